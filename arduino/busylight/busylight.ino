@@ -155,9 +155,9 @@
 ** Responses:
 ** ?
 **     L <L0> <l1> ... <L6> $ F <flasher-status> $ S <strober-status> $ \n
-**        <*-status> ::= <running?> _             (no sequence)
-**                     | <running?> <pos> @ (<colorcode>|<digit>)*
-**        <running?> ::= R=running | S=stopped
+**        <*-status> ::= <lit?> X                 (no sequence)
+**                     | <lit?> <pos> @ (<colorcode>|<digit>|_)*
+**        <lit?> ::= R=light at <pos> is lit | S=it isn't
 **        <pos> ::= encoded position value 0-63 as 0-9:;<=>?@A-Z[\]^_`a-o (numeric value+48)
 **        <Ln> ::= <colorcode>|<digit>|_ (off)|? (out of range)
 **
@@ -264,11 +264,11 @@ void LightBlinker::report_state(void)
 		for (i = 0; i < sequence_length; i++) {
 			if (sequence[i] == SEQUENCE_OFF) {
 				Serial.write('_');
-			} else if (i >= COUNTOF(tree_port)) {
+			} else if (sequence[i] >= COUNTOF(tree_port)) {
 				Serial.write('?');
 			} else {
-				if (i < strlen(THIS_DEVICE_COLOR_MAP)) {
-					Serial.write(THIS_DEVICE_COLOR_MAP[i]);
+				if (sequence[i] < strlen(THIS_DEVICE_COLOR_MAP)) {
+					Serial.write(THIS_DEVICE_COLOR_MAP[sequence[i]]);
 				} else {
 					Serial.write(sequence[i] + '0');
 				}
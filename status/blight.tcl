@@ -66,85 +66,40 @@ proc save_activities {filename data} {
 }
 
 #
-# Update the device status by running busylight -query
-# Raw response data: [76 48 48 48 48 49 48 48 70 49 88 83 48 88]
-#
-# response string is
-#                  sequence
-#            index  __|___
-#                | /      \
-#                n@xxxxx...         n@xxxxx...
-#    L011100...F0X                S0X             \n
-#     \______/ :| \              :             :
-#        |     :|  if no sequence:             :
-#      0=off  0=off              :             :
-#      1=on   1=on               :             :
-#    Each LED timer              :             :
-#              |_________________|_____________|
-#                   flasher         strober
+# Update the device status by running busylight -query -json
+# (see JSON OUTPUT in busylight(1) for what it reports)
 #
 proc _update_status {statevar} {
 	upvar $statevar s
 
+	# busylight exits with a non-zero status if anything went wrong, even if it could
+	# still tell us what the device is doing, so we go by what it reports instead.
 	if [catch {
-		if [regexp {Raw response data: \[(.*?)\]} [exec busylight -query] _ raw_data] {
-		} else {
-			error "unable to get light status"
-		}
+		set f [open "|busylight -query -json"]
+		set report [::json::json2dict [read $f]]
+		catch {close $f}
 	} err] {
 		error "error getting light status: $err"
 	}
-
-	set state {}
-	set fseq {}
-	set sseq {}
-	dict set s IsLightOn {}
-	foreach byte $raw_data {
-		switch -exact -- $byte {
-			76 { set state lights }
-			70 { set state flasher }
-			83 { set state strober }
-			88 { set state {} }
-			64 { append state ,sequence }
-			48 - 49 { 
-				if {$byte eq 48} {
-					set value false
-					set svalue 0
-				} else {
-					set value true
-					set svalue 1
-				}
-
-				switch -exact -- $state {
-					fpos,sequence {lappend fseq $svalue}
-					spos,sequence {lappend sseq $svalue}
-					flasher       {dict set s Flasher IsOn $value; set state fpos}
-					strober       {dict set s Strober IsOn $value; set state spos}
-					fpos          {}
-					spos          {}
-					lights        {dict lappend s IsLightOn $value}
-					default {
-						error "unexpected byte $byte w/o state ($raw_data)"
-					}
-				}
-			}
-			50 - 51 - 52 - 53 - 54 {
-				switch -exact -- $state {
-					fpos,sequence {lappend fseq [format %c $byte]}
-					spos,sequence {lappend sseq [format %c $byte]}
-					default {
-						error "unexpected byte $byte outside sequence ($raw_data)"
-					}
-				}
-			}
-			
-			default {
-				error "unexpected byte $byte in device status ($raw_data)"
+	if {![dict exists $report Device]} {
+		set problems {}
+		if {[dict exists $report Warnings]} {
+			foreach w [dict get $report Warnings] {
+				lappend problems [dict get $w Message]
 			}
 		}
+		error "error getting light status: [join $problems {; }]"
+	}
+	set device [dict get $report Device]
+
+	dict set s IsLightOn {}
+	foreach light [dict get $device Lights] {
+		dict lappend s IsLightOn [dict get $light On]
+	}
+	foreach timer {Flasher Strober} {
+		dict set s $timer IsOn [dict get $device $timer IsOn]
+		dict set s $timer Sequence [dict get $device $timer Sequence]
 	}
-	dict set s Flasher Sequence $fseq
-	dict set s Strober Sequence $sseq
 }
 
 proc signal_error {message} {
@@ -295,7 +250,9 @@ proc do_busylight {args} {
 
 proc busylight {args} {
 	global config_data dev_state
-	exec busylight {*}$args
+	if {[catch {exec busylight {*}$args} err]} {
+		signal_error $err
+	}
 	_blank_lights
 	update
 	after 1000
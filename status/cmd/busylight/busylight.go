@@ -12,29 +12,23 @@ import (
 	"flag"
 	"fmt"
 	"internal/busylight"
-	"io/ioutil"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/user"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
-func fatal(format string, a ...interface{}) {
-	fmt.Printf(format, a...)
-	os.Exit(1)
-}
-
+// getDaemonProcess finds the running daemon from its PID file, but only believes it if the
+// daemon holds the file's lock (or that process really is the daemon), so we don't signal
+// some unrelated process which happens to have reused a stale PID. We don't ask the daemon
+// itself, since that would start it if it's waiting to be activated by its socket.
 func getDaemonProcess(config *busylight.ConfigData) *os.Process {
-	pidbytes, err := ioutil.ReadFile(config.PidFile)
-	if err != nil {
-		return nil
-	}
-
-	pid, err := strconv.Atoi(strings.TrimSuffix(string(pidbytes), "\n"))
-	if err != nil {
+	pid := busylight.DaemonPID(config)
+	if pid == 0 {
 		return nil
 	}
 
@@ -45,11 +39,54 @@ func getDaemonProcess(config *busylight.ConfigData) *os.Process {
 	return process
 }
 
+// tellDaemon asks the daemon to do something via its control socket, falling back
+// to sending it a signal if it can't be reached that way.
+func tellDaemon(config *busylight.ConfigData, daemon *os.Process, path string, sig syscall.Signal) {
+	if err := busylight.DaemonRequest(config, http.MethodPost, path, nil, nil); err == nil {
+		return
+	}
+	if daemon == nil {
+		warn(fmt.Errorf("%w, so I can't signal it", busylight.ErrNoDaemon))
+	} else {
+		daemon.Signal(sig)
+	}
+}
+
+// parseUntil interprets a time given on the command line for -until.
+// A bare time of day refers to the next time the clock reads that time.
+func parseUntil(value string) (time.Time, error) {
+	now := time.Now()
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"15:04", "15:04:05", "3:04pm", "3:04PM", "3pm", "3PM"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local)
+			if !t.After(now) {
+				t = t.AddDate(0, 0, 1)
+			}
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't understand \"%s\" as a time (try HH:MM)", value)
+}
+
 func main() {
 	var config busylight.ConfigData
 	var devState busylight.DevState
 
-	devState.Logger = log.New(os.Stdout, "busylight: ", log.LstdFlags)
+	// Messages from the library go to the standard error, so they don't get mixed into
+	// what we print (especially a JSON document from -json).
+	devState.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
 	var Fmute = flag.Bool("mute", false, "muted mic in meeting")
 	var Fopen = flag.Bool("open", false, "open mic in meeting")
 	var Fcal = flag.Bool("cal", false, "leave meeting; back to calendar status")
@@ -57,12 +94,63 @@ func main() {
 	var Fwake = flag.Bool("wake", false, "wake daemon from sleep")
 	var Fkill = flag.Bool("kill", false, "terminate busylight service")
 	var Freload = flag.Bool("reload", false, "reload calendar data")
+	var Freopenlog = flag.Bool("reopenlog", false, "have the daemon reopen its log file")
 	var Fstatus = flag.String("status", "", "set custom status by name")
+	var Ffor = flag.Duration("for", 0, "with -status or -flag, have the daemon show that status for this long; with -preview, show it for this long")
+	var Funtil = flag.String("until", "", "with -status or -flag, have the daemon show that status until this time")
+	var Fcancel = flag.Bool("cancel", false, "cancel status set with -for or -until")
+	var Fflag = flag.String("flag", "", "have the daemon show status by name on top of its usual status")
+	var Funflag = flag.Bool("unflag", false, "cancel status set with -flag")
 	var Fraw = flag.String("raw", "", "send raw command to device")
 	var Flist = flag.Bool("list", false, "list defined status codes")
 	var Fquery = flag.Bool("query", false, "report current status of lights")
+	var Fexplain = flag.Bool("explain", false, "explain how the daemon chose the status it is showing")
+	var Factivity = flag.String("activity", "", "have the daemon start keeping time for an activity by name")
+	var Fendactivity = flag.Bool("endactivity", false, "have the daemon stop keeping time for the current activity")
+	var Factivities = flag.Bool("activities", false, "list activities and the time spent on each")
+	var Fcleartimes = flag.Bool("cleartimes", false, "set the time spent on every activity back to zero")
+	var Fhistory = flag.Bool("history", false, "show the history of statuses the daemon has shown")
+	var Freport = flag.Bool("report", false, "report the time spent on each activity, status, and calendar")
+	var Ffrom = flag.String("from", "", "with -history or -report, start at this time (or this long ago)")
+	var Fto = flag.String("to", "", "with -history or -report, end at this time (or this long ago)")
+	var Fwatch = flag.Bool("watch", false, "report changes in the daemon's state as they happen")
+	var Fpreview = flag.String("preview", "", "show what a status (or raw command) would make the lights do, without touching the device")
+	var Fexport = flag.String("export", "", "with -preview, save the lights as an animated GIF or SVG image in this file")
+	var Fformat = flag.String("format", "text", "with -history, output format (text, csv, or json); with -report, (text, csv, json, or ics); with -watch, (text or json)")
+	var Fjson = flag.Bool("json", false, "report results as JSON (same as -format json for -history, -report, and -watch)")
 	var daemon *os.Process
+	flag.Usage = func() { usage(flag.CommandLine.Output()) }
 	flag.Parse()
+	jsonOutput = *Fjson
+
+	// A subcommand stands for one of the options above (or is run on its own, below).
+	var command *subcommand
+	var commandArg string
+	if flag.NArg() > 0 {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name != "json" {
+				usageError("Only -json may come before a command; give the command's options after it.\n")
+			}
+		})
+		command, commandArg = parseSubcommand(flag.Args())
+		jsonOutput = *Fjson
+	}
+
+	// Note which options were given, and whether we're asked for anything but -watch
+	// (apart from how to report things).
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	onlyWatching := *Fwatch
+	for name := range given {
+		if name != "watch" && name != "json" && name != "format" {
+			onlyWatching = false
+		}
+	}
+
+	if command != nil && command.noConfig {
+		command.run(&config, "", commandArg)
+		finish()
+	}
 
 	//
 	// Find the user and from there the configuration file
@@ -72,38 +160,94 @@ func main() {
 		fatal("Who are you? (%v)\n", err)
 	}
 
-	if err = busylight.GetConfigFromFile(
-		filepath.Join(thisUser.HomeDir, ".busylight/config.json"),
-		&config); err != nil {
+	configPath := filepath.Join(thisUser.HomeDir, ".busylight/config.json")
+	if err = busylight.GetConfigFromFile(configPath, &config); err != nil {
 		fatal("Can't initialize: %v\n", err)
 	}
 
-	if *Flist {
-		fmt.Println("Defined status codes usable with the --status option:")
-		fmt.Println("CODE------  LIGHT-EFFECT")
-		for code, def := range config.StatusLights {
-			fmt.Printf("%-10s  %s\n", code, def)
+	if command != nil && command.run != nil {
+		command.run(&config, configPath, commandArg)
+		finish()
+	}
+
+	if *Funtil != "" && *Fstatus == "" && *Fflag == "" {
+		usageError("The -until option requires -status or -flag.\n")
+	}
+	if *Ffor != 0 && *Fstatus == "" && *Fflag == "" && *Fpreview == "" {
+		usageError("The -for option requires -status, -flag, or -preview.\n")
+	}
+	if *Ffor != 0 && *Funtil != "" {
+		usageError("The -for and -until options may not be used together.\n")
+	}
+	if *Ffor < 0 {
+		usageError("The -for duration must be positive.\n")
+	}
+	if (*Ffrom != "" || *Fto != "") && !*Fhistory && !*Freport {
+		usageError("The -from and -to options require -history or -report.\n")
+	}
+	if *Fexport != "" && *Fpreview == "" {
+		usageError("The -export option requires -preview.\n")
+	}
+	if given["format"] && !*Fhistory && !*Freport && !*Fwatch {
+		usageError("The -format option requires -history, -report, or -watch.\n")
+	}
+	if err := checkCombination(given); err != nil {
+		usageError("Invalid combination of options: %v.\n", err)
+	}
+	if *Fjson {
+		if given["format"] && *Fformat != "json" {
+			usageError("The -json option may not be used with -format %s.\n", *Fformat)
+		}
+		*Fformat = "json"
+	}
+
+	if *Fpreview != "" {
+		if err := showPreview(&config, *Fpreview, *Ffor, *Fexport); err != nil {
+			fatal("Can't preview: %v\n", err)
+		}
+		finish()
+	}
+
+	if *Fhistory || *Freport {
+		var from, to time.Time
+		if *Ffrom != "" {
+			if from, err = parsePast(*Ffrom); err != nil {
+				fatal("Invalid -from value: %v\n", err)
+			}
+		}
+		if *Fto != "" {
+			if to, err = parsePast(*Fto); err != nil {
+				fatal("Invalid -to value: %v\n", err)
+			}
+		}
+		if *Freport {
+			if err := showReport(&config, &devState, from, to, *Fformat); err != nil {
+				fatal("Can't make report: %v\n", err)
+			}
+		} else if err := showHistory(&config, &devState, from, to, *Fformat); err != nil {
+			fatal("Can't show history: %v\n", err)
 		}
 		return
 	}
 
+	if *Flist {
+		listStatuses(&config)
+		finish()
+	}
+
 	if *Fmute || *Fopen || *Fcal || *Fzzz || *Fwake || *Fkill || *Freload || *Fquery {
 		daemon = getDaemonProcess(&config)
 	}
 
 	if *Fwake {
-		if daemon == nil {
-			fmt.Printf("Warning: unable to find daemon, so I can't signal it.\n")
-		} else {
-			daemon.Signal(syscall.SIGVTALRM)
-		}
+		tellDaemon(&config, daemon, "/wake", syscall.SIGVTALRM)
 	}
 
 	if *Fmute {
 		if daemon == nil {
-			fmt.Printf("Warning: unable to find daemon. Sending direct \"mute\" status\n")
+			note("Warning: unable to find daemon. Sending direct \"mute\" status\n")
 			if err := busylight.LightSignal(&config, &devState, "mute", 0); err != nil {
-				fmt.Printf("Warning: %v\n", err)
+				warn(err)
 			}
 		} else {
 			daemon.Signal(syscall.SIGUSR1)
@@ -112,9 +256,9 @@ func main() {
 
 	if *Fopen {
 		if daemon == nil {
-			fmt.Printf("Warning: unable to find daemon. Sending direct \"open\" status\n")
+			note("Warning: unable to find daemon. Sending direct \"open\" status\n")
 			if err := busylight.LightSignal(&config, &devState, "open", 0); err != nil {
-				fmt.Printf("Warning: %v\n", err)
+				warn(err)
 			}
 		} else {
 			daemon.Signal(syscall.SIGUSR2)
@@ -123,75 +267,227 @@ func main() {
 
 	if *Fcal {
 		if daemon == nil {
-			fmt.Printf("Warning: unable to find daemon. I don't know what status to send.\n")
+			warn(fmt.Errorf("%w, so I don't know what status to send", busylight.ErrNoDaemon))
 		} else {
 			daemon.Signal(syscall.SIGHUP)
 		}
 	}
 
 	if *Fkill {
-		if daemon == nil {
-			fmt.Printf("Warning: unable to find daemon, so I can't signal it.\n")
-		} else {
-			daemon.Signal(syscall.SIGINT)
-		}
+		tellDaemon(&config, daemon, "/shutdown", syscall.SIGINT)
 	}
 
 	if *Freload {
 		if daemon == nil {
-			fmt.Printf("Warning: unable to find daemon, so I can't signal it.\n")
+			warn(fmt.Errorf("%w, so I can't signal it", busylight.ErrNoDaemon))
 		} else {
 			daemon.Signal(syscall.SIGPWR)
 		}
 	}
 
+	if *Freopenlog {
+		if err := busylight.DaemonRequest(&config, http.MethodPost, "/reopen-log", nil, nil); err != nil {
+			warn(err)
+		}
+	}
+
+	var expires time.Time
+	if *Funtil != "" {
+		if expires, err = parseUntil(*Funtil); err != nil {
+			fatal("Invalid -until value: %v\n", err)
+		}
+	} else if *Ffor != 0 {
+		expires = time.Now().Add(*Ffor)
+	}
+
+	if *Fcancel {
+		if err := busylight.DaemonRequest(&config, http.MethodDelete, "/override", nil, nil); err != nil {
+			warn(err)
+		}
+	}
+
+	if *Funflag {
+		if err := busylight.DaemonRequest(&config, http.MethodDelete, "/flag", nil, nil); err != nil {
+			warn(err)
+		}
+	}
+
+	if *Fflag != "" {
+		if err := busylight.DaemonRequest(&config, http.MethodPut, "/flag", busylight.Override{Status: *Fflag, Until: expires}, nil); err != nil {
+			warn(err)
+		}
+	}
+
 	if *Fstatus != "" {
-		if err := busylight.LightSignal(&config, &devState, *Fstatus, 0); err != nil {
-			fmt.Printf("Warning: %v\n", err)
+		if !expires.IsZero() {
+			if err := busylight.DaemonRequest(&config, http.MethodPut, "/override", busylight.Override{Status: *Fstatus, Until: expires}, nil); err != nil {
+				warn(err)
+			}
+		} else {
+			if err := busylight.LightSignal(&config, &devState, *Fstatus, 0); err != nil {
+				warn(err)
+			}
 		}
 	}
 
 	if *Fraw != "" {
 		if err := busylight.RawLightSignal(&config, &devState, *Fraw, 0); err != nil {
-			fmt.Printf("Warning: %v\n", err)
+			warn(err)
 		}
 	}
 
 	if *Fzzz {
-		if daemon == nil {
-			fmt.Printf("Warning: unable to find daemon, so I can't signal it.\n")
+		tellDaemon(&config, daemon, "/sleep", syscall.SIGWINCH)
+	}
+
+	if *Fendactivity {
+		if err := busylight.DaemonRequest(&config, http.MethodDelete, "/activity", nil, nil); err != nil {
+			warn(err)
+		}
+	}
+
+	if *Factivity != "" {
+		if err := busylight.DaemonRequest(&config, http.MethodPut, "/activity", busylight.Activity{Name: *Factivity}, nil); err != nil {
+			warn(err)
+		}
+	}
+
+	if *Fcleartimes {
+		if err := busylight.DaemonRequest(&config, http.MethodDelete, "/activities", nil, nil); err != nil {
+			warn(err)
+		}
+	}
+
+	if *Factivities {
+		var activities []busylight.Activity
+		if err := busylight.DaemonRequest(&config, http.MethodGet, "/activities", nil, &activities); err != nil {
+			warn(err)
+		} else if jsonOutput {
+			report.Activities = &activities
+		} else {
+			showActivities(activities)
+		}
+	}
+
+	if *Fexplain {
+		var ex busylight.Explanation
+		if err := busylight.DaemonRequest(&config, http.MethodGet, "/explain", nil, &ex); err != nil {
+			warn(err)
+		} else if jsonOutput {
+			report.Explanation = &ex
 		} else {
-			daemon.Signal(syscall.SIGWINCH)
+			showExplanation(ex)
 		}
 	}
 
 	if *Fquery {
-		if state, err := busylight.QueryStatus(&config, &devState, 0); err == nil {
+		if jsonOutput {
+			queryJSON(&config, &devState, daemon)
+		} else if state, err := busylight.QueryStatus(&config, &devState, 0); err == nil {
 			if daemon == nil {
 				fmt.Println("Daemon NOT running.")
 			} else {
 				fmt.Printf("Daemon running, pid=%v.\n", daemon.Pid)
-			}
-			fmt.Println("Current hardware status:")
-			fmt.Printf("  Raw response data: %v\n", state.RawResponse[:state.ResponseLength])
-			fmt.Print("  Individual LEDs:   ")
-			for i, on := range state.IsLightOn {
-				if on {
-					if i < len(config.Colors) {
-						fmt.Printf("%c", config.Colors[i])
-					} else {
-						fmt.Print("X")
-					}
+				var ds busylight.DaemonStatus
+				if err := busylight.DaemonRequest(&config, http.MethodGet, "/status", nil, &ds); err != nil {
+					warn(err)
 				} else {
-					fmt.Print("-")
+					if ds.Layer != "" {
+						fmt.Printf("Daemon showing \"%s\" from %s layer (%s).\n", ds.Status, ds.Layer, ds.Reason)
+					}
+					showOverride("Status overridden to", ds.Override)
+					showOverride("Flagged with", ds.Flag)
 				}
 			}
-			fmt.Print("\n")
+			fmt.Println("Current hardware status:")
+			fmt.Printf("  Raw response data: %v\n", state.RawResponse[:state.ResponseLength])
+			fmt.Printf("  Individual LEDs:   %s\n", renderLights(&config, state.IsLightOn, useColor(os.Stdout)))
 			showSequence("Flasher", config, state.Flasher)
 			showSequence("Strober", config, state.Strober)
 		} else {
-			fmt.Printf("Warning: %v\n", err)
+			warn(err)
+		}
+	}
+
+	// This comes last, since it carries on until interrupted.
+	if *Fwatch {
+		if !onlyWatching {
+			writeReport()
+		}
+		if err := watchDaemon(&config, *Fformat); err != nil {
+			die(exitCode(err), fmt.Sprintf("Can't watch daemon: %v\n", err))
+		}
+	}
+	finish()
+}
+
+func showExplanation(ex busylight.Explanation) {
+	if len(ex.Layers) > 0 {
+		fmt.Println("Layers offering a status (highest priority first):")
+		fmt.Println("  LAYER------ PRI STATUS----- REASON")
+		overlays := false
+		for _, l := range ex.Layers {
+			name := l.Name
+			if l.Overlay {
+				name += "*"
+				overlays = true
+			}
+			fmt.Printf("  %-11s %3d %-11s %s", name, l.Priority, l.Status, l.Reason)
+			if !l.Expires.IsZero() {
+				fmt.Printf(" (expires %s)", l.Expires.Local().Format("15:04:05"))
+			}
+			fmt.Println()
+		}
+		if overlays {
+			fmt.Println("  (* = overlay shown on top of the others)")
+		}
+		fmt.Printf("Status from layers: \"%s\" from %s layer.\n", ex.Resolved, ex.ResolvedLayer)
+	}
+	if len(ex.Rules) == 0 {
+		fmt.Println("No rules checked.")
+	}
+	for _, r := range ex.Rules {
+		if r.Matched {
+			fmt.Printf("Rule %s APPLIES:\n", r.Name)
+		} else {
+			fmt.Printf("Rule %s does not apply:\n", r.Name)
+		}
+		for _, d := range r.Details {
+			fmt.Printf("  %s\n", d)
+		}
+	}
+	if ex.Rule != "" {
+		fmt.Printf("Showing \"%s\" because of rule %s.\n", ex.Status, ex.Rule)
+	} else {
+		fmt.Printf("Showing \"%s\" (%s).\n", ex.Status, ex.Reason)
+	}
+}
+
+func showActivities(activities []busylight.Activity) {
+	if len(activities) == 0 {
+		fmt.Println("No activities defined.")
+		return
+	}
+	fmt.Println(" ACTIVITY---------- TIME-- STATUS")
+	for _, a := range activities {
+		marker := " "
+		if a.Active {
+			marker = "*"
 		}
+		fmt.Printf("%s%-18s %3d:%02d %s\n", marker, a.Name, a.Elapsed/60, a.Elapsed%60, strings.Join(a.Status, ", "))
+	}
+	fmt.Println("(* = going on now)")
+}
+
+func showOverride(description string, o *busylight.Override) {
+	if o == nil {
+		return
+	}
+	if o.Until.IsZero() {
+		fmt.Printf("%s \"%s\" until cancelled.\n", description, o.Status)
+	} else {
+		fmt.Printf("%s \"%s\" until %s (%v remaining).\n", description, o.Status,
+			o.Until.Format("15:04:05"), time.Until(o.Until).Round(time.Second))
 	}
 }
 
@@ -199,7 +495,9 @@ func showSequence(name string, config busylight.ConfigData, seq busylight.LightS
 	if len(seq.Sequence) > 0 {
 		fmt.Printf("  %s: ", name)
 		for _, led := range seq.Sequence {
-			if int(led) < len(config.Colors) {
+			if led == busylight.LightOff {
+				fmt.Print("_")
+			} else if int(led) < len(config.Colors) {
 				fmt.Printf("%c", config.Colors[int(led)])
 			} else {
 				fmt.Printf("%d", led)
@@ -0,0 +1,387 @@
+//
+// Subcommands for busylight.
+//
+// Each subcommand (such as "busylight status set busy -for 1h") stands
+// for one of the original options (here, "-status busy -for 1h"), which
+// still work as they always have. A subcommand's own options are the
+// very same flags, so either way of asking ends up doing the same thing.
+// A few subcommands (such as "config check") have no option of their
+// own and are run directly instead.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"internal/busylight"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// subcommand describes one of busylight's subcommands.
+type subcommand struct {
+	name     string   // the words which invoke it, such as "status set"
+	arg      string   // what its argument is called, if it takes one
+	option   string   // the original option it stands for (given the argument, if any)
+	flags    []string // the other options which may be used with it
+	summary  string   // what it does, in a line
+	complete string   // what its argument may be: "statuses", "activities", or a list of words
+	noConfig bool     // can it be run without reading the configuration?
+
+	// What to do, for subcommands which don't stand for an option.
+	run func(config *busylight.ConfigData, configPath, arg string)
+}
+
+var subcommands = []subcommand{
+	{name: "status set", arg: "name", option: "status", flags: []string{"for", "until"}, complete: "statuses",
+		summary: "show a status (via the daemon, if only for a while)"},
+	{name: "status cancel", option: "cancel",
+		summary: "cancel a status set for a while with status set"},
+	{name: "status flag", arg: "name", option: "flag", flags: []string{"for", "until"}, complete: "statuses",
+		summary: "have the daemon show a status on top of its usual status"},
+	{name: "status unflag", option: "unflag",
+		summary: "cancel a status set with status flag"},
+	{name: "status list", option: "list",
+		summary: "list the statuses defined in the configuration"},
+	{name: "status names", run: printStatusNames,
+		summary: "print the name of each status which may be shown, one per line"},
+	{name: "status explain", option: "explain",
+		summary: "explain how the daemon chose the status it is showing"},
+	{name: "status preview", arg: "name", option: "preview", flags: []string{"for", "export"}, complete: "statuses",
+		summary: "show what a status (or raw command) would make the lights do"},
+	{name: "meeting mute", option: "mute",
+		summary: "tell the daemon we're in a meeting with the microphone muted"},
+	{name: "meeting open", option: "open",
+		summary: "tell the daemon we're in a meeting with the microphone open"},
+	{name: "meeting end", option: "cal",
+		summary: "tell the daemon the meeting is over"},
+	{name: "activity start", arg: "name", option: "activity", complete: "activities",
+		summary: "have the daemon start keeping time for an activity"},
+	{name: "activity stop", option: "endactivity",
+		summary: "have the daemon stop keeping time for the current activity"},
+	{name: "activity list", option: "activities",
+		summary: "list the activities and the time spent on each"},
+	{name: "activity clear", option: "cleartimes",
+		summary: "set the time spent on every activity back to zero"},
+	{name: "activity names", run: printActivityNames,
+		summary: "print the name of each activity, one per line"},
+	{name: "daemon wake", option: "wake",
+		summary: "wake the daemon from sleep"},
+	{name: "daemon sleep", option: "zzz",
+		summary: "put the daemon to sleep"},
+	{name: "daemon stop", option: "kill",
+		summary: "stop the daemon"},
+	{name: "daemon reload", option: "reload",
+		summary: "have the daemon poll the calendars now"},
+	{name: "daemon reopen-log", option: "reopenlog",
+		summary: "have the daemon reopen its log file"},
+	{name: "daemon watch", option: "watch", flags: []string{"format"},
+		summary: "report changes in the daemon's state as they happen"},
+	{name: "device send", arg: "command", option: "raw",
+		summary: "send a raw command to the device"},
+	{name: "query", option: "query",
+		summary: "report what the daemon and the device are doing"},
+	{name: "history", option: "history", flags: []string{"from", "to", "format"},
+		summary: "show the history of statuses the daemon has shown"},
+	{name: "report", option: "report", flags: []string{"from", "to", "format"},
+		summary: "report the time spent on each activity, status, and calendar"},
+	{name: "config path", run: printConfigPath,
+		summary: "print the name of the configuration file"},
+	{name: "config check", run: checkConfigFile,
+		summary: "check the configuration file for mistakes"},
+	{name: "completion", arg: "shell", complete: "bash zsh fish", noConfig: true,
+		summary: "print a script which completes busylight's commands in bash, zsh, or fish"},
+	{name: "help", arg: "[command]", noConfig: true,
+		summary: "describe a command, or list them all"},
+}
+
+// exclusiveOptions are sets of options which contradict each other, so no more than one
+// of each set may be given at a time.
+var exclusiveOptions = [][]string{
+	{"mute", "open", "cal"},
+	{"wake", "zzz"},
+	{"status", "raw"},
+	{"flag", "unflag"},
+	{"activity", "endactivity"},
+}
+
+// soloOptions are options which may not be given with any others, apart from those which
+// only modify how they work (see optionModifiers).
+var soloOptions = []string{"list", "preview", "history", "report", "kill"}
+
+// optionModifiers are the options which only modify how others work.
+var optionModifiers = map[string]bool{
+	"for": true, "until": true, "from": true, "to": true, "format": true, "export": true, "json": true,
+}
+
+// checkCombination makes sure the options given make sense together.
+func checkCombination(given map[string]bool) error {
+	for _, set := range exclusiveOptions {
+		var found []string
+		for _, name := range set {
+			if given[name] {
+				found = append(found, "-"+name)
+			}
+		}
+		if len(found) > 1 {
+			return fmt.Errorf("the %s options may not be used together", strings.Join(found, " and "))
+		}
+	}
+	for _, solo := range soloOptions {
+		if !given[solo] {
+			continue
+		}
+		for name := range given {
+			if name != solo && !optionModifiers[name] {
+				return fmt.Errorf("the -%s option may not be used with other options (such as -%s)", solo, name)
+			}
+		}
+	}
+	return nil
+}
+
+// findSubcommand returns the subcommand invoked by the start of args, and how many of
+// them name it, or nil if there isn't one.
+func findSubcommand(args []string) (*subcommand, int) {
+	for i := range subcommands {
+		words := strings.Fields(subcommands[i].name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == subcommands[i].name {
+			return &subcommands[i], len(words)
+		}
+	}
+	return nil, 0
+}
+
+// subcommandGroup returns the subcommands whose names start with the given word.
+func subcommandGroup(word string) []subcommand {
+	var group []subcommand
+	for _, c := range subcommands {
+		if first, _, _ := strings.Cut(c.name, " "); first == word {
+			group = append(group, c)
+		}
+	}
+	return group
+}
+
+// parseSubcommand works out which subcommand the arguments ask for and sets the options it
+// stands for, returning the subcommand and its argument. The subcommand's options may come
+// before or after its argument.
+func parseSubcommand(args []string) (*subcommand, string) {
+	command, n := findSubcommand(args)
+	if command == nil {
+		if group := subcommandGroup(args[0]); len(group) > 0 && len(args) == 1 {
+			listSubcommands(os.Stderr, group)
+			usageError("Which %s command? (See above.)\n", args[0])
+		}
+		usageError("Unknown command \"%s\" (see \"busylight help\").\n", strings.Join(args, " "))
+	}
+	if command.name == "help" {
+		showHelp(args[1:])
+		os.Exit(exitOK)
+	}
+
+	fs := newSubcommandFlags(command)
+	var positional []string
+	for rest := args[n:]; ; {
+		if err := fs.Parse(rest); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				os.Exit(exitOK)
+			}
+			os.Exit(exitUsage)
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		rest = fs.Args()[1:]
+	}
+
+	switch {
+	case command.arg == "" && len(positional) > 0:
+		usageError("The %s command doesn't take an argument (see \"busylight help %s\").\n", command.name, command.name)
+	case command.arg != "" && len(positional) != 1:
+		usageError("The %s command needs one argument, the %s (see \"busylight help %s\").\n", command.name, command.arg, command.name)
+	}
+	var arg string
+	if len(positional) > 0 {
+		arg = positional[0]
+	}
+
+	// Record the options given to the subcommand as given, so they're checked like any others.
+	fs.Visit(func(f *flag.Flag) { flag.Set(f.Name, f.Value.String()) })
+	if command.option != "" {
+		value := arg
+		if command.arg == "" {
+			value = "true"
+		}
+		if err := flag.Set(command.option, value); err != nil {
+			usageError("Invalid %s for the %s command: %v\n", command.arg, command.name, err)
+		}
+	}
+	return command, arg
+}
+
+// newSubcommandFlags makes a flag set for a subcommand, sharing its flags with the
+// original options (so setting one sets the other).
+func newSubcommandFlags(command *subcommand) *flag.FlagSet {
+	fs := flag.NewFlagSet("busylight "+command.name, flag.ContinueOnError)
+	for _, name := range append(command.flags, "json") {
+		f := flag.Lookup(name)
+		fs.Var(f.Value, name, f.Usage)
+	}
+	fs.Usage = func() { describeSubcommand(fs.Output(), command, fs) }
+	return fs
+}
+
+// describeSubcommand prints the help for a subcommand.
+func describeSubcommand(w io.Writer, command *subcommand, fs *flag.FlagSet) {
+	usage := "busylight " + command.name
+	if len(command.flags) > 0 {
+		usage += " [options]"
+	}
+	if command.arg != "" {
+		usage += " " + command.arg
+	}
+	fmt.Fprintf(w, "Usage: %s\n\n%s%s.\n", usage, strings.ToUpper(command.summary[:1]), command.summary[1:])
+	if command.option != "" {
+		old := "-" + command.option
+		if command.arg != "" {
+			old += " " + command.arg
+		}
+		fmt.Fprintf(w, "(This is the same as \"busylight %s\".)\n", old)
+	}
+	switch command.complete {
+	case "", "statuses", "activities":
+	default:
+		fmt.Fprintf(w, "The %s is one of: %s.\n", command.arg, strings.Join(strings.Fields(command.complete), ", "))
+	}
+	if fs != nil {
+		fmt.Fprintf(w, "\nOptions:\n")
+		fs.SetOutput(w)
+		fs.PrintDefaults()
+	}
+}
+
+// listSubcommands prints a summary of each of the subcommands given.
+func listSubcommands(w io.Writer, commands []subcommand) {
+	fmt.Fprintf(w, "Commands:\n")
+	for _, c := range commands {
+		name := c.name
+		if c.arg != "" {
+			name += " " + c.arg
+		}
+		fmt.Fprintf(w, "  %-25s %s\n", name, c.summary)
+	}
+}
+
+// showHelp prints the help for the subcommand (or group of subcommands) named, or for
+// busylight as a whole if none is named.
+func showHelp(args []string) {
+	if len(args) == 0 {
+		usage(os.Stdout)
+		return
+	}
+	if command, n := findSubcommand(args); command != nil && n == len(args) {
+		var fs *flag.FlagSet
+		if command.name != "help" {
+			fs = newSubcommandFlags(command)
+		}
+		describeSubcommand(os.Stdout, command, fs)
+		return
+	}
+	if group := subcommandGroup(args[0]); len(group) > 0 && len(args) == 1 {
+		listSubcommands(os.Stdout, group)
+		return
+	}
+	usageError("Unknown command \"%s\" (see \"busylight help\").\n", strings.Join(args, " "))
+}
+
+// usage prints the help for busylight as a whole, for -help and "busylight help".
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: busylight [-json] command [options] [argument]\n")
+	fmt.Fprintf(w, "   or: busylight [options]\n\n")
+	listSubcommands(w, subcommands)
+	fmt.Fprintf(w, "\nUse \"busylight help command\" for more about a command.\n\nOptions:\n")
+	flag.CommandLine.SetOutput(w)
+	flag.PrintDefaults()
+}
+
+// printStatusNames prints the name of each status, for "status names".
+func printStatusNames(config *busylight.ConfigData, configPath, arg string) {
+	printNames(busylight.StatusNames(config))
+}
+
+// printActivityNames prints the name of each activity, for "activity names". We ask the
+// daemon if we can, since it knows best; otherwise, we look for them ourselves as it would.
+func printActivityNames(config *busylight.ConfigData, configPath, arg string) {
+	activities := config.Activities
+	if err := busylight.DaemonRequest(config, http.MethodGet, "/activities", nil, &activities); err != nil && len(activities) == 0 {
+		if activities, err = busylight.ReadActivities(busylight.ActivityPath(config)); err != nil {
+			warn(err)
+		}
+	}
+	var names []string
+	for _, a := range activities {
+		names = append(names, a.Name)
+	}
+	printNames(names)
+}
+
+func printNames(names []string) {
+	if jsonOutput {
+		if names == nil {
+			names = []string{}
+		}
+		report.Names = &names
+		return
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+}
+
+// printConfigPath prints the name of the configuration file, for "config path".
+func printConfigPath(config *busylight.ConfigData, configPath, arg string) {
+	if jsonOutput {
+		report.Config = &configReport{Path: configPath}
+	} else {
+		fmt.Println(configPath)
+	}
+}
+
+// checkConfigFile reports any mistakes found in the configuration, for "config check".
+func checkConfigFile(config *busylight.ConfigData, configPath, arg string) {
+	problems := checkConfig(config)
+	if len(problems) > 0 {
+		exitStatus = exitError
+	}
+	if jsonOutput {
+		if problems == nil {
+			problems = []string{}
+		}
+		report.Config = &configReport{Path: configPath, Problems: &problems}
+		return
+	}
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", configPath, p)
+	}
+	if len(problems) == 0 {
+		fmt.Printf("No problems found in %s.\n", configPath)
+	}
+}
+
+// optionNames returns the names of all of busylight's options, in alphabetical order.
+func optionNames() []string {
+	var names []string
+	flag.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+	sort.Strings(names)
+	return names
+}
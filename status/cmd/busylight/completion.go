@@ -0,0 +1,313 @@
+//
+// Shell completion scripts for busylight completion.
+//
+// The scripts are made from the table of subcommands and options, so they
+// always match this version of busylight. The names of statuses and
+// activities aren't built in; the scripts ask busylight for them ("busylight
+// status names" and "busylight activity names") as they're needed, so they
+// keep up with changes to the configuration.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"internal/busylight"
+	"strings"
+)
+
+// completionWords are the words which may follow what's been typed so far (apart from options).
+type completionWords struct {
+	after  string // the words typed so far, such as "status set"
+	values string // what may follow, as shell words
+}
+
+// Commands the scripts run to find the names of statuses and activities, and the shell
+// words which run them.
+const (
+	statusNamesCommand   = "busylight status names 2>/dev/null"
+	activityNamesCommand = "busylight activity names 2>/dev/null"
+	statusNamesWords     = "$(" + statusNamesCommand + ")"
+	activityNamesWords   = "$(" + activityNamesCommand + ")"
+)
+
+// The completion scripts are made from the table of subcommands, so the "completion"
+// subcommand can't refer to printCompletion in the table itself.
+func init() {
+	command, _ := findSubcommand([]string{"completion"})
+	command.run = printCompletion
+}
+
+// printCompletion prints the completion script for the given shell, for "completion".
+func printCompletion(config *busylight.ConfigData, configPath, shell string) {
+	switch shell {
+	case "bash":
+		fmt.Print(bashCompletion())
+	case "zsh":
+		fmt.Print(zshCompletion())
+	case "fish":
+		fmt.Print(fishCompletion())
+	default:
+		usageError("Unknown shell \"%s\" (use bash, zsh, or fish).\n", shell)
+	}
+}
+
+// topWords returns the first word of each subcommand, in order.
+func topWords() []string {
+	var words []string
+	seen := make(map[string]bool)
+	for _, c := range subcommands {
+		first, _, _ := strings.Cut(c.name, " ")
+		if !seen[first] {
+			seen[first] = true
+			words = append(words, first)
+		}
+	}
+	return words
+}
+
+// argumentWords returns the shell words giving the possible arguments of a subcommand.
+func argumentWords(c subcommand) string {
+	switch c.complete {
+	case "statuses":
+		return statusNamesWords
+	case "activities":
+		return activityNamesWords
+	}
+	return c.complete
+}
+
+// completionCases works out what may be typed after what, both as arguments and as options.
+func completionCases() (args, options []completionWords) {
+	top := strings.Join(topWords(), " ")
+	args = append(args, completionWords{"", top}, completionWords{"help", top})
+	for _, word := range topWords() {
+		var next []string
+		for _, c := range subcommandGroup(word) {
+			if _, rest, found := strings.Cut(c.name, " "); found {
+				next = append(next, rest)
+			}
+		}
+		if len(next) > 0 {
+			args = append(args, completionWords{word, strings.Join(next, " ")}, completionWords{"help " + word, strings.Join(next, " ")})
+		}
+	}
+	for _, c := range subcommands {
+		if c.complete != "" {
+			args = append(args, completionWords{c.name, argumentWords(c)})
+		}
+	}
+
+	var all []string
+	for _, name := range optionNames() {
+		all = append(all, "-"+name)
+	}
+	options = append(options, completionWords{"", strings.Join(all, " ")})
+	for _, c := range subcommands {
+		if c.name == "help" || c.name == "completion" {
+			continue
+		}
+		var names []string
+		for _, name := range append(c.flags, "json") {
+			names = append(names, "-"+name)
+		}
+		options = append(options, completionWords{c.name, strings.Join(names, " ")})
+	}
+	return args, options
+}
+
+// isBoolOption reports whether the named option is a switch rather than taking a value.
+func isBoolOption(name string) bool {
+	b, ok := flag.Lookup(name).Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// valueOptionsPattern returns a shell case pattern matching the options which take a value.
+func valueOptionsPattern() string {
+	var patterns []string
+	for _, name := range optionNames() {
+		if !isBoolOption(name) {
+			patterns = append(patterns, "-"+name, "--"+name)
+		}
+	}
+	return strings.Join(patterns, "|")
+}
+
+// shellCompletionBody returns the part of the bash and zsh scripts (which share the same
+// case syntax) which decides what may come next. Given the word being completed in $cur,
+// the word before it in $prev, and the words typed so far apart from options in $line,
+// it sets $values to the possible completions, or $files if they're file names.
+func shellCompletionBody() string {
+	var b strings.Builder
+	args, options := completionCases()
+	cases := func(indent string, list []completionWords) {
+		for _, c := range list {
+			fmt.Fprintf(&b, "%s\"%s\") values=\"%s\" ;;\n", indent, c.after, c.values)
+		}
+	}
+	b.WriteString("\tcase $prev in\n")
+	b.WriteString("\t-status|--status|-flag|--flag|-preview|--preview)\n\t\tvalues=\"" + statusNamesWords + "\" ;;\n")
+	b.WriteString("\t-activity|--activity)\n\t\tvalues=\"" + activityNamesWords + "\" ;;\n")
+	b.WriteString("\t-format|--format)\n\t\tvalues=\"text csv json ics\" ;;\n")
+	b.WriteString("\t-export|--export)\n\t\tfiles=1 ;;\n")
+	b.WriteString("\t" + valueOptionsPattern() + ")\n\t\t;;\n")
+	b.WriteString("\t*)\n\t\tcase $cur in\n\t\t-*)\n\t\t\tcase $line in\n")
+	cases("\t\t\t", options)
+	b.WriteString("\t\t\tesac ;;\n\t\t*)\n\t\t\tcase $line in\n")
+	cases("\t\t\t", args)
+	b.WriteString("\t\t\tesac ;;\n\t\tesac ;;\n\tesac\n")
+	return b.String()
+}
+
+func bashCompletion() string {
+	return `# bash completion for busylight, from "busylight completion bash".
+# Load it with: source <(busylight completion bash)
+_busylight() {
+	local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+	local line= values= files= i
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		case ${COMP_WORDS[i]} in
+		` + valueOptionsPattern() + `) ((i++)) ;;
+		-*) ;;
+		*) line+="${line:+ }${COMP_WORDS[i]}" ;;
+		esac
+	done
+` + shellCompletionBody() + `	if [[ -n $files ]]; then
+		COMPREPLY=($(compgen -f -- "$cur"))
+	else
+		COMPREPLY=($(compgen -W "$values" -- "$cur"))
+	fi
+}
+complete -F _busylight busylight
+`
+}
+
+func zshCompletion() string {
+	return `#compdef busylight
+# zsh completion for busylight, from "busylight completion zsh".
+# Load it with: source <(busylight completion zsh)
+# or save it as _busylight in a directory in $fpath.
+_busylight() {
+	local cur=${words[CURRENT]} prev=${words[CURRENT-1]}
+	local line= values= files= i
+	for ((i = 2; i < CURRENT; i++)); do
+		case ${words[i]} in
+		` + valueOptionsPattern() + `) ((i++)) ;;
+		-*) ;;
+		*) line+="${line:+ }${words[i]}" ;;
+		esac
+	done
+` + shellCompletionBody() + `	if [[ -n $files ]]; then
+		_files
+	else
+		compadd -- ${=values}
+	fi
+}
+if [[ $funcstack[1] == _busylight ]]; then
+	_busylight "$@"
+else
+	compdef _busylight busylight
+fi
+`
+}
+
+// fishQuote quotes a string for fish.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+func fishCompletion() string {
+	var b strings.Builder
+	b.WriteString(`# fish completion for busylight, from "busylight completion fish".
+# Load it with: busylight completion fish | source
+# or save it as busylight.fish in ~/.config/fish/completions.
+
+# __busylight_words tells whether the words typed so far, apart from options, are those given.
+function __busylight_words
+	set -l typed (commandline -opc)
+	set -e typed[1]
+	set -l words
+	set -l skip 0
+	for w in $typed
+		if test $skip = 1
+			set skip 0
+		else if contains -- $w ` + strings.ReplaceAll(valueOptionsPattern(), "|", " ") + `
+			set skip 1
+		else if not string match -q -- '-*' $w
+			set -a words $w
+		end
+	end
+	test "$words" = "$argv"
+end
+
+complete -c busylight -f
+`)
+	line := func(after string, rest string) {
+		fmt.Fprintf(&b, "complete -c busylight -n %s %s\n", fishQuote("__busylight_words "+fishQuote(after)), rest)
+	}
+
+	// Subcommands, with their summaries.
+	for _, word := range topWords() {
+		group := subcommandGroup(word)
+		summary := word + " commands"
+		if len(group) == 1 && group[0].name == word {
+			summary = group[0].summary
+		}
+		line("", "-a "+word+" -d "+fishQuote(summary))
+		line("help", "-a "+word+" -d "+fishQuote(summary))
+	}
+	for _, c := range subcommands {
+		if first, rest, found := strings.Cut(c.name, " "); found {
+			line(first, "-a "+rest+" -d "+fishQuote(c.summary))
+			line("help "+first, "-a "+rest+" -d "+fishQuote(c.summary))
+		}
+	}
+
+	// Their arguments and options.
+	for _, c := range subcommands {
+		switch c.complete {
+		case "statuses":
+			line(c.name, "-a "+fishQuote("("+statusNamesCommand+")"))
+		case "activities":
+			line(c.name, "-a "+fishQuote("("+activityNamesCommand+")"))
+		case "":
+		default:
+			line(c.name, "-a "+fishQuote(c.complete))
+		}
+		if c.name == "help" || c.name == "completion" {
+			continue
+		}
+		for _, name := range append(c.flags, "json") {
+			line(c.name, fishOption(name))
+		}
+	}
+
+	// The original options.
+	for _, name := range optionNames() {
+		line("", fishOption(name))
+	}
+	return b.String()
+}
+
+// fishOption returns the arguments to fish's complete command describing an option.
+func fishOption(name string) string {
+	rest := "-o " + name
+	if !isBoolOption(name) {
+		rest += " -r"
+	}
+	switch name {
+	case "status", "flag", "preview":
+		rest += " -a " + fishQuote("("+statusNamesCommand+")")
+	case "activity":
+		rest += " -a " + fishQuote("("+activityNamesCommand+")")
+	case "format":
+		rest += " -a " + fishQuote("text csv json ics")
+	case "export":
+		rest += " -F"
+	}
+	return rest + " -d " + fishQuote(flag.Lookup(name).Usage)
+}
@@ -0,0 +1,113 @@
+//
+// Checking the configuration file for busylight config check.
+//
+// We look for the sorts of mistakes which would otherwise only come
+// to light when the daemon (or the device) trips over them: statuses
+// whose commands the device won't accept, colors we can't draw, rules
+// and activities which name statuses which don't exist, and so on.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"fmt"
+	"internal/busylight"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// checkConfig returns a description of each mistake found in the configuration.
+func checkConfig(config *busylight.ConfigData) []string {
+	var problems []string
+	report := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if config.Device == "" {
+		if config.DeviceDir == "" || config.DeviceRegexp == "" {
+			report("neither Device nor DeviceDir and DeviceRegexp are set, so the device can't be found")
+		} else if _, err := regexp.Compile(config.DeviceRegexp); err != nil {
+			report("DeviceRegexp: %v", err)
+		}
+	}
+
+	var letters []string
+	for letter := range config.ColorValues {
+		letters = append(letters, letter)
+	}
+	sort.Strings(letters)
+	for _, letter := range letters {
+		if len(letter) != 1 || !strings.Contains(config.Colors, letter) {
+			report("ColorValues gives a color for \"%s\", which isn't one of the letters in Colors", letter)
+		}
+		if _, err := busylight.ParseColor(config.ColorValues[letter]); err != nil {
+			report("ColorValues for \"%s\": %v", letter, err)
+		}
+	}
+
+	var names []string
+	for name := range config.StatusLights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := busylight.StatusPattern(config, name); err != nil {
+			report("%v", err)
+		} else if err := busylight.NewEmulator(config.Colors).Send(config.StatusLights[name]); err != nil {
+			report("status %s: %v", name, err)
+		}
+	}
+
+	for i, r := range config.Rules {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if _, err := busylight.StatusCommand(config, r.Show); err != nil {
+			report("rule %s: %v", name, err)
+		}
+		if _, err := regexp.Compile(r.If.Calendar); err != nil {
+			report("rule %s: Calendar: %v", name, err)
+		}
+		if _, err := regexp.Compile(r.If.Status); err != nil {
+			report("rule %s: Status: %v", name, err)
+		}
+		switch r.If.Meeting {
+		case "", "muted", "open", "yes", "no":
+		default:
+			report("rule %s: Meeting must be \"muted\", \"open\", \"yes\", or \"no\"", name)
+		}
+		switch r.If.Presence {
+		case "", "present", "away":
+		default:
+			report("rule %s: Presence must be \"present\" or \"away\"", name)
+		}
+		for _, t := range []struct{ field, value string }{{"After", r.If.After}, {"Before", r.If.Before}} {
+			if _, err := time.Parse("15:04", t.value); t.value != "" && err != nil {
+				report("rule %s: %s: invalid time of day \"%s\" (must be HH:MM)", name, t.field, t.value)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, a := range config.Activities {
+		switch {
+		case a.Name == "":
+			report("activity #%d has no name", i+1)
+		case seen[a.Name]:
+			report("activity %s is listed more than once", a.Name)
+		}
+		seen[a.Name] = true
+		if status, err := busylight.ActivityStatus(a); err != nil {
+			report("%v", err)
+		} else if _, err := busylight.StatusCommand(config, status); err != nil {
+			report("activity %s: %v", a.Name, err)
+		}
+	}
+	return problems
+}
@@ -0,0 +1,88 @@
+//
+// Status history reports for busylight -history.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"internal/busylight"
+	"os"
+	"time"
+)
+
+// parsePast interprets a time given on the command line for -from or -to. As well as
+// full dates and times, this accepts a date alone (meaning midnight at the start of that
+// day), a time of day alone (meaning the last time the clock read that time), or a
+// duration (meaning that long ago).
+func parsePast(value string) (time.Time, error) {
+	now := time.Now()
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"15:04", "15:04:05", "3:04pm", "3:04PM", "3pm", "3PM"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local)
+			if t.After(now) {
+				t = t.AddDate(0, 0, -1)
+			}
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't understand \"%s\" as a time (try YYYY-MM-DD HH:MM)", value)
+}
+
+// showHistory prints the status history between `from` and `to` as text, CSV, or JSON.
+func showHistory(config *busylight.ConfigData, devState *busylight.DevState, from, to time.Time, format string) error {
+	entries, err := busylight.ReadHistory(busylight.HistoryPath(config), from, to, devState.Logger)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "", "text":
+		if len(entries) == 0 {
+			fmt.Println("No status changes recorded in that time.")
+			return nil
+		}
+		fmt.Println("TIME-------------- STATUS---- LAYER----- REASON")
+		for _, e := range entries {
+			fmt.Printf("%s %-10s %-10s %s", e.Time.Local().Format("2006-01-02 15:04:05"), e.Status, e.Layer, e.Reason)
+			if e.Rule != "" {
+				fmt.Printf(" (rule %s)", e.Rule)
+			}
+			fmt.Println()
+		}
+
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"time", "status", "layer", "reason", "rule"})
+		for _, e := range entries {
+			w.Write([]string{e.Time.Local().Format(time.RFC3339), e.Status, e.Layer, e.Reason, e.Rule})
+		}
+		w.Flush()
+		return w.Error()
+
+	case "json":
+		if entries == nil {
+			entries = []busylight.HistoryEntry{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+
+	default:
+		return fmt.Errorf("unknown format \"%s\" (use text, csv, or json)", format)
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+//
+// Reporting results, as text or (with -json) as a JSON document,
+// and exit statuses.
+//
+// With -json, everything busylight has to report is gathered into a
+// single cliReport, printed as one JSON object when it's finished, so
+// that other programs (such as blight) can read it without having to
+// pick apart text meant for people.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"internal/busylight"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Exit statuses. If several things go wrong, the first one decides.
+const (
+	exitOK          = 0 // everything worked
+	exitError       = 1 // something else went wrong
+	exitUsage       = 2 // the command line doesn't make sense (as the flag package uses)
+	exitNoDaemon    = 3 // the daemon isn't running (or can't be reached)
+	exitNoDevice    = 4 // the light device couldn't be found
+	exitBadResponse = 5 // the device (or daemon) sent something we didn't understand
+)
+
+// problemKinds names each exit status in the Kind field of a problem.
+var problemKinds = map[int]string{
+	exitError:       "error",
+	exitUsage:       "usage",
+	exitNoDaemon:    "no-daemon",
+	exitNoDevice:    "no-device",
+	exitBadResponse: "bad-response",
+}
+
+// problem is an error or warning as reported in JSON.
+type problem struct {
+	Kind    string
+	Message string
+}
+
+// cliReport is everything we have to report, as printed by -json. Each field is only
+// present if the option which reports it was given.
+type cliReport struct {
+	Statuses    *[]statusReport        `json:",omitempty"` // -list
+	Daemon      *daemonReport          `json:",omitempty"` // -query
+	Device      *deviceReport          `json:",omitempty"` // -query
+	Activities  *[]busylight.Activity  `json:",omitempty"` // -activities
+	Explanation *busylight.Explanation `json:",omitempty"` // -explain
+	Preview     *previewReport         `json:",omitempty"` // -preview
+	Names       *[]string              `json:",omitempty"` // status names, activity names
+	Config      *configReport          `json:",omitempty"` // config path, config check
+	Warnings    []problem              `json:",omitempty"` // things which went wrong along the way
+	Error       *problem               `json:",omitempty"` // what made us give up, if anything
+}
+
+// statusReport describes a status defined in the configuration.
+type statusReport struct {
+	Name    string
+	Command string                  // the command sent to the device
+	Lights  *busylight.LightPattern `json:",omitempty"` // what the command makes the lights do
+	Error   string                  `json:",omitempty"` // why Lights is missing, if it is
+}
+
+// configReport describes the configuration file.
+type configReport struct {
+	Path     string
+	Problems *[]string `json:",omitempty"` // the mistakes found in it (config check)
+}
+
+// daemonReport describes the daemon.
+type daemonReport struct {
+	Running bool
+	PID     int                     `json:",omitempty"`
+	Status  *busylight.DaemonStatus `json:",omitempty"` // as the daemon reports it, if it could
+}
+
+// deviceReport describes what the device said it was doing when queried.
+type deviceReport struct {
+	Raw     string // the device's response, as sent
+	Lights  []lightReport
+	Flasher sequenceReport
+	Strober sequenceReport
+}
+
+// lightReport describes one of the device's lights.
+type lightReport struct {
+	Index  int
+	Letter string `json:",omitempty"` // its letter in Colors
+	Color  string `json:",omitempty"` // its color name (see busylight.ColorName)
+	RGB    string // its color, as #rrggbb
+	On     bool
+}
+
+// sequenceReport describes the device's flasher or strober.
+type sequenceReport struct {
+	Running       bool   // is there a sequence to flash?
+	IsOn          bool   // is the light at SequenceIndex lit now?
+	SequenceIndex int    // where in Sequence it has got to
+	Sequence      []int  // the light numbers it goes through (-1 where none is lit)
+	Letters       string // the same, by their letters in Colors (or _ where none is lit)
+}
+
+// previewReport describes what the lights would do for -preview.
+type previewReport struct {
+	Name     string
+	Command  string
+	Warning  string  `json:",omitempty"` // what the device would reject or ignore
+	Cycle    float64 // how long (in seconds) before the lights repeat, or 0 if they don't change
+	Duration float64 // how long (in seconds) the Frames cover
+	Frames   []frameReport
+}
+
+// frameReport is what the lights look like from a point in time until the next frame.
+type frameReport struct {
+	At     float64 // seconds from the start
+	Lights []bool
+}
+
+var (
+	jsonOutput    bool      // are we reporting as JSON?
+	report        cliReport // what we have to report, if so
+	reportWritten bool      // have we already printed it?
+	exitStatus    = exitOK  // the status to exit with
+)
+
+// exitCode decides on the exit status to report an error with.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, busylight.ErrNoDaemon):
+		return exitNoDaemon
+	case errors.Is(err, busylight.ErrNoDevice):
+		return exitNoDevice
+	case errors.Is(err, busylight.ErrBadResponse):
+		return exitBadResponse
+	}
+	return exitError
+}
+
+// warn reports something which went wrong, but not badly enough to stop us from carrying on.
+func warn(err error) {
+	code := exitCode(err)
+	if exitStatus == exitOK {
+		exitStatus = code
+	}
+	if jsonOutput {
+		report.Warnings = append(report.Warnings, problem{Kind: problemKinds[code], Message: err.Error()})
+	} else {
+		fmt.Printf("Warning: %v\n", err)
+	}
+}
+
+// note tells the user something in passing. With -json, this goes to the standard error
+// so as not to get in the way of the JSON document.
+func note(format string, a ...interface{}) {
+	if jsonOutput {
+		fmt.Fprintf(os.Stderr, format, a...)
+	} else {
+		fmt.Printf(format, a...)
+	}
+}
+
+// die reports that we can't go on, and exits with the given status.
+func die(code int, message string) {
+	if jsonOutput {
+		report.Error = &problem{Kind: problemKinds[code], Message: strings.TrimSpace(message)}
+		writeReport()
+	} else {
+		fmt.Print(message)
+	}
+	os.Exit(code)
+}
+
+func fatal(format string, a ...interface{}) {
+	die(exitError, fmt.Sprintf(format, a...))
+}
+
+// usageError reports that the options given don't make sense together.
+func usageError(format string, a ...interface{}) {
+	die(exitUsage, fmt.Sprintf(format, a...))
+}
+
+// writeReport prints what we have to report as a JSON object (if that's what we're doing),
+// and starts over with an empty report.
+func writeReport() {
+	if !jsonOutput {
+		return
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	report, reportWritten = cliReport{}, true
+}
+
+// finish prints the report (unless it has been already) and exits.
+func finish() {
+	if !reportWritten {
+		writeReport()
+	}
+	os.Exit(exitStatus)
+}
+
+// listStatuses reports the statuses defined in the configuration for -list.
+func listStatuses(config *busylight.ConfigData) {
+	if !jsonOutput {
+		fmt.Println("Defined status codes usable with the --status option:")
+		fmt.Println("CODE------  LIGHT-EFFECT")
+		for code, def := range config.StatusLights {
+			fmt.Printf("%-10s  %s\n", code, def)
+		}
+		return
+	}
+
+	var names []string
+	for name := range config.StatusLights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	statuses := []statusReport{}
+	for _, name := range names {
+		s := statusReport{Name: name, Command: config.StatusLights[name]}
+		if pattern, err := busylight.StatusPattern(config, name); err != nil {
+			s.Error = err.Error()
+		} else {
+			s.Lights = &pattern
+		}
+		statuses = append(statuses, s)
+	}
+	report.Statuses = &statuses
+}
+
+// queryJSON reports the state of the daemon and the device for -query.
+func queryJSON(config *busylight.ConfigData, devState *busylight.DevState, daemon *os.Process) {
+	if state, err := busylight.QueryStatus(config, devState, 0); err != nil {
+		warn(err)
+	} else {
+		report.Device = newDeviceReport(config, state)
+	}
+
+	report.Daemon = &daemonReport{}
+	if daemon != nil {
+		report.Daemon.Running, report.Daemon.PID = true, daemon.Pid
+		var ds busylight.DaemonStatus
+		if err := busylight.DaemonRequest(config, http.MethodGet, "/status", nil, &ds); err != nil {
+			warn(err)
+		} else {
+			report.Daemon.Status = &ds
+		}
+	}
+}
+
+// newDeviceReport decodes the device's response to a query.
+func newDeviceReport(config *busylight.ConfigData, state busylight.LightStatus) *deviceReport {
+	d := &deviceReport{
+		Raw:     string(state.RawResponse[:state.ResponseLength]),
+		Lights:  []lightReport{},
+		Flasher: newSequenceReport(config, state.Flasher),
+		Strober: newSequenceReport(config, state.Strober),
+	}
+	for i, on := range state.IsLightOn {
+		l := lightReport{
+			Index: i,
+			Color: busylight.ColorName(config, i),
+			RGB:   busylight.LightColor(config, i).String(),
+			On:    on,
+		}
+		if i < len(config.Colors) {
+			l.Letter = config.Colors[i : i+1]
+		}
+		d.Lights = append(d.Lights, l)
+	}
+	return d
+}
+
+func newSequenceReport(config *busylight.ConfigData, seq busylight.LightSequence) sequenceReport {
+	s := sequenceReport{
+		Running:       len(seq.Sequence) > 0,
+		IsOn:          seq.IsOn,
+		SequenceIndex: seq.SequenceIndex,
+		Sequence:      []int{},
+	}
+	for _, led := range seq.Sequence {
+		if led == busylight.LightOff {
+			s.Sequence = append(s.Sequence, -1)
+			s.Letters += "_"
+			continue
+		}
+		s.Sequence = append(s.Sequence, int(led))
+		if int(led) < len(config.Colors) {
+			s.Letters += config.Colors[led : led+1]
+		} else {
+			s.Letters += fmt.Sprint(led)
+		}
+	}
+	return s
+}
+
+// newPreviewReport describes the frames of a preview.
+func newPreviewReport(name, command string, warning error, cycle, length time.Duration, frames []lightFrame) *previewReport {
+	p := &previewReport{
+		Name:     name,
+		Command:  command,
+		Cycle:    cycle.Seconds(),
+		Duration: length.Seconds(),
+		Frames:   []frameReport{},
+	}
+	if warning != nil {
+		p.Warning = warning.Error()
+	}
+	for _, f := range frames {
+		p.Frames = append(p.Frames, frameReport{At: f.at.Seconds(), Lights: f.lit})
+	}
+	return p
+}
@@ -0,0 +1,249 @@
+//
+// Previewing light patterns for busylight -preview.
+//
+// The status (or raw command) is sent to an emulated device rather than
+// the real one, and the lights are shown doing what the device would,
+// with the device's own timing: animated on a terminal, as a list of
+// changes otherwise, or saved as an animated GIF or SVG image.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"internal/busylight"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const maxPreviewLength = time.Minute // the longest stretch of time we'll list or export
+
+// Sizes (in pixels) for exported images.
+const (
+	imageLightSize = 32 // diameter of each light
+	imageLightGap  = 8  // space between lights
+	imageMargin    = 8  // space around the edge
+)
+
+var imageBackground = busylight.RGB{R: 0x20, G: 0x20, B: 0x20}
+
+// lightFrame is what the lights look like from a point in time until the next frame.
+type lightFrame struct {
+	at  time.Duration
+	lit []bool
+}
+
+// previewCommand works out what to send to the device for -preview, which may name a status
+// (or several joined with "+") or give a raw command.
+func previewCommand(config *busylight.ConfigData, what string) string {
+	if command, err := busylight.StatusCommand(config, what); err == nil {
+		return command
+	}
+	return what
+}
+
+// showPreview shows what the device would do when sent the status or raw command given.
+// On a terminal, the lights are animated for the given length of time (or until
+// interrupted); otherwise, the changes in the lights are listed (or, with -json, added
+// to the report). If `export` is given, the lights are saved to that file as an animated
+// GIF or SVG image instead.
+func showPreview(config *busylight.ConfigData, what string, length time.Duration, export string) error {
+	command := previewCommand(config, what)
+	device := busylight.NewEmulator(config.Colors)
+	warning := device.Send(command)
+	if warning != nil && !jsonOutput {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", warning)
+	}
+
+	if export != "" || jsonOutput || !useColor(os.Stdout) {
+		cycle := device.Cycle()
+		if length <= 0 {
+			length = cycle
+		}
+		if length > maxPreviewLength {
+			length = maxPreviewLength
+		}
+		frames := lightChanges(device, length, lightCount(config))
+		if jsonOutput {
+			report.Preview = newPreviewReport(what, command, warning, cycle, length, frames)
+		}
+		switch ext := strings.ToLower(filepath.Ext(export)); {
+		case export == "" && jsonOutput:
+			return nil
+		case export == "":
+			fmt.Printf("Preview of %s (%q):\n", what, command)
+			for _, f := range frames {
+				fmt.Printf("%8.3fs %s\n", f.at.Seconds(), renderLights(config, f.lit, false))
+			}
+			if length > 0 && length == cycle {
+				fmt.Printf("%8.3fs (repeats)\n", length.Seconds())
+			} else if length > 0 {
+				fmt.Printf("%8.3fs (end of preview)\n", length.Seconds())
+			}
+			return nil
+		case ext == ".gif":
+			return exportGIF(config, frames, length, export)
+		case ext == ".svg":
+			return exportSVG(config, frames, length, export)
+		default:
+			return fmt.Errorf("can't export to %s (the file name must end in .gif or .svg)", export)
+		}
+	}
+
+	lights := newLightAnimator(config)
+	lights.println(fmt.Sprintf("Preview of %s (%q); interrupt to stop.", what, command))
+	lights.play(device, what)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	if length > 0 {
+		select {
+		case <-stop:
+		case <-time.After(length):
+		}
+	} else {
+		<-stop
+	}
+	fmt.Println()
+	return nil
+}
+
+// lightChanges runs the emulated device for the given length of time, returning each
+// change in the lights it shows along the way.
+func lightChanges(device *busylight.Emulator, length time.Duration, lights int) []lightFrame {
+	start := device.Now
+	frames := []lightFrame{{at: 0, lit: append([]bool(nil), device.Lights[:lights]...)}}
+	for {
+		next, ok := device.NextChange()
+		if !ok || device.Now+next-start >= length {
+			return frames
+		}
+		device.Advance(next)
+		last := frames[len(frames)-1].lit
+		for i := range last {
+			if last[i] != device.Lights[i] {
+				frames = append(frames, lightFrame{at: device.Now - start, lit: append([]bool(nil), device.Lights[:lights]...)})
+				break
+			}
+		}
+	}
+}
+
+// frameLength returns how long frame i is shown for.
+func frameLength(frames []lightFrame, i int, length time.Duration) time.Duration {
+	if i+1 < len(frames) {
+		return frames[i+1].at - frames[i].at
+	}
+	return length - frames[i].at
+}
+
+// lightCenter returns where light i is drawn in an exported image.
+func lightCenter(i int) (int, int) {
+	return imageMargin + i*(imageLightSize+imageLightGap) + imageLightSize/2, imageMargin + imageLightSize/2
+}
+
+// imageSize returns the size of an exported image showing the given number of lights.
+func imageSize(lights int) (int, int) {
+	return 2*imageMargin + lights*imageLightSize + (lights-1)*imageLightGap, 2*imageMargin + imageLightSize
+}
+
+// lightColor returns the color to draw light i when it's on or off.
+func lightColor(config *busylight.ConfigData, i int, on bool) busylight.RGB {
+	c := busylight.LightColor(config, i)
+	if !on {
+		c = c.Darken(offBrightness)
+	}
+	return c
+}
+
+// exportGIF saves the frames as an animated GIF image which repeats forever.
+func exportGIF(config *busylight.ConfigData, frames []lightFrame, length time.Duration, path string) error {
+	lights := len(frames[0].lit)
+	width, height := imageSize(lights)
+
+	palette := color.Palette{color.RGBA{imageBackground.R, imageBackground.G, imageBackground.B, 0xff}}
+	for i := 0; i < lights; i++ {
+		for _, on := range []bool{true, false} {
+			c := lightColor(config, i, on)
+			palette = append(palette, color.RGBA{c.R, c.G, c.B, 0xff})
+		}
+	}
+
+	animation := &gif.GIF{}
+	for n, f := range frames {
+		img := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+		for i, on := range f.lit {
+			index := uint8(1 + 2*i)
+			if !on {
+				index++
+			}
+			cx, cy := lightCenter(i)
+			r := imageLightSize / 2
+			for y := -r; y < r; y++ {
+				for x := -r; x < r; x++ {
+					if (2*x+1)*(2*x+1)+(2*y+1)*(2*y+1) <= 4*r*r {
+						img.SetColorIndex(cx+x, cy+y, index)
+					}
+				}
+			}
+		}
+		// GIF delays are in hundredths of a second.
+		delay := int((frameLength(frames, n, length) + 5*time.Millisecond) / (10 * time.Millisecond))
+		if delay < 2 {
+			delay = 2
+		}
+		animation.Image = append(animation.Image, img)
+		animation.Delay = append(animation.Delay, delay)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := gif.EncodeAll(f, animation); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// exportSVG saves the frames as an SVG image whose lights are animated, repeating forever.
+func exportSVG(config *busylight.ConfigData, frames []lightFrame, length time.Duration, path string) error {
+	lights := len(frames[0].lit)
+	width, height := imageSize(lights)
+
+	var svg strings.Builder
+	fmt.Fprintf(&svg, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n", width, height, width, height)
+	fmt.Fprintf(&svg, "  <rect width=\"%d\" height=\"%d\" fill=\"%s\"/>\n", width, height, imageBackground)
+	for i := 0; i < lights; i++ {
+		cx, cy := lightCenter(i)
+		fmt.Fprintf(&svg, "  <circle cx=\"%d\" cy=\"%d\" r=\"%d\" fill=\"%s\"", cx, cy, imageLightSize/2, lightColor(config, i, frames[0].lit[i]))
+
+		// The light only needs animating if it changes, and then only where it does.
+		var times, values []string
+		for n, f := range frames {
+			if n == 0 || f.lit[i] != frames[n-1].lit[i] {
+				times = append(times, fmt.Sprintf("%.4f", float64(f.at)/float64(length)))
+				values = append(values, lightColor(config, i, f.lit[i]).String())
+			}
+		}
+		if len(values) < 2 {
+			svg.WriteString("/>\n")
+			continue
+		}
+		svg.WriteString(">\n")
+		fmt.Fprintf(&svg, "    <animate attributeName=\"fill\" dur=\"%.3fs\" repeatCount=\"indefinite\" calcMode=\"discrete\" keyTimes=\"%s\" values=\"%s\"/>\n",
+			length.Seconds(), strings.Join(times, ";"), strings.Join(values, ";"))
+		svg.WriteString("  </circle>\n")
+	}
+	svg.WriteString("</svg>\n")
+	return os.WriteFile(path, []byte(svg.String()), 0644)
+}
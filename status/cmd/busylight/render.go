@@ -0,0 +1,135 @@
+//
+// Drawing the lights on the terminal.
+//
+// On a terminal, each light is drawn as a block in its ColorValues color
+// (using 24-bit color escape sequences), dimmed when the light is off.
+// Otherwise (or if NO_COLOR is set), lit lights are shown by their letters
+// from Colors and unlit ones as dashes.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"fmt"
+	"internal/busylight"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	offBrightness   = 25                    // how bright (in percent) to draw a light which is off, as blight does
+	animationPeriod = 25 * time.Millisecond // how often to redraw animated lights
+)
+
+// useColor reports whether we should draw the lights in color on the given file.
+func useColor(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// renderLights draws the lights, one character per light, in color or as letters.
+func renderLights(config *busylight.ConfigData, lit []bool, color bool) string {
+	var s strings.Builder
+	for i, on := range lit {
+		switch {
+		case color:
+			c := busylight.LightColor(config, i)
+			if !on {
+				c = c.Darken(offBrightness)
+			}
+			fmt.Fprintf(&s, "\x1b[38;2;%d;%d;%dm█", c.R, c.G, c.B)
+		case !on:
+			s.WriteByte('-')
+		case i < len(config.Colors):
+			s.WriteByte(config.Colors[i])
+		default:
+			s.WriteByte('X')
+		}
+	}
+	if color {
+		s.WriteString("\x1b[0m")
+	}
+	return s.String()
+}
+
+// lightAnimator keeps a line at the bottom of the terminal showing the lights as they
+// change from moment to moment, with other output scrolling past above it.
+type lightAnimator struct {
+	config  *busylight.ConfigData
+	lock    sync.Mutex
+	pattern busylight.LightPattern
+	lit     func(time.Duration) []bool // which lights are lit a given time after `since`
+	since   time.Time                  // when the lights started doing what they're doing
+	label   string                     // shown after the lights
+}
+
+// newLightAnimator starts animating the lights (all off until told otherwise).
+func newLightAnimator(config *busylight.ConfigData) *lightAnimator {
+	a := &lightAnimator{config: config, since: time.Now()}
+	a.lit = func(time.Duration) []bool { return make([]bool, lightCount(config)) }
+	go func() {
+		for range time.Tick(animationPeriod) {
+			a.lock.Lock()
+			a.draw()
+			a.lock.Unlock()
+		}
+	}()
+	return a
+}
+
+// show changes the pattern being shown, starting it from the beginning if it's different.
+func (a *lightAnimator) show(pattern busylight.LightPattern, label string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if pattern.Command() != a.pattern.Command() {
+		a.pattern, a.since = pattern, time.Now()
+		a.lit = func(elapsed time.Duration) []bool {
+			return pattern.LitAt(a.config.Colors, elapsed, lightCount(a.config))
+		}
+	}
+	a.label = label
+	a.draw()
+}
+
+// play starts showing the lights from an emulated device, in real time.
+func (a *lightAnimator) play(device *busylight.Emulator, label string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.pattern, a.since, a.label = busylight.LightPattern{}, time.Now(), label
+	start := device.Now
+	a.lit = func(elapsed time.Duration) []bool {
+		device.Advance(start + elapsed - device.Now)
+		return device.Lights[:lightCount(a.config)]
+	}
+	a.draw()
+}
+
+// println prints a line of text above the lights.
+func (a *lightAnimator) println(text string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	fmt.Printf("\r\x1b[K%s\n", text)
+	a.draw()
+}
+
+// draw shows the lights as they are now. The caller must hold the lock.
+func (a *lightAnimator) draw() {
+	fmt.Printf("\r%s %s\x1b[K", renderLights(a.config, a.lit(time.Since(a.since)), true), a.label)
+}
+
+// lightCount returns the number of lights to draw: as many as there are colors for, or
+// all that the firmware drives if we don't know.
+func lightCount(config *busylight.ConfigData) int {
+	if n := len(config.Colors); n > 0 && n <= busylight.FirmwareLights {
+		return n
+	}
+	return busylight.FirmwareLights
+}
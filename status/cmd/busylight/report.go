@@ -0,0 +1,260 @@
+//
+// Time-tracking reports for busylight -report.
+//
+// From the daemon's status history, we add up how much time was spent on
+// each activity, showing each status, and busy on each calendar, for
+// pasting into timesheets.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"internal/busylight"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const defaultReportPeriod = 7 * 24 * time.Hour // how far back -report goes if not told otherwise
+
+// historySpan is a stretch of time during which one history entry was in effect.
+type historySpan struct {
+	busylight.HistoryEntry
+	Start, End time.Time
+}
+
+// historySpans works out when each history entry was in effect, limited to the time from
+// `from` to `to`. The last entry is taken to still be in effect now.
+func historySpans(entries []busylight.HistoryEntry, from, to time.Time) []historySpan {
+	var spans []historySpan
+	for i, e := range entries {
+		s := historySpan{HistoryEntry: e, Start: e.Time, End: to}
+		if i+1 < len(entries) {
+			s.End = entries[i+1].Time
+		} else if now := time.Now(); s.End.After(now) {
+			s.End = now
+		}
+		if s.Start.Before(from) {
+			s.Start = from
+		}
+		if s.End.After(to) {
+			s.End = to
+		}
+		if s.End.After(s.Start) {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+// reportTotals is the time spent on each thing we report on.
+type reportTotals map[string]time.Duration
+
+// names returns the things in the totals, in alphabetical order.
+func (t reportTotals) names() []string {
+	var names []string
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// showReport prints the time spent on each activity, status, and calendar between `from` and
+// `to` as text, CSV, or JSON, or the activities as iCalendar events.
+func showReport(config *busylight.ConfigData, devState *busylight.DevState, from, to time.Time, format string) error {
+	if from.IsZero() {
+		from = time.Now().Add(-defaultReportPeriod)
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if !to.After(from) {
+		return fmt.Errorf("the report must end after it starts")
+	}
+	entries, err := busylight.ReadHistory(busylight.HistoryPath(config), from, to, devState.Logger)
+	if err != nil {
+		return err
+	}
+	spans := historySpans(entries, from, to)
+
+	if format == "ics" {
+		return writeActivityEvents(spans)
+	}
+
+	// Everything configured is listed, even if no time was spent on it.
+	activities, statuses, calendars := reportTotals{}, reportTotals{}, reportTotals{}
+	for _, a := range config.Activities {
+		activities[a.Name] = 0
+	}
+	for _, c := range config.Calendars {
+		calendars[c.Title] = 0
+	}
+	for _, s := range spans {
+		elapsed := s.End.Sub(s.Start)
+		statuses[s.Status] += elapsed
+		if s.Activity != "" {
+			activities[s.Activity] += elapsed
+		}
+		for _, title := range s.Calendars {
+			calendars[title] += elapsed
+		}
+	}
+	sections := []struct {
+		name   string
+		totals reportTotals
+	}{
+		{"activity", activities},
+		{"status", statuses},
+		{"calendar", calendars},
+	}
+
+	switch format {
+	case "", "text":
+		fmt.Printf("Time from %s to %s:\n", from.Local().Format("2006-01-02 15:04"), to.Local().Format("2006-01-02 15:04"))
+		for _, section := range sections {
+			if len(section.totals) == 0 {
+				continue
+			}
+			fmt.Printf("\n%-20.20s %-7s %-6s\n", strings.ToUpper(section.name)+strings.Repeat("-", 20), "TIME---", "HOURS-")
+			for _, name := range section.totals.names() {
+				elapsed := section.totals[name].Round(time.Minute)
+				fmt.Printf("%-20s %4d:%02d %6.2f\n", name, int(elapsed.Hours()), int(elapsed.Minutes())%60, elapsed.Hours())
+			}
+		}
+
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"category", "name", "hours", "minutes", "from", "to"})
+		for _, section := range sections {
+			for _, name := range section.totals.names() {
+				elapsed := section.totals[name].Round(time.Minute)
+				w.Write([]string{
+					section.name,
+					name,
+					fmt.Sprintf("%.2f", elapsed.Hours()),
+					fmt.Sprintf("%d", int(elapsed.Minutes())),
+					from.Local().Format(time.RFC3339),
+					to.Local().Format(time.RFC3339),
+				})
+			}
+		}
+		w.Flush()
+		return w.Error()
+
+	case "json":
+		type total struct {
+			Name    string
+			Hours   float64
+			Minutes int
+		}
+		doc := struct {
+			From, To                        time.Time
+			Activities, Statuses, Calendars []total
+		}{From: from.Local(), To: to.Local()}
+		for _, section := range sections {
+			list := []total{}
+			for _, name := range section.totals.names() {
+				elapsed := section.totals[name].Round(time.Minute)
+				list = append(list, total{name, math.Round(elapsed.Hours()*100) / 100, int(elapsed.Minutes())})
+			}
+			switch section.name {
+			case "activity":
+				doc.Activities = list
+			case "status":
+				doc.Statuses = list
+			case "calendar":
+				doc.Calendars = list
+			}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(doc)
+
+	default:
+		return fmt.Errorf("unknown format \"%s\" (use text, csv, json, or ics)", format)
+	}
+	return nil
+}
+
+// writeActivityEvents prints an iCalendar file with an event for each stretch of time spent
+// on an activity.
+func writeActivityEvents(spans []historySpan) error {
+	// Join together consecutive spans of the same activity.
+	var events []historySpan
+	for _, s := range spans {
+		if s.Activity == "" {
+			continue
+		}
+		if n := len(events); n > 0 && events[n-1].Activity == s.Activity && !events[n-1].End.Before(s.Start) {
+			events[n-1].End = s.End
+			continue
+		}
+		events = append(events, s)
+	}
+
+	const stamp = "20060102T150405Z"
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//MadScienceZone//busylight//EN",
+		"CALSCALE:GREGORIAN",
+	}
+	now := time.Now().UTC().Format(stamp)
+	for _, e := range events {
+		h := fnv.New64a()
+		h.Write([]byte(e.Activity))
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			fmt.Sprintf("UID:%d-%x@busylight", e.Start.Unix(), h.Sum64()),
+			"DTSTAMP:"+now,
+			"DTSTART:"+e.Start.UTC().Format(stamp),
+			"DTEND:"+e.End.UTC().Format(stamp),
+			"SUMMARY:"+escapeICalText(e.Activity),
+			"CATEGORIES:busylight activity",
+			"TRANSP:TRANSPARENT",
+			"END:VEVENT",
+		)
+	}
+	lines = append(lines, "END:VCALENDAR")
+	for i, line := range lines {
+		lines[i] = foldICalLine(line)
+	}
+	_, err := fmt.Print(strings.Join(lines, "\r\n") + "\r\n")
+	return err
+}
+
+// foldICalLine breaks a content line longer than 75 octets into several, each continuation
+// starting with a space, as RFC 5545 requires. It never splits a UTF-8 character.
+func foldICalLine(line string) string {
+	const maxOctets = 75
+	var folded strings.Builder
+	length := 0
+	for _, r := range line {
+		size := utf8.RuneLen(r)
+		if length+size > maxOctets {
+			folded.WriteString("\r\n ")
+			length = 1
+		}
+		folded.WriteRune(r)
+		length += size
+	}
+	return folded.String()
+}
+
+var iCalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+// escapeICalText makes a string safe to use as an iCalendar text value.
+func escapeICalText(s string) string {
+	return iCalEscaper.Replace(s)
+}
@@ -0,0 +1,158 @@
+//
+// Live reports of the daemon's state for busylight -watch.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"internal/busylight"
+	"os"
+	"strings"
+	"time"
+)
+
+const watchRetryInterval = 5 * time.Second // how long to wait before reconnecting to the daemon
+
+// watchDaemon prints each change announced by the daemon as it happens, as text or as JSON
+// (one event per line). On a terminal, the text is followed by a line showing the lights
+// as they are now. If contact with the daemon is lost, we keep trying to get it back.
+func watchDaemon(config *busylight.ConfigData, format string) error {
+	var print func(busylight.DaemonEvent) error
+	switch format {
+	case "", "text":
+		var lights *lightAnimator
+		if useColor(os.Stdout) {
+			lights = newLightAnimator(config)
+		}
+		last := make(map[string]string)
+		print = func(e busylight.DaemonEvent) error {
+			text, err := describeEvent(e)
+			if err != nil {
+				return err
+			}
+			if lights != nil && e.Event == "status" {
+				var s busylight.DaemonStatus
+				if err := json.Unmarshal(e.Data, &s); err == nil {
+					lights.show(s.Lights, s.Status)
+				}
+			}
+			// Only mention things the user would notice have changed.
+			if text != "" && text != last[e.Event] {
+				last[e.Event] = text
+				line := fmt.Sprintf("%s %-10s %s", time.Now().Format("15:04:05"), e.Event, text)
+				if lights != nil {
+					lights.println(line)
+				} else {
+					fmt.Println(line)
+				}
+			}
+			return nil
+		}
+
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		print = func(e busylight.DaemonEvent) error {
+			return enc.Encode(e)
+		}
+
+	default:
+		return fmt.Errorf("unknown format \"%s\" (use text or json)", format)
+	}
+
+	everConnected := false
+	for {
+		connected := false
+		err := busylight.WatchDaemon(config, func(e busylight.DaemonEvent) error {
+			connected = true
+			return print(e)
+		})
+		if connected {
+			everConnected = true
+			if err == nil {
+				err = fmt.Errorf("daemon closed the connection")
+			}
+			fmt.Fprintf(os.Stderr, "%v; trying to reconnect\n", err)
+		} else if !everConnected {
+			return err
+		}
+		time.Sleep(watchRetryInterval)
+	}
+}
+
+// describeEvent sums up an event from the daemon in a line of text.
+func describeEvent(e busylight.DaemonEvent) (string, error) {
+	switch e.Event {
+	case "status":
+		var s busylight.DaemonStatus
+		if err := json.Unmarshal(e.Data, &s); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s (%s)", s.Status, s.Reason), nil
+
+	case "meeting":
+		var m busylight.MeetingState
+		if err := json.Unmarshal(e.Data, &m); err != nil {
+			return "", err
+		}
+		switch {
+		case !m.InMeeting:
+			return "not in a meeting", nil
+		case m.Muted:
+			return "in a meeting, muted", nil
+		default:
+			return "in a meeting, mic open", nil
+		}
+
+	case "calendar":
+		var c busylight.CalendarState
+		if err := json.Unmarshal(e.Data, &c); err != nil {
+			return "", err
+		}
+		text := "free"
+		if c.Busy {
+			text = "busy"
+			if len(c.BusyCalendars) > 0 {
+				text += " on " + strings.Join(c.BusyCalendars, ", ")
+			}
+		}
+		for _, p := range c.Periods {
+			if p.Start.After(time.Now()) {
+				text += fmt.Sprintf("; next busy %s-%s on %s", p.Start.Local().Format("15:04"), p.End.Local().Format("15:04"), p.Calendar)
+				break
+			}
+		}
+		return text, nil
+
+	case "device":
+		var d busylight.DeviceState
+		if err := json.Unmarshal(e.Data, &d); err != nil {
+			return "", err
+		}
+		switch {
+		case d.Connected:
+			return "connected to " + d.Device, nil
+		case d.Error != "":
+			return "can't reach device: " + d.Error, nil
+		default:
+			return "not connected", nil
+		}
+
+	case "activities":
+		var activities []busylight.Activity
+		if err := json.Unmarshal(e.Data, &activities); err != nil {
+			return "", err
+		}
+		for _, a := range activities {
+			if a.Active {
+				return "doing " + a.Name, nil
+			}
+		}
+		return "no activity going on", nil
+	}
+	return "", nil
+}
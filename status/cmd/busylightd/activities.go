@@ -0,0 +1,188 @@
+//
+// Activity time tracking for busylightd.
+//
+// The user may tell the daemon they're starting one of the Activities
+// listed in config.json (or in the activities file which blight used to
+// keep). While an activity is going on, the activity layer offers its
+// status, and the daemon keeps count of the time spent on it, saving the
+// totals to the activities file every minute so they survive the daemon
+// (or the computer) being restarted. The clock stops while the daemon is
+// sleeping.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"fmt"
+	"internal/busylight"
+	"time"
+)
+
+// activityTracker keeps time for the user's activities.
+type activityTracker struct {
+	path       string
+	activities []busylight.Activity
+	statuses   []string        // what to show for each activity
+	elapsed    []time.Duration // time spent on each activity (more precisely than Activity.Elapsed)
+	current    int             // which activity is going on now, or -1 if none is
+	since      time.Time       // when we last added to the current activity's time (zero while the clock is stopped)
+}
+
+// loadActivities sets up the activities from the configuration and the activities file,
+// picking up where we left off if one was going on when the daemon last stopped.
+func loadActivities(config *busylight.ConfigData) (*activityTracker, error) {
+	t := &activityTracker{path: busylight.ActivityPath(config), current: -1}
+	saved, err := busylight.ReadActivities(t.path)
+	if err != nil {
+		return nil, err
+	}
+	t.activities = config.Activities
+	if len(t.activities) == 0 {
+		t.activities = saved
+	}
+
+	seen := make(map[string]bool)
+	for i, a := range t.activities {
+		if a.Name == "" {
+			return nil, fmt.Errorf("activity #%d has no name", i+1)
+		}
+		if seen[a.Name] {
+			return nil, fmt.Errorf("activity %s is listed more than once", a.Name)
+		}
+		seen[a.Name] = true
+		status, err := busylight.ActivityStatus(a)
+		if err != nil {
+			return nil, err
+		}
+		t.statuses = append(t.statuses, status)
+
+		var elapsed time.Duration
+		for _, s := range saved {
+			if s.Name == a.Name {
+				elapsed = time.Duration(s.Elapsed) * time.Minute
+				if s.Active && t.current < 0 {
+					t.current = i
+					t.since = time.Now()
+				}
+				break
+			}
+		}
+		t.elapsed = append(t.elapsed, elapsed)
+	}
+	return t, nil
+}
+
+// keepTimes carries over the time spent on each activity from the tracker we had
+// before reloading, since that counts the seconds which the activities file doesn't.
+func (t *activityTracker) keepTimes(old *activityTracker) {
+	for i, a := range t.activities {
+		for j, o := range old.activities {
+			if o.Name == a.Name {
+				t.elapsed[i] = old.elapsed[j]
+				break
+			}
+		}
+	}
+}
+
+// count adds the time since we last counted to the current activity.
+func (t *activityTracker) count() {
+	if t.current >= 0 && !t.since.IsZero() {
+		now := time.Now()
+		t.elapsed[t.current] += now.Sub(t.since)
+		t.since = now
+	}
+}
+
+// list reports the activities and the time spent on each so far.
+func (t *activityTracker) list() []busylight.Activity {
+	t.count()
+	list := make([]busylight.Activity, len(t.activities))
+	for i, a := range t.activities {
+		list[i] = busylight.Activity{
+			Name:    a.Name,
+			Status:  a.Status,
+			Elapsed: int(t.elapsed[i] / time.Minute),
+			Active:  i == t.current,
+		}
+	}
+	return list
+}
+
+// save writes the time spent on each activity to the activities file.
+func (t *activityTracker) save() error {
+	if len(t.activities) == 0 {
+		return nil
+	}
+	return busylight.WriteActivities(t.path, t.list())
+}
+
+// start begins keeping time for the named activity, ending any other one.
+func (t *activityTracker) start(name string) error {
+	for i, a := range t.activities {
+		if a.Name == name {
+			t.count()
+			t.current, t.since = i, time.Now()
+			return t.save()
+		}
+	}
+	return fmt.Errorf("there is no activity called \"%s\"", name)
+}
+
+// stop ends the current activity, if there is one.
+func (t *activityTracker) stop() error {
+	t.count()
+	t.current, t.since = -1, time.Time{}
+	return t.save()
+}
+
+// clear sets the time spent on every activity back to zero.
+func (t *activityTracker) clear() error {
+	t.count()
+	for i := range t.elapsed {
+		t.elapsed[i] = 0
+	}
+	return t.save()
+}
+
+// pause stops the clock without ending the current activity.
+func (t *activityTracker) pause() error {
+	t.count()
+	t.since = time.Time{}
+	return t.save()
+}
+
+// resume starts the clock again for the current activity, if there is one.
+func (t *activityTracker) resume() {
+	if t.current >= 0 && t.since.IsZero() {
+		t.since = time.Now()
+	}
+}
+
+// running reports whether we're keeping time for an activity now.
+func (t *activityTracker) running() bool {
+	return t.current >= 0 && !t.since.IsZero()
+}
+
+// name returns the name of the current activity, if there is one.
+func (t *activityTracker) name() string {
+	if t.current < 0 {
+		return ""
+	}
+	return t.activities[t.current].Name
+}
+
+// updateLayer offers the current activity's status to the status resolver.
+func (t *activityTracker) updateLayer(layers *statusResolver) {
+	if t.current < 0 {
+		layers.Clear("activity")
+		return
+	}
+	layers.Set("activity", statusCandidate{
+		Status: t.statuses[t.current],
+		Reason: fmt.Sprintf("doing %s", t.activities[t.current].Name),
+	})
+}
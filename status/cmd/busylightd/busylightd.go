@@ -10,6 +10,14 @@
 //    WINCH  - enter idle state (was: toggle idle/working state)
 //    CHLD   - not used (was: toggle low-priority)
 //    INT    - turn off lights and exit
+//    TERM   - turn off lights and exit
+//
+// With -foreground, the daemon logs to standard error instead of LogFile, as
+// suits running it under systemd (see systemd.go).
+//
+// Clients may also send requests via the control socket (see control.go),
+// and the daemon may notice meetings on its own (see meetings.go) or that the
+// user has stepped away or the computer is suspending (see presence.go).
 //
 // Steve Willoughby <steve@madscience.zone>
 // License: BSD 3-Clause open-source license
@@ -19,6 +27,7 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"internal/busylight"
 	"io/ioutil"
@@ -28,7 +37,9 @@ import (
 	"os/signal"
 	"os/user"
 	"path/filepath"
+	"reflect"
 	"sort"
+	"strings"
 	"syscall"
 	"time"
 
@@ -38,6 +49,11 @@ import (
 	"google.golang.org/api/calendar/v3"
 )
 
+var Fforeground = flag.Bool("foreground", false, "log to standard error instead of the log file (for systemd)")
+
+// pidFile is our PID file, which we hold locked for as long as we run.
+var pidFile *os.File
+
 func getClient(config *oauth2.Config, tokFile string) (*http.Client, error) {
 	tok, err := tokenFromFile(tokFile)
 	if err != nil {
@@ -62,6 +78,12 @@ type BusyPeriod struct {
 	Start, End time.Time
 }
 
+// CalendarPeriod is a busy period as reported by one particular calendar.
+type CalendarPeriod struct {
+	Title string // from the calendar's CalendarConfigData
+	BusyPeriod
+}
+
 // ByStartTime provides a custom sort order for `BusyPeriod` elements.
 type ByStartTime []BusyPeriod
 
@@ -84,6 +106,39 @@ type CalendarAvailability struct {
 
 	// The list of "busy" time spans found on the calendars from the last poll.
 	UpcomingPeriods []BusyPeriod // will be in chronological order
+
+	// The busy time spans for each calendar separately, from the last poll.
+	CalendarPeriods []CalendarPeriod
+}
+
+// BusyCalendarsNow returns the titles of the calendars which show a busy period right now.
+func (cal *CalendarAvailability) BusyCalendarsNow() []string {
+	var titles []string
+	now := time.Now().Add(5 * time.Second)
+	for _, p := range cal.CalendarPeriods {
+		if now.After(p.Start) && now.Before(p.End) {
+			titles = append(titles, p.Title)
+		}
+	}
+	return titles
+}
+
+// State reports what we know of the calendars, for clients watching the daemon's events.
+func (cal *CalendarAvailability) State(layers *statusResolver) busylight.CalendarState {
+	state := busylight.CalendarState{LastPoll: cal.LastPollTime}
+	if _, state.Busy = layers.Get("calendar"); state.Busy {
+		state.BusyCalendars = cal.BusyCalendarsNow()
+		sort.Strings(state.BusyCalendars)
+		state.BusyCalendars = uniqueStrings(state.BusyCalendars)
+	}
+	now := time.Now()
+	for _, p := range cal.CalendarPeriods {
+		if p.End.After(now) {
+			state.Periods = append(state.Periods, busylight.CalendarPeriod{Calendar: p.Title, Start: p.Start, End: p.End})
+		}
+	}
+	sort.SliceStable(state.Periods, func(i, j int) bool { return state.Periods[i].Start.Before(state.Periods[j].Start) })
+	return state
 }
 
 // RemoveExpiredPeriods trims busy spans from a `CalendarAvailability` value which occur in the past.
@@ -98,13 +153,16 @@ func (cal *CalendarAvailability) RemoveExpiredPeriods(config *busylight.ConfigDa
 	if len(cal.UpcomingPeriods) == 0 && time.Now().After(cal.LastPollTime.Add(30*time.Minute)) {
 		err := cal.Refresh(config, devState)
 		if err != nil {
-			devState.Logger.Printf("Unable to refresh calendar data while removing expired periods: %v", err)
+			devState.Logger.Error("Unable to refresh calendar data while removing expired periods", "err", err)
 		}
 	}
 	// yes, we're trusting the Google service not to give us past events.
 }
 
 // NextTransitionTime returns the absolute time at which we need to check again to change the lights.
+// Besides the start and end of the next busy period, this includes the times within it when
+// an individual calendar's busy period starts or ends, so that the change in which calendars
+// we're busy on is noticed (and recorded in the history) when it happens.
 func (cal *CalendarAvailability) NextTransitionTime(config *busylight.ConfigData, devState *busylight.DevState) time.Time {
 	cal.RemoveExpiredPeriods(config, devState)
 
@@ -113,12 +171,25 @@ func (cal *CalendarAvailability) NextTransitionTime(config *busylight.ConfigData
 		// Tell the caller to check back in 8 hours.
 		return time.Now().Add(8 * time.Hour)
 	}
-	if time.Now().Add(5 * time.Second).After(cal.UpcomingPeriods[0].Start) {
+
+	soon := time.Now().Add(5 * time.Second)
+	var next time.Time
+	if soon.After(cal.UpcomingPeriods[0].Start) {
 		// we're already into the period, so the next transition will be at its end
-		return cal.UpcomingPeriods[0].End
+		next = cal.UpcomingPeriods[0].End
+	} else {
+		// the period hasn't started yet so the transition will be at its beginning.
+		next = cal.UpcomingPeriods[0].Start
+	}
+
+	for _, p := range cal.CalendarPeriods {
+		for _, t := range []time.Time{p.Start, p.End} {
+			if !soon.After(t) && t.Before(next) {
+				next = t
+			}
+		}
 	}
-	// the period hasn't started yet so the transition will be at its beginning.
-	return cal.UpcomingPeriods[0].Start
+	return next
 }
 
 // ScheduledBusyNow checks to see if, according to the monitored calendars, we are scheduled to be busy right now.
@@ -134,9 +205,35 @@ func (cal *CalendarAvailability) ScheduledBusyNow(config *busylight.ConfigData,
 	return false
 }
 
+// UpdateLayer offers the calendar's idea of our status to the status resolver.
+func (cal *CalendarAvailability) UpdateLayer(config *busylight.ConfigData, devState *busylight.DevState, layers *statusResolver) {
+	if cal.ScheduledBusyNow(config, devState) {
+		end := cal.UpcomingPeriods[0].End
+		reason := fmt.Sprintf("busy on calendar until %s", end.Local().Format("15:04"))
+		if titles := cal.BusyCalendarsNow(); len(titles) > 0 {
+			reason = fmt.Sprintf("busy on %s until %s", strings.Join(titles, ", "), end.Local().Format("15:04"))
+		}
+		layers.Set("calendar", statusCandidate{
+			Status:  "busy",
+			Reason:  reason,
+			Expires: end,
+		})
+	} else {
+		layers.Clear("calendar")
+	}
+}
+
 // Refresh polls the Google API and updates the `CalendarAvailability` structure accordingly.
 func (cal *CalendarAvailability) Refresh(config *busylight.ConfigData, devState *busylight.DevState) error {
-	devState.Logger.Printf("Polling Google Calendars")
+	start := time.Now()
+	err := cal.poll(config, devState)
+	metrics.calendarPolled(time.Since(start), err == nil)
+	return err
+}
+
+// poll does the work of Refresh.
+func (cal *CalendarAvailability) poll(config *busylight.ConfigData, devState *busylight.DevState) error {
+	devState.Logger.Info("Polling Google Calendars")
 	googleConfig, err := google.ConfigFromJSON(devState.GoogleConfig, calendar.CalendarReadonlyScope)
 	if err != nil {
 		return err
@@ -166,30 +263,31 @@ func (cal *CalendarAvailability) Refresh(config *busylight.ConfigData, devState
 	}
 
 	var rawbusylist []BusyPeriod
+	var calendarPeriods []CalendarPeriod
 	for calID, calData := range freelist.Calendars {
 		calInfo, isKnown := config.Calendars[calID]
 		if !isKnown {
-			devState.Logger.Printf("WARNING: Calendar <%s> in API results does not match any in our configuration!", calID)
+			devState.Logger.Warn("Calendar in API results does not match any in our configuration", "calendar", calID)
 			calInfo = busylight.CalendarConfigData{
 				Title: fmt.Sprintf("UNKNOWN<%v>", calID),
 			}
 		}
 
 		for _, e := range calData.Errors {
-			devState.Logger.Printf("ERROR: Calendar \"%s\": %v", calInfo.Title, e)
+			devState.Logger.Error("Calendar reported an error", "calendar", calInfo.Title, "domain", e.Domain, "reason", e.Reason)
 		}
 		for _, busy := range calData.Busy {
 			startTime, err := time.Parse(time.RFC3339, busy.Start)
 			if err != nil {
-				devState.Logger.Printf("ERROR: %s: Unable to parse start time \"%v\": %v", calInfo.Title, busy.Start, err)
+				devState.Logger.Error("Unable to parse start time", "calendar", calInfo.Title, "start", busy.Start, "err", err)
 				continue
 			}
 			endTime, err := time.Parse(time.RFC3339, busy.End)
 			if err != nil {
-				devState.Logger.Printf("ERROR: %s: Unable to parse end time \"%v\": %v", calInfo.Title, busy.End, err)
+				devState.Logger.Error("Unable to parse end time", "calendar", calInfo.Title, "end", busy.End, "err", err)
 				continue
 			}
-			devState.Logger.Printf("Calendar \"%s\": busy %v - %v", calInfo.Title, startTime.Local(), endTime.Local())
+			devState.Logger.Info("Busy on calendar", "calendar", calInfo.Title, "start", startTime.Local(), "end", endTime.Local())
 			if calInfo.IgnoreAllDayEvents {
 				// This calendar is on our ignore list for all-day bookings.
 				// There isn't any really great way to identify all-day events
@@ -200,17 +298,17 @@ func (cal *CalendarAvailability) Refresh(config *busylight.ConfigData, devState
 				// It's far from perfect but it gets us closer to something useful.
 				if startTime.Before(queryStartTime.Add(5*time.Second)) &&
 					endTime.After(queryEndTime.Add(-5*time.Second)) {
-					devState.Logger.Printf("Ignoring long-running event from %s", calInfo.Title)
+					devState.Logger.Info("Ignoring long-running event", "calendar", calInfo.Title)
 					continue
 				}
 			}
 			rawbusylist = append(rawbusylist, BusyPeriod{Start: startTime, End: endTime})
+			calendarPeriods = append(calendarPeriods, CalendarPeriod{Title: calInfo.Title, BusyPeriod: BusyPeriod{Start: startTime, End: endTime}})
 		}
 	}
 	// smush list and sort it
-	devState.Logger.Printf("DEBUG: Initial list: %v", rawbusylist)
 	sort.Sort(ByStartTime(rawbusylist))
-	devState.Logger.Printf("DEBUG: Sorted list: %v", rawbusylist)
+	devState.Logger.Debug("Busy periods from calendars", "periods", rawbusylist)
 	var currentStart time.Time
 	var currentEnd time.Time
 
@@ -238,11 +336,142 @@ func (cal *CalendarAvailability) Refresh(config *busylight.ConfigData, devState
 		// we need to commit the last one, too
 		cal.UpcomingPeriods = append(cal.UpcomingPeriods, BusyPeriod{Start: currentStart, End: currentEnd})
 	}
-	devState.Logger.Printf("DEBUG: final list: %v", cal.UpcomingPeriods)
+	devState.Logger.Debug("Busy periods combined", "periods", cal.UpcomingPeriods)
+	cal.CalendarPeriods = calendarPeriods
 	cal.LastPollTime = time.Now()
 	return nil
 }
 
+// nextTransitionTime returns the absolute time at which we need to check again to change the lights,
+// taking into account the calendar, the expiration of any layer's candidate status, and the times of
+// day mentioned in rules.
+func nextTransitionTime(config *busylight.ConfigData, devState *busylight.DevState, cal *CalendarAvailability, layers *statusResolver, rules []rule) time.Time {
+	next := cal.NextTransitionTime(config, devState)
+	for _, t := range []time.Time{layers.NextExpiry(time.Now()), nextRuleBoundary(rules, time.Now())} {
+		if !t.IsZero() && t.Before(next) {
+			next = t
+		}
+	}
+	return next
+}
+
+// meetingState reports the state of the meeting we're in ("muted" or "open"), or "" if we're not in one.
+func meetingState(layers *statusResolver) string {
+	if c, ok := layers.Get("meeting"); ok {
+		return c.Status
+	}
+	return ""
+}
+
+// presenceState reports whether the user is "present" or "away", as far as we can tell.
+func presenceState(layers *statusResolver) string {
+	for _, layer := range []string{"override", "presence"} {
+		if c, ok := layers.Get(layer); ok && c.Status == "away" {
+			return "away"
+		}
+	}
+	return "present"
+}
+
+// setMeeting records the state of the meeting we're in ("muted" or "open"), or that we're
+// not in one ("").
+func setMeeting(devState *busylight.DevState, layers *statusResolver, state string) {
+	switch state {
+	case "":
+		devState.Logger.Info("Call ended")
+		layers.Clear("meeting")
+	case "muted":
+		devState.Logger.Info("Muted")
+		layers.Set("meeting", statusCandidate{Status: "muted", Reason: "in a meeting with mic muted"})
+	default:
+		devState.Logger.Info("Unmuted")
+		layers.Set("meeting", statusCandidate{Status: "open", Reason: "in a meeting with mic open"})
+	}
+}
+
+// recordHistory adds an entry to the history file.
+func recordHistory(config *busylight.ConfigData, devState *busylight.DevState, entry busylight.HistoryEntry) {
+	if err := busylight.AppendHistory(busylight.HistoryPath(config), entry); err != nil {
+		devState.Logger.Warn("Unable to record status history", "err", err)
+	}
+}
+
+// statusSummary describes what the daemon is showing, for systemctl status.
+func statusSummary(current busylight.Explanation, active bool) string {
+	if !active {
+		return "Sleeping"
+	}
+	return fmt.Sprintf("Showing %s (%s)", current.Status, current.Reason)
+}
+
+// userName returns the name by which the user is identified to others.
+func userName(config *busylight.ConfigData) string {
+	if config.UserName != "" {
+		return config.UserName
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
+
+// decideStatus works out what the lights should show now, starting with the candidates
+// offered by the layers and then applying the rules, and explains how it got there.
+func decideStatus(config *busylight.ConfigData, cal *CalendarAvailability, layers *statusResolver, rules []rule) busylight.Explanation {
+	var ex busylight.Explanation
+
+	for _, name := range layers.Ranked(config) {
+		c, _ := layers.Get(name)
+		priority, _ := layerPriority(config, name)
+		ex.Layers = append(ex.Layers, busylight.LayerReport{
+			Name:     name,
+			Priority: priority,
+			Overlay:  isOverlay(config, name),
+			Status:   c.Status,
+			Reason:   c.Reason,
+			Expires:  c.Expires,
+		})
+	}
+
+	layer, candidate, ok := layers.Resolve(config)
+	if !ok {
+		layer, candidate = "", statusCandidate{Status: "off", Reason: "no layers offer any status"}
+	}
+	ex.Resolved, ex.ResolvedLayer = candidate.Status, layer
+	ex.Status, ex.Reason = candidate.Status, candidate.Reason
+
+	// The rules only consider the winning layer's status. Whatever the overlays add to it
+	// is added to the status a rule shows in its place, too.
+	winner, overlays := layers.Pick(config)
+	ctx := ruleContext{
+		Now:       time.Now(),
+		Status:    "off",
+		Presence:  presenceState(layers),
+		Calendars: cal.BusyCalendarsNow(),
+	}
+	if c, ok := layers.Get(winner); ok && winner != "" {
+		ctx.Status = c.Status
+	}
+	ctx.Meeting = meetingState(layers)
+	if c, ok := layers.Get("override"); ok {
+		ctx.Override = c.Status
+	}
+
+	fired, reports := applyRules(rules, ctx)
+	ex.Rules = reports
+	if fired != nil {
+		ex.Rule = fired.Name
+		shown := []string{fired.Show}
+		for _, l := range overlays {
+			c, _ := layers.Get(l)
+			shown = append(shown, c.Status)
+		}
+		ex.Status = strings.Join(shown, "+")
+		ex.Reason = fmt.Sprintf("rule %s: %s", fired.Name, strings.Join(reports[len(reports)-1].Details, "; "))
+	}
+	return ex
+}
+
 //
 // We maintain a list of busy/free times since the last time we polled the calendar.
 // from that we can also know when the next transition time will be
@@ -265,7 +494,15 @@ func (cal *CalendarAvailability) Refresh(config *busylight.ConfigData, devState
 func setup(config *busylight.ConfigData, devState *busylight.DevState) error {
 	var thisUser *user.User
 	previousLogFile := config.LogFile
+	previousLogFormat := config.LogFormat
 	previousPidFile := config.PidFile
+	previousWebhooks := config.Webhooks
+	previousWebhookSpool := config.WebhookSpool
+	previousUserName := config.UserName
+	previousMQTT := config.MQTT
+	previousMetricsAddress := config.MetricsAddress
+	previousListenAddress := config.ListenAddress
+	previousWebPassword := config.WebPassword
 
 	thisUser, err := user.Current()
 	if err != nil {
@@ -281,35 +518,68 @@ func setup(config *busylight.ConfigData, devState *busylight.DevState) error {
 	// If we're just re-reading the configuration, we will leave the
 	// existing logfile and pid file alone.
 	//
+	logging, err := checkLogging(config)
 	if devState.Logger == nil {
-		f, err := os.OpenFile(config.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
-			return fmt.Errorf("Unable to open logfile: %v", err)
+			return err
+		}
+		if devState.Logger, err = newLogger(config, logging); err != nil {
+			return err
 		}
-		devState.Logger = log.New(f, "busylightd: ", log.LstdFlags)
 
 		myPID := os.Getpid()
-		devState.Logger.Printf("busylightd started, PID=%v", myPID)
+		devState.Logger.Info("busylightd started", "pid", myPID)
 
-		pidf, err := os.OpenFile(config.PidFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		var stale int
+		pidFile, stale, err = busylight.LockPidFile(config.PidFile)
 		if err != nil {
-			devState.Logger.Printf("ERROR creating PID file (is another busylightd running?): %v", err)
+			devState.Logger.Error("Unable to claim PID file", "err", err)
 			return err
 		}
-		pidf.WriteString(fmt.Sprintf("%d\n", myPID))
-		pidf.Close()
+		if stale != 0 {
+			devState.Logger.Info("Replaced stale PID file", "pid", stale)
+		}
 
 		devState.GoogleConfig, err = ioutil.ReadFile(config.CredentialFile)
 		if err != nil {
-			devState.Logger.Printf("Unable to read client secret file %v: %v", config.CredentialFile, err)
+			devState.Logger.Error("Unable to read client secret file", "path", config.CredentialFile, "err", err)
 			return fmt.Errorf("Unable to read client secret file %v: %v", config.CredentialFile, err)
 		}
 	} else {
+		if err != nil {
+			devState.Logger.Error("Keeping previous logging settings", "err", err)
+		} else {
+			applyLogSettings(logging)
+		}
 		if previousPidFile != config.PidFile {
-			devState.Logger.Printf("WARNING: PID file changed from %v to %v on reload. This requires a full restart of the daemon. Ignoring the change for now.", previousPidFile, config.PidFile)
+			devState.Logger.Warn("PID file changed on reload. This requires a full restart of the daemon. Ignoring the change for now.", "old", previousPidFile, "new", config.PidFile)
+		}
+		if previousLogFile != config.LogFile && !*Fforeground {
+			devState.Logger.Warn("Log file changed on reload. This requires a full restart of the daemon. Ignoring the change for now.", "old", previousLogFile, "new", config.LogFile)
+		}
+		if previousLogFormat != config.LogFormat {
+			devState.Logger.Warn("Log format changed on reload. This requires a full restart of the daemon. Ignoring the change for now.", "old", previousLogFormat, "new", config.LogFormat)
 		}
-		if previousLogFile != config.LogFile {
-			devState.Logger.Printf("WARNING: Log file changed from %v to %v on reload. This requires a full restart of the daemon. Ignoring the change for now.", previousLogFile, config.LogFile)
+		if !reflect.DeepEqual(previousWebhooks, config.Webhooks) || previousWebhookSpool != config.WebhookSpool || previousUserName != config.UserName {
+			devState.Logger.Warn("Webhook settings changed on reload. This requires a full restart of the daemon. Ignoring the change for now.")
+		}
+		if previousMQTT != config.MQTT {
+			devState.Logger.Warn("MQTT settings changed on reload. This requires a full restart of the daemon. Ignoring the change for now.")
+		}
+		if previousMetricsAddress != config.MetricsAddress {
+			devState.Logger.Warn("Metrics address changed on reload. This requires a full restart of the daemon. Ignoring the change for now.", "old", previousMetricsAddress, "new", config.MetricsAddress)
+		}
+		if previousListenAddress != config.ListenAddress {
+			devState.Logger.Warn("Listen address changed on reload. This requires a full restart of the daemon. Ignoring the change for now.", "old", previousListenAddress, "new", config.ListenAddress)
+		}
+		if previousWebPassword != config.WebPassword {
+			devState.Logger.Warn("Web password changed on reload. This requires a full restart of the daemon. Ignoring the change for now.")
+		}
+	}
+
+	for layer := range config.Layers {
+		if _, known := defaultLayerPriorities[layer]; !known {
+			devState.Logger.Warn("Layer in configuration is not one I know about (ignored)", "layer", layer)
 		}
 	}
 
@@ -338,204 +608,604 @@ func closeDevice(config *busylight.ConfigData, devState *busylight.DevState) {
 
 func shutdown(config *busylight.ConfigData, devState *busylight.DevState) {
 	closeDevice(config, devState)
-	err := os.Remove(config.PidFile)
-	if err != nil {
-		devState.Logger.Printf("Error removing PID file: %v", err)
+	if pidFile != nil {
+		// Remove it while we still hold the lock, so nobody else locks it in the meantime.
+		if err := os.Remove(config.PidFile); err != nil {
+			devState.Logger.Error("Unable to remove PID file", "err", err)
+		}
+		pidFile.Close()
+		pidFile = nil
 	}
-	devState.Logger.Printf("busylightd shutting down")
+	devState.Logger.Info("busylightd shutting down")
 }
 
 func main() {
 	var config busylight.ConfigData
 	var devState busylight.DevState
+	var broker *mqttBridge
 
+	flag.Parse()
 	if err := setup(&config, &devState); err != nil {
 		log.Fatalf("Unable to start daemon: %v", err)
 	}
 	defer shutdown(&config, &devState)
 
+	//
+	// Listen for control requests from clients
+	//
+	ctlReq := make(chan controlRequest)
+	ctlListener, activated, err := startControlServer(&config, &devState, ctlReq)
+	if err != nil {
+		devState.Logger.Error("Unable to start daemon", "err", err)
+		shutdown(&config, &devState)
+		log.Fatalf("Unable to start daemon: %v", err)
+	}
+	defer func() {
+		ctlListener.Close()
+		if !activated {
+			os.Remove(busylight.ControlSocketPath(&config))
+		}
+	}()
+
+	metricsListener, err := startMetricsServer(&config, &devState)
+	if err != nil {
+		devState.Logger.Error("Unable to start daemon", "err", err)
+		shutdown(&config, &devState)
+		log.Fatalf("Unable to start daemon: %v", err)
+	}
+	if metricsListener != nil {
+		defer metricsListener.Close()
+	}
+
+	webListener, err := startWebServer(&config, &devState, ctlReq)
+	if err != nil {
+		devState.Logger.Error("Unable to start daemon", "err", err)
+		shutdown(&config, &devState)
+		log.Fatalf("Unable to start daemon: %v", err)
+	}
+	if webListener != nil {
+		defer webListener.Close()
+	}
+
 	//
 	// Listen for incoming signals from outside
 	//
 	req := make(chan os.Signal, 5)
-	signal.Notify(req, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGWINCH, syscall.SIGPWR, syscall.SIGINT, syscall.SIGVTALRM)
+	signal.Notify(req, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGWINCH, syscall.SIGPWR, syscall.SIGINT, syscall.SIGTERM, syscall.SIGVTALRM)
 
 	//
 	// Get initial calendar download
 	//
+	rules, err := compileRules(&config)
+	if err == nil {
+		err = checkHooks(&config)
+	}
+	var meetingDetectors []meetingDetector
+	if err == nil {
+		meetingDetectors, err = compileMeetingDetectors(&config)
+	}
+	if err == nil {
+		err = checkMicrophone(&config)
+	}
+	if err == nil {
+		_, err = cameraDevices(&config)
+	}
+	if err == nil {
+		_, err = awayAfter(&config)
+	}
+	var activities *activityTracker
+	if err == nil {
+		activities, err = loadActivities(&config)
+	}
+	if err != nil {
+		devState.Logger.Error("Unable to start daemon", "err", err)
+		shutdown(&config, &devState)
+		log.Fatalf("Unable to start daemon: %v", err)
+	}
+	hooks := newHookRunner(&config, &devState)
+	webhooks, err := newWebhookNotifier(&config, &devState)
+	if err == nil {
+		broker, err = newMQTTBridge(&config, &devState, ctlReq)
+	}
+	if err != nil {
+		devState.Logger.Error("Unable to start daemon", "err", err)
+		shutdown(&config, &devState)
+		log.Fatalf("Unable to start daemon: %v", err)
+	}
+
 	var busyTimes CalendarAvailability
-	err := busyTimes.Refresh(&config, &devState)
+	err = busyTimes.Refresh(&config, &devState)
 	if err != nil {
-		devState.Logger.Printf("Error updating busy/free times from calendar: %v", err)
+		devState.Logger.Error("Unable to update busy/free times from calendar", "err", err)
 	}
 
-	isZoomNow := false
-	isZoomMuted := false
 	isActiveNow := true
 
+	//
+	// Start watching for things we can detect on our own
+	//
+	detected := make(chan detectorEvent, 5)
+	detections := make(map[string]detectorEvent)
+	suspending := make(chan suspendEvent)
+	var stopDetectors chan struct{}
+	startDetectors := func() {
+		stopDetectors = make(chan struct{})
+		snapshot := config
+		if len(meetingDetectors) > 0 {
+			go watchMeetings(&snapshot, &devState, meetingDetectors, detected, stopDetectors)
+		}
+		if snapshot.WatchMicrophone {
+			go watchMicrophone(&snapshot, &devState, detected, stopDetectors)
+		}
+		if snapshot.WatchCamera {
+			go watchCamera(&snapshot, &devState, detected, stopDetectors)
+		}
+		if snapshot.WatchPresence {
+			go watchPresence(&snapshot, &devState, detected, suspending, stopDetectors)
+		}
+	}
+	startDetectors()
+	defer func() { close(stopDetectors) }()
+
 	//
 	// Set the current state and schedule for next transition
 	//
-	isBusyTimeNow := busyTimes.ScheduledBusyNow(&config, &devState)
-	nextTransitionTime := busyTimes.NextTransitionTime(&config, &devState)
-	transitionTimer := time.NewTimer(time.Until(nextTransitionTime))
+	layers := newStatusResolver()
+	busyTimes.UpdateLayer(&config, &devState, layers)
+	activities.updateLayer(layers)
+	transitionTimer := time.NewTimer(time.Until(nextTransitionTime(&config, &devState, &busyTimes, layers, rules)))
 
-	if isBusyTimeNow {
-		if err := busylight.LightSignal(&config, &devState, "busy", 0); err != nil {
-			shutdown(&config, &devState)
-			os.Exit(1)
+	current := decideStatus(&config, &busyTimes, layers, rules)
+	if err := busylight.ShowStatus(&config, &devState, current.Status, 0); err != nil {
+		shutdown(&config, &devState)
+		os.Exit(1)
+	}
+	hooks.Fire(&config, "start", current.Status, busylight.Explanation{}, current)
+	hooks.StatusChanged(&config, busylight.Explanation{}, current)
+	webhooks.StatusChanged(busylight.Explanation{}, current, nextTransitionTime(&config, &devState, &busyTimes, layers, rules))
+	currentMeeting := ""
+
+	// daemonStatus reports our current state to control clients.
+	daemonStatus := func() busylight.DaemonStatus {
+		status := busylight.DaemonStatus{
+			PID:    os.Getpid(),
+			Active: isActiveNow,
+			Status: current.Status,
+			Layer:  current.ResolvedLayer,
+			Reason: current.Reason,
+			Rule:   current.Rule,
 		}
-	} else {
-		if err := busylight.LightSignal(&config, &devState, "free", 0); err != nil {
-			shutdown(&config, &devState)
-			os.Exit(1)
+		if isActiveNow {
+			status.NextTransition = nextTransitionTime(&config, &devState, &busyTimes, layers, rules)
+		}
+		if c, ok := layers.Get("meeting"); ok {
+			status.InMeeting = true
+			status.Muted = c.Status == "muted"
+		}
+		_, status.CalendarBusy = layers.Get("calendar")
+		if c, ok := layers.Get("override"); ok {
+			status.Override = &busylight.Override{Status: c.Status, Until: c.Expires}
+		}
+		if c, ok := layers.Get("flag"); ok {
+			status.Flag = &busylight.Override{Status: c.Status, Until: c.Expires}
+		}
+		status.Activity = activities.name()
+		status.Lights, _ = busylight.StatusPattern(&config, current.Status)
+		return status
+	}
+
+	// noteHistory records what we're showing now (and why) in the history file, if that has changed.
+	var lastHistory busylight.HistoryEntry
+	noteHistory := func() {
+		entry := busylight.HistoryEntry{
+			Status: current.Status,
+			Layer:  current.ResolvedLayer,
+			Reason: current.Reason,
+			Rule:   current.Rule,
 		}
+		if isActiveNow {
+			entry.Activity = activities.name()
+			entry.Calendars = busyTimes.BusyCalendarsNow()
+			sort.Strings(entry.Calendars)
+			entry.Calendars = uniqueStrings(entry.Calendars)
+		}
+		if !entry.SameAs(lastHistory) {
+			entry.Time = time.Now()
+			recordHistory(&config, &devState, entry)
+			lastHistory = entry
+		}
+	}
+
+	// publishEvents tells clients watching our events about anything which has changed.
+	publishEvents := func(status busylight.DaemonStatus) {
+		events.publish("status", status)
+		events.publish("meeting", busylight.MeetingState{InMeeting: status.InMeeting, Muted: status.Muted})
+		events.publish("calendar", busyTimes.State(layers))
+		events.publish("device", deviceState(&devState))
+		events.publish("activities", activities.list())
+	}
+
+	metrics.update(&devState, daemonStatus())
+	noteHistory()
+	broker.Update(daemonStatus())
+	publishEvents(daemonStatus())
+	if err := sdNotify("READY=1\nSTATUS=" + statusSummary(current, isActiveNow)); err != nil {
+		devState.Logger.Warn("Unable to notify systemd", "err", err)
+	}
+
+	// If systemd is watching us, we need to check in every so often.
+	var watchdog <-chan time.Time
+	if interval := sdWatchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchdog = ticker.C
 	}
 
 	// We will keep a timer for refreshing the calendar and one for transitioning
 	// to the next free/busy state
 	refreshTimer := time.NewTicker(time.Hour * 1)
 
+	// While an activity is going on, we save the time spent on it every minute.
+	activityTimer := time.NewTicker(time.Minute)
+	defer activityTimer.Stop()
+
+	// sleep puts the daemon into its inactive state, letting go of the device.
+	sleep := func() {
+		if isActiveNow {
+			isActiveNow = false
+			devState.Logger.Info("Stopping timers")
+			refreshTimer.Stop()
+			transitionTimer.Stop()
+			closeDevice(&config, &devState)
+			if err := activities.pause(); err != nil {
+				devState.Logger.Warn("Unable to save activity times", "err", err)
+			}
+			devState.Logger.Info("Daemon in inactive state... zzz")
+		}
+	}
+
+	// wake brings the daemon back from its inactive state with a fresh look at its configuration.
+	wake := func() {
+		if isActiveNow {
+			return
+		}
+		isActiveNow = true
+		devState.Logger.Info("Activating service; re-loading configuration and opening serial port")
+		if err := setup(&config, &devState); err != nil {
+			devState.Logger.Error("Unable to load configuration data. Unable to restart.", "err", err)
+			os.Exit(1)
+		}
+		if newRules, err := compileRules(&config); err != nil {
+			devState.Logger.Error("Keeping previous rules", "err", err)
+		} else {
+			rules = newRules
+		}
+		if err := checkHooks(&config); err != nil {
+			devState.Logger.Error("Hooks may not run correctly", "err", err)
+		}
+		if newDetectors, err := compileMeetingDetectors(&config); err != nil {
+			devState.Logger.Error("Keeping previous detectors", "err", err)
+		} else if err := checkMicrophone(&config); err != nil {
+			devState.Logger.Error("Keeping previous detectors", "err", err)
+		} else if _, err := cameraDevices(&config); err != nil {
+			devState.Logger.Error("Keeping previous detectors", "err", err)
+		} else if _, err := awayAfter(&config); err != nil {
+			devState.Logger.Error("Keeping previous detectors", "err", err)
+		} else {
+			close(stopDetectors)
+			meetingDetectors = newDetectors
+			startDetectors()
+		}
+		// We saved the activities when we went to sleep, so loading them again picks up
+		// any changes to their definitions and starts the clock again. The times we already
+		// have are kept, though, since the file only records whole minutes.
+		if newActivities, err := loadActivities(&config); err != nil {
+			devState.Logger.Error("Keeping previous activities", "err", err)
+			activities.resume()
+		} else {
+			newActivities.keepTimes(activities)
+			activities = newActivities
+		}
+		activities.updateLayer(layers)
+		devState.Logger.Info("Activating service; getting fresh calendar data")
+		if err := busyTimes.Refresh(&config, &devState); err != nil {
+			devState.Logger.Error("Unable to update busy/free times from calendar", "err", err)
+		}
+		devState.Logger.Info("Resetting timers")
+		refreshTimer.Reset(1 * time.Hour)
+		busyTimes.UpdateLayer(&config, &devState, layers)
+		transitionTimer.Reset(time.Until(nextTransitionTime(&config, &devState, &busyTimes, layers, rules)))
+	}
+
+	// If we went to sleep because the computer suspended, we wake up again when it resumes.
+	// The presence watcher waits for suspendDone to be closed once we've dealt with either.
+	sleptForSuspend := false
+	var suspendDone chan struct{}
+
 	//
 	// Main event loop:
-	// 	On incoming signals, indicate light status as requested by signaller
+	// 	On incoming signals, update the layer they pertain to
 	//  Otherwise, update Google calendar status hourly while active
-	//	Update lights based on busy/free status when transition times arrive unless in Zoom
+	//	Update the calendar layer when transition times arrive
+	//  Then show whichever layer's status has the highest priority
 	//
 eventLoop:
 	for {
 		select {
 		case _ = <-refreshTimer.C:
 			if isActiveNow {
-				devState.Logger.Printf("Periodic calendar refresh starts")
+				devState.Logger.Info("Periodic calendar refresh starts")
 				err = busyTimes.Refresh(&config, &devState)
 				if err != nil {
-					devState.Logger.Printf("Reload failed: %v", err)
+					devState.Logger.Error("Calendar reload failed", "err", err)
 				}
-				isBusyTimeNow = busyTimes.ScheduledBusyNow(&config, &devState)
+				busyTimes.UpdateLayer(&config, &devState, layers)
 				transitionTimer.Stop()
-				transitionTimer.Reset(time.Until(busyTimes.NextTransitionTime(&config, &devState)))
+				transitionTimer.Reset(time.Until(nextTransitionTime(&config, &devState, &busyTimes, layers, rules)))
 			} else {
-				devState.Logger.Printf("Ignoring scheduled request to refresh calendar since service isn't active now.")
+				devState.Logger.Info("Ignoring scheduled request to refresh calendar since service isn't active now")
 				refreshTimer.Stop()
 			}
 
+		case _ = <-watchdog:
+			sdNotify("WATCHDOG=1")
+			continue eventLoop
+
+		case _ = <-activityTimer.C:
+			if activities.running() {
+				if err := activities.save(); err != nil {
+					devState.Logger.Warn("Unable to save activity times", "err", err)
+				}
+				events.publish("activities", activities.list())
+			}
+			continue eventLoop
+
 		case _ = <-transitionTimer.C:
-			devState.Logger.Printf("Scheduled status change")
-			isBusyTimeNow = busyTimes.ScheduledBusyNow(&config, &devState)
-			transitionTimer.Reset(time.Until(busyTimes.NextTransitionTime(&config, &devState)))
+			devState.Logger.Info("Scheduled status change")
+			busyTimes.UpdateLayer(&config, &devState, layers)
+			transitionTimer.Reset(time.Until(nextTransitionTime(&config, &devState, &busyTimes, layers, rules)))
+
+		case r := <-ctlReq:
+			switch r.op {
+			case "status":
+				r.reply <- controlReply{result: daemonStatus()}
+				continue eventLoop
+
+			case "explain":
+				if isActiveNow {
+					r.reply <- controlReply{result: decideStatus(&config, &busyTimes, layers, rules)}
+				} else {
+					r.reply <- controlReply{result: current}
+				}
+				continue eventLoop
+
+			case "display":
+				r.reply <- controlReply{result: busylight.Display{
+					Colors:      config.Colors,
+					ColorValues: config.ColorValues,
+					Statuses:    busylight.StatusNames(&config),
+				}}
+				continue eventLoop
+
+			case "set":
+				if _, err := busylight.StatusCommand(&config, r.override.Status); err != nil {
+					r.reply <- controlReply{err: err}
+					continue eventLoop
+				}
+				if !r.override.Until.IsZero() && !r.override.Until.After(time.Now()) {
+					r.reply <- controlReply{err: fmt.Errorf("%s expiration time %v is not in the future", r.layer, r.override.Until)}
+					continue eventLoop
+				}
+				if r.override.Until.IsZero() {
+					devState.Logger.Info("Manual status set until cancelled", "layer", r.layer, "status", r.override.Status)
+					layers.Set(r.layer, statusCandidate{Status: r.override.Status, Reason: fmt.Sprintf("%s set manually until cancelled", r.layer)})
+				} else {
+					devState.Logger.Info("Manual status set", "layer", r.layer, "status", r.override.Status, "until", r.override.Until)
+					layers.Set(r.layer, statusCandidate{
+						Status:  r.override.Status,
+						Reason:  fmt.Sprintf("%s set manually until %s", r.layer, r.override.Until.Local().Format("15:04:05")),
+						Expires: r.override.Until,
+					})
+				}
+
+			case "clear":
+				if c, ok := layers.Get(r.layer); ok {
+					devState.Logger.Info("Manual status cancelled", "layer", r.layer, "status", c.Status)
+				}
+				layers.Clear(r.layer)
+
+			case "meeting":
+				setMeeting(&devState, layers, r.override.Status)
+
+			case "wake":
+				sleptForSuspend = false
+				wake()
+
+			case "sleep":
+				sleep()
+
+			case "shutdown":
+				devState.Logger.Info("Received request to shut down")
+				r.reply <- controlReply{result: daemonStatus()}
+				break eventLoop
+
+			case "activities":
+				r.reply <- controlReply{result: activities.list()}
+				continue eventLoop
+
+			case "start-activity":
+				if err := activities.start(r.name); err != nil {
+					r.reply <- controlReply{err: err}
+					continue eventLoop
+				}
+				devState.Logger.Info("Activity started", "activity", r.name)
+				if !isActiveNow {
+					activities.pause()
+				}
+				activities.updateLayer(layers)
+
+			case "stop-activity":
+				if name := activities.name(); name != "" {
+					devState.Logger.Info("Activity stopped", "activity", name)
+				}
+				if err := activities.stop(); err != nil {
+					devState.Logger.Warn("Unable to save activity times", "err", err)
+				}
+				activities.updateLayer(layers)
+
+			case "clear-activities":
+				devState.Logger.Info("Activity times cleared")
+				if err := activities.clear(); err != nil {
+					r.reply <- controlReply{err: err}
+				} else {
+					r.reply <- controlReply{result: activities.list()}
+				}
+				events.publish("activities", activities.list())
+				continue eventLoop
+
+			case "reopen-log":
+				if logFile == nil {
+					r.reply <- controlReply{err: fmt.Errorf("not logging to a file")}
+				} else if err := logFile.Reopen(); err != nil {
+					r.reply <- controlReply{err: err}
+				} else {
+					devState.Logger.Info("Log file reopened")
+					r.reply <- controlReply{result: daemonStatus()}
+				}
+				continue eventLoop
+
+			default:
+				r.reply <- controlReply{err: fmt.Errorf("unknown request \"%s\"", r.op)}
+				continue eventLoop
+			}
+			if isActiveNow {
+				transitionTimer.Stop()
+				transitionTimer.Reset(time.Until(nextTransitionTime(&config, &devState, &busyTimes, layers, rules)))
+			}
+			r.reply <- controlReply{result: daemonStatus()}
+
+		case event := <-detected:
+			if !applyDetection(&devState, layers, detections, event) {
+				continue eventLoop
+			}
+
+		case event := <-suspending:
+			suspendDone = event.done
+			if event.sleeping {
+				devState.Logger.Info("Computer is about to suspend")
+				if isActiveNow {
+					sleep()
+					sleptForSuspend = true
+				}
+			} else {
+				devState.Logger.Info("Computer has resumed")
+				if sleptForSuspend {
+					sleptForSuspend = false
+					wake()
+				}
+			}
 
 		case externalSignal := <-req:
 			switch externalSignal {
 
 			case syscall.SIGVTALRM:
-				if !isActiveNow {
-					isActiveNow = true
-					devState.Logger.Printf("Activating service; re-loading configuration and opening serial port")
-					err = setup(&config, &devState)
-					if err != nil {
-						devState.Logger.Fatalf("Error loading configuration data. Unable to restart: %v", err)
-						return
-					}
-					devState.Logger.Printf("Activating service; getting fresh calendar data")
-					err = busyTimes.Refresh(&config, &devState)
-					if err != nil {
-						devState.Logger.Printf("Error updating busy/free times from calendar: %v", err)
-					}
-					devState.Logger.Printf("Resetting timers")
-					refreshTimer.Reset(1 * time.Hour)
-					isBusyTimeNow = busyTimes.ScheduledBusyNow(&config, &devState)
-					transitionTimer.Reset(time.Until(busyTimes.NextTransitionTime(&config, &devState)))
-				}
+				sleptForSuspend = false
+				wake()
 
 			case syscall.SIGHUP:
-				devState.Logger.Printf("Call ended")
-				isZoomNow = false
+				setMeeting(&devState, layers, "")
 
 			case syscall.SIGUSR1:
-				devState.Logger.Printf("Muted")
-				isZoomNow = true
-				isZoomMuted = true
+				setMeeting(&devState, layers, "muted")
 
 			case syscall.SIGUSR2:
-				devState.Logger.Printf("Unmuted")
-				isZoomNow = true
-				isZoomMuted = false
+				setMeeting(&devState, layers, "open")
 
 			case syscall.SIGWINCH:
-				if isActiveNow {
-					isActiveNow = false
-					devState.Logger.Printf("Stopping timers")
-					refreshTimer.Stop()
-					transitionTimer.Stop()
-					closeDevice(&config, &devState)
-					devState.Logger.Printf("Daemon in inactive state... zzz")
-				}
+				sleep()
 
 			case syscall.SIGPWR:
 				if isActiveNow {
-					devState.Logger.Printf("Reloading calendar status by request")
+					devState.Logger.Info("Reloading calendar status by request")
 					err = busyTimes.Refresh(&config, &devState)
 					if err != nil {
-						devState.Logger.Printf("Reload failed: %v", err)
+						devState.Logger.Error("Calendar reload failed", "err", err)
 					}
-					isBusyTimeNow = busyTimes.ScheduledBusyNow(&config, &devState)
+					busyTimes.UpdateLayer(&config, &devState, layers)
 					transitionTimer.Stop()
-					transitionTimer.Reset(time.Until(busyTimes.NextTransitionTime(&config, &devState)))
+					transitionTimer.Reset(time.Until(nextTransitionTime(&config, &devState, &busyTimes, layers, rules)))
 				} else {
-					devState.Logger.Printf("Ignoring reload request since service isn't active now.")
+					devState.Logger.Info("Ignoring reload request since service isn't active now")
 				}
 
-			case syscall.SIGINT:
-				devState.Logger.Printf("Received interrupt signal")
+			case syscall.SIGINT, syscall.SIGTERM:
+				devState.Logger.Info("Received signal to shut down", "signal", externalSignal)
 				break eventLoop
 
 			default:
-				devState.Logger.Printf("Received unexpeced signal %v (ignored)", externalSignal)
+				devState.Logger.Warn("Received unexpected signal (ignored)", "signal", externalSignal)
 			}
 		}
 
 		// Set signal to current state
+		for _, layer := range layers.Expire(time.Now()) {
+			devState.Logger.Info("Status expired", "layer", layer)
+		}
+		previous := current
+		if meeting := meetingState(layers); meeting != currentMeeting {
+			if currentMeeting == "" {
+				hooks.Fire(&config, "meeting-start", meeting, current, current)
+			} else if meeting == "" {
+				hooks.Fire(&config, "meeting-end", currentMeeting, current, current)
+			}
+			currentMeeting = meeting
+		}
 		if isActiveNow {
-			if isZoomNow {
-				if isZoomMuted {
-					if err := busylight.LightSignal(&config, &devState, "muted", 0); err != nil {
-						devState.Logger.Printf("busylight.LightSignal: %v", err)
-						shutdown(&config, &devState)
-						break
-					}
-					devState.Logger.Printf("Signal mic MUTED")
-				} else {
-					if err := busylight.LightSignal(&config, &devState, "open", 0); err != nil {
-						devState.Logger.Printf("busylight.LightSignal: %v", err)
-						shutdown(&config, &devState)
-						break
-					}
-					devState.Logger.Printf("Signal mic OPEN")
-				}
-			} else if isBusyTimeNow {
-				if err := busylight.LightSignal(&config, &devState, "busy", 0); err != nil {
-					devState.Logger.Printf("busylight.LightSignal: %v", err)
-					shutdown(&config, &devState)
-					break
-				}
-				devState.Logger.Printf("Signal BUSY")
-			} else {
-				if err := busylight.LightSignal(&config, &devState, "free", 0); err != nil {
-					devState.Logger.Printf("busylight.LightSignal: %v", err)
-					shutdown(&config, &devState)
-					break
-				}
-				devState.Logger.Printf("Signal FREE")
+			current = decideStatus(&config, &busyTimes, layers, rules)
+			if err := busylight.ShowStatus(&config, &devState, current.Status, 0); err != nil {
+				devState.Logger.Error("Unable to show status", "err", err)
+				shutdown(&config, &devState)
+				break
 			}
+			devState.Logger.Info("Signal", "status", current.Status, "layer", current.ResolvedLayer, "reason", current.Reason)
 		} else {
 			if err := busylight.LightSignal(&config, &devState, "off", 0); err != nil {
-				devState.Logger.Printf("busylight.LightSignal: %v", err)
+				devState.Logger.Error("Unable to turn off lights", "err", err)
 				shutdown(&config, &devState)
 				break
 			}
-			devState.Logger.Printf("Signal off")
+			current = busylight.Explanation{Status: "off", Reason: "daemon is sleeping"}
+			devState.Logger.Info("Signal", "status", "off")
+		}
+		hooks.StatusChanged(&config, previous, current)
+		status := daemonStatus()
+		webhooks.StatusChanged(previous, current, status.NextTransition)
+		metrics.update(&devState, status)
+		noteHistory()
+		broker.Update(status)
+		publishEvents(status)
+		if current.Status != previous.Status || current.Reason != previous.Reason {
+			sdNotify("STATUS=" + statusSummary(current, isActiveNow))
+		}
+		if suspendDone != nil {
+			close(suspendDone)
+			suspendDone = nil
 		}
 	}
+	close(eventLoopDone)
+	sdNotify("STOPPING=1\nSTATUS=Shutting down")
 	_ = busylight.LightSignal(&config, &devState, "off", 0)
+	stopped := busylight.Explanation{Status: "off", Reason: "daemon is shutting down"}
+	hooks.Fire(&config, "stop", current.Status, current, stopped)
+	webhooks.StatusChanged(current, stopped, time.Time{})
+	hooks.Wait(defaultHookTimeout)
+	webhooks.Stop(defaultWebhookTimeout)
+	if err := activities.pause(); err != nil {
+		devState.Logger.Warn("Unable to save activity times", "err", err)
+	}
+	isActiveNow, current = false, stopped
+	noteHistory()
+	broker.Update(daemonStatus())
+	publishEvents(daemonStatus())
+	broker.Close()
 }
@@ -0,0 +1,103 @@
+//
+// Camera watching for busylightd.
+//
+// If WatchCamera is set in config.json, we periodically look through
+// /proc/*/fd for processes which have a video device open. While any do,
+// the camera layer offers the "camera" status, which by default outranks
+// everything but manual overrides and flags, since being seen on camera
+// is generally more important to others than whether we can be heard.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"fmt"
+	"internal/busylight"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultCameraDevices = `^/dev/video[0-9]+$` // what a camera looks like if not configured
+
+// cameraDevices returns the pattern matching the names of camera devices.
+func cameraDevices(config *busylight.ConfigData) (*regexp.Regexp, error) {
+	pattern := config.CameraDevices
+	if pattern == "" {
+		pattern = defaultCameraDevices
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("CameraDevices: %v", err)
+	}
+	return re, nil
+}
+
+// camerasInUse returns the names of the processes which have a camera open.
+func camerasInUse(root string, devices *regexp.Regexp) ([]string, error) {
+	procs, err := scanProcesses(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []string
+	for pid, p := range procs {
+		for _, file := range openFiles(root, pid) {
+			if devices.MatchString(file) {
+				users = append(users, p.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(users)
+	return uniqueStrings(users), nil
+}
+
+// watchCamera checks whether any camera is in use every so often until told to quit,
+// reporting to the event loop via `events` when that changes.
+func watchCamera(config *busylight.ConfigData, devState *busylight.DevState, events chan<- detectorEvent, quit <-chan struct{}) {
+	interval, _ := detectInterval(config)
+	devices, _ := cameraDevices(config)
+	root := procRoot(config)
+
+	var lastError string
+	var lastEvent *detectorEvent
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		event := detectorEvent{source: "camera", layer: "camera"}
+		users, err := camerasInUse(root, devices)
+		if err != nil {
+			if err.Error() != lastError {
+				devState.Logger.Error("Camera detection failed", "err", err)
+				lastError = err.Error()
+			}
+		} else {
+			lastError = ""
+			if len(users) > 0 {
+				event.status = "camera"
+				event.reason = "camera in use by " + strings.Join(users, ", ")
+			}
+		}
+
+		if lastEvent == nil || *lastEvent != event {
+			select {
+			case events <- event:
+			case <-quit:
+				return
+			}
+			lastEvent = &event
+		}
+
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"internal/busylight"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openFakeFile makes a process in a fake /proc filesystem at root look as though it has
+// the file open, as the fd'th file descriptor.
+func openFakeFile(t *testing.T, root string, pid, fd int, file string) {
+	t.Helper()
+	dir := filepath.Join(root, strconv.Itoa(pid), "fd")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(file, filepath.Join(dir, strconv.Itoa(fd))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// closeFakeFile undoes openFakeFile.
+func closeFakeFile(t *testing.T, root string, pid, fd int) {
+	t.Helper()
+	if err := os.Remove(filepath.Join(root, strconv.Itoa(pid), "fd", strconv.Itoa(fd))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCamerasInUse(t *testing.T) {
+	dev := t.TempDir()
+	for _, name := range []string{"video0", "video1", "video-loopback", "null"} {
+		if err := os.WriteFile(filepath.Join(dev, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := t.TempDir()
+	writeFakeProcess(t, root, 100, 1, "zoom", "/opt/zoom/zoom")
+	writeFakeProcess(t, root, 200, 1, "obs", "/usr/bin/obs")
+	writeFakeProcess(t, root, 300, 1, "bash", "/bin/bash")
+	openFakeFile(t, root, 100, 0, filepath.Join(dev, "null"))
+	openFakeFile(t, root, 200, 0, filepath.Join(dev, "video-loopback"))
+	openFakeFile(t, root, 300, 0, filepath.Join(dev, "null"))
+	// Processes whose files we can't see don't get in the way.
+	writeFakeProcess(t, root, 400, 1, "secret", "/usr/bin/secret")
+
+	devices, err := cameraDevices(&busylight.ConfigData{CameraDevices: "^" + dev + "/video[0-9]+$"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(want ...string) {
+		t.Helper()
+		users, err := camerasInUse(root, devices)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(users, ",") != strings.Join(want, ",") {
+			t.Fatalf("cameras in use by %v, want %v", users, want)
+		}
+	}
+
+	check()
+	openFakeFile(t, root, 100, 7, filepath.Join(dev, "video0"))
+	check("zoom")
+	openFakeFile(t, root, 100, 8, filepath.Join(dev, "video1"))
+	openFakeFile(t, root, 200, 5, filepath.Join(dev, "video1"))
+	check("obs", "zoom")
+	closeFakeFile(t, root, 100, 7)
+	closeFakeFile(t, root, 100, 8)
+	check("obs")
+
+	if _, err := cameraDevices(&busylight.ConfigData{CameraDevices: "("}); err == nil {
+		t.Error("invalid CameraDevices accepted")
+	}
+	if re, _ := cameraDevices(&busylight.ConfigData{}); !re.MatchString("/dev/video2") || re.MatchString("/dev/video-loopback") {
+		t.Errorf("default CameraDevices %v is wrong", re)
+	}
+}
+
+func TestWatchCamera(t *testing.T) {
+	dev := t.TempDir()
+	root := t.TempDir()
+	writeFakeProcess(t, root, 100, 1, "zoom", "/opt/zoom/zoom")
+	config := &busylight.ConfigData{
+		ProcRoot:       root,
+		DetectInterval: "1s",
+		CameraDevices:  "^" + dev + "/video[0-9]+$",
+	}
+	events := make(chan detectorEvent)
+	quit := make(chan struct{})
+	defer close(quit)
+	go watchCamera(config, quietDevState(), events, quit)
+
+	expect := func(status, reason string) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event.source != "camera" || event.layer != "camera" || event.status != status || event.reason != reason {
+				t.Fatalf("got %+v, want status %q and reason %q", event, status, reason)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event reporting status %q", status)
+		}
+	}
+
+	expect("", "")
+	openFakeFile(t, root, 100, 3, filepath.Join(dev, "video0"))
+	expect("camera", "camera in use by zoom")
+	closeFakeFile(t, root, 100, 3)
+	expect("", "")
+}
@@ -0,0 +1,272 @@
+//
+// Control socket for busylightd.
+//
+// The daemon accepts HTTP requests on a Unix-domain socket so that clients
+// can send it requests which carry more information than a bare signal can
+// (such as a status override with an expiration time) and can get answers
+// back. The requests are handed off to the main event loop so that all
+// changes to the daemon's state happen in one place.
+//
+//    GET    /status   - report daemon state (busylight.DaemonStatus)
+//    GET    /explain  - report how the current status was chosen (busylight.Explanation)
+//    PUT    /override - set manual status override (busylight.Override)
+//    DELETE /override - cancel manual status override
+//    PUT    /flag     - set manual flag shown on top of the status (busylight.Override)
+//    DELETE /flag     - cancel manual flag
+//    PUT    /meeting  - signal being in a meeting (busylight.Override; Status is "muted" or "open")
+//    DELETE /meeting  - signal that the meeting has ended
+//    POST   /wake     - wake from idle state (as with VTALRM)
+//    POST   /sleep    - enter idle state (as with WINCH)
+//    POST   /shutdown - turn off lights and exit (as with INT)
+//    POST   /reopen-log - close and reopen the log file (after it's been moved away)
+//    GET    /metrics  - report Prometheus metrics (see metrics.go)
+//    GET    /activities - list activities and the time spent on each ([]busylight.Activity)
+//    DELETE /activities - set the time spent on every activity back to zero
+//    PUT    /activity - start an activity (busylight.Activity; only the Name is needed)
+//    DELETE /activity - stop the current activity
+//    GET    /display  - describe the lights and the statuses which may be chosen (busylight.Display)
+//    GET    /events   - stream changes as they happen (see events.go)
+//
+// All but wake, sleep, shutdown, reopen-log, and metrics are also available from
+// the ListenAddress for the web page (see web.go).
+//
+// If the daemon was socket-activated by systemd, the socket belongs to
+// systemd, which created it from the unit file, so we leave it alone.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"internal/busylight"
+	"net"
+	"net/http"
+	"os"
+)
+
+// controlRequest is a request received from a client, passed to the event loop for action.
+type controlRequest struct {
+	op       string             // what to do ("status", "explain", "display", "set", "clear", "meeting", "wake", "sleep", "shutdown", "reopen-log", "activities", "start-activity", "stop-activity", "clear-activities")
+	layer    string             // for "set" and "clear", the layer affected ("override" or "flag")
+	name     string             // for "start-activity", the activity to start
+	override busylight.Override // for "set" requests, or the meeting state ("muted", "open", or "")
+	reply    chan controlReply  // where to send the outcome
+}
+
+// controlReply is the event loop's response to a controlRequest.
+type controlReply struct {
+	result interface{} // sent back to the client as JSON
+	err    error
+}
+
+// startControlServer begins listening on the control socket (or the one systemd gave us),
+// passing all requests received to the event loop via the `requests` channel. It reports
+// whether the socket came from systemd.
+func startControlServer(config *busylight.ConfigData, devState *busylight.DevState, requests chan<- controlRequest) (net.Listener, bool, error) {
+	socket := busylight.ControlSocketPath(config)
+
+	listener, err := sdListener()
+	if err != nil {
+		return nil, false, err
+	}
+	activated := listener != nil
+	if activated {
+		socket = listener.Addr().String()
+	} else {
+		// Any socket file left behind by a previous daemon would prevent us from
+		// listening. We hold the PID file at this point so it isn't someone else's.
+		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+			return nil, false, fmt.Errorf("Unable to remove old control socket %s: %v", socket, err)
+		}
+		listener, err = net.Listen("unix", socket)
+		if err != nil {
+			return nil, false, fmt.Errorf("Unable to listen on control socket %s: %v", socket, err)
+		}
+		if err = os.Chmod(socket, 0600); err != nil {
+			listener.Close()
+			return nil, false, fmt.Errorf("Unable to set permissions on control socket %s: %v", socket, err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	handleSharedRequests(mux, requests)
+	for _, op := range []string{"wake", "sleep", "shutdown", "reopen-log"} {
+		mux.HandleFunc("/"+op, actionHandler(op, requests))
+	}
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			devState.Logger.Info("Control socket closed", "err", err)
+		}
+	}()
+	if activated {
+		devState.Logger.Info("Listening for control requests (from systemd)", "socket", socket)
+	} else {
+		devState.Logger.Info("Listening for control requests", "socket", socket)
+	}
+	return listener, activated, nil
+}
+
+// handleSharedRequests sets up the handlers for the requests which may come from either the
+// control socket or the web page.
+func handleSharedRequests(mux *http.ServeMux, requests chan<- controlRequest) {
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		sendControlRequest(w, r, requests, controlRequest{op: "status"})
+	})
+	mux.HandleFunc("/explain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		sendControlRequest(w, r, requests, controlRequest{op: "explain"})
+	})
+	mux.HandleFunc("/display", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		sendControlRequest(w, r, requests, controlRequest{op: "display"})
+	})
+	mux.HandleFunc("/events", eventsHandler)
+	mux.HandleFunc("/activities", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			sendControlRequest(w, r, requests, controlRequest{op: "activities"})
+		case http.MethodDelete:
+			sendControlRequest(w, r, requests, controlRequest{op: "clear-activities"})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/activity", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			var a busylight.Activity
+			if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+				http.Error(w, fmt.Sprintf("invalid activity request: %v", err), http.StatusBadRequest)
+				return
+			}
+			sendControlRequest(w, r, requests, controlRequest{op: "start-activity", name: a.Name})
+		case http.MethodDelete:
+			sendControlRequest(w, r, requests, controlRequest{op: "stop-activity"})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/override", manualLayerHandler("override", requests))
+	mux.HandleFunc("/flag", manualLayerHandler("flag", requests))
+	mux.HandleFunc("/meeting", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			var o busylight.Override
+			if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+				http.Error(w, fmt.Sprintf("invalid meeting request: %v", err), http.StatusBadRequest)
+				return
+			}
+			if o.Status != "muted" && o.Status != "open" {
+				http.Error(w, "meeting status must be \"muted\" or \"open\"", http.StatusBadRequest)
+				return
+			}
+			sendControlRequest(w, r, requests, controlRequest{op: "meeting", override: o})
+		case http.MethodDelete:
+			sendControlRequest(w, r, requests, controlRequest{op: "meeting"})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// actionHandler handles requests for the daemon to do something which needs no further details.
+func actionHandler(op string, requests chan<- controlRequest) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		sendControlRequest(w, r, requests, controlRequest{op: op})
+	}
+}
+
+// manualLayerHandler handles requests to set or clear the status offered by one of the
+// layers the user controls manually.
+func manualLayerHandler(layer string, requests chan<- controlRequest) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			var o busylight.Override
+			if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s request: %v", layer, err), http.StatusBadRequest)
+				return
+			}
+			sendControlRequest(w, r, requests, controlRequest{op: "set", layer: layer, override: o})
+
+		case http.MethodDelete:
+			sendControlRequest(w, r, requests, controlRequest{op: "clear", layer: layer})
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// eventLoopDone is closed once the event loop stops taking requests, so that any which
+// arrive while the daemon shuts down are turned away instead of waiting forever.
+var eventLoopDone = make(chan struct{})
+
+// errDaemonStopping is the outcome of a request which arrives after the event loop has stopped.
+var errDaemonStopping = errors.New("busylightd is shutting down")
+
+// submitRequest hands a request to the event loop and waits for its reply, giving up if
+// the context is cancelled or the event loop stops.
+func submitRequest(ctx context.Context, requests chan<- controlRequest, req controlRequest) (controlReply, error) {
+	req.reply = make(chan controlReply, 1)
+	select {
+	case requests <- req:
+	case <-ctx.Done():
+		return controlReply{}, ctx.Err()
+	case <-eventLoopDone:
+		return controlReply{}, errDaemonStopping
+	}
+
+	select {
+	case reply := <-req.reply:
+		return reply, nil
+	case <-ctx.Done():
+		return controlReply{}, ctx.Err()
+	case <-eventLoopDone:
+		// It may have answered just before stopping.
+		select {
+		case reply := <-req.reply:
+			return reply, nil
+		default:
+			return controlReply{}, errDaemonStopping
+		}
+	}
+}
+
+// sendControlRequest hands a request to the event loop and writes its reply back to the client.
+func sendControlRequest(w http.ResponseWriter, r *http.Request, requests chan<- controlRequest, req controlRequest) {
+	reply, err := submitRequest(r.Context(), requests, req)
+	if err != nil {
+		// The event loop has stopped (or the client has gone away, and won't see this anyway).
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if reply.err != nil {
+		http.Error(w, reply.err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply.result)
+}
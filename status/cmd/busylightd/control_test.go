@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSendControlRequest(t *testing.T) {
+	done := make(chan struct{})
+	eventLoopDone = done
+	t.Cleanup(func() { eventLoopDone = make(chan struct{}) })
+
+	// While the event loop is running, it answers.
+	requests := make(chan controlRequest)
+	go func() {
+		req := <-requests
+		req.reply <- controlReply{result: req.op}
+		req = <-requests
+		req.reply <- controlReply{err: errors.New("no such thing")}
+	}()
+	for _, want := range []int{http.StatusOK, http.StatusBadRequest} {
+		w := httptest.NewRecorder()
+		sendControlRequest(w, httptest.NewRequest("GET", "/status", nil), requests, controlRequest{op: "status"})
+		if w.Code != want {
+			t.Errorf("got %d, want %d", w.Code, want)
+		}
+	}
+
+	// A client which gives up isn't left waiting.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := submitRequest(ctx, requests, controlRequest{op: "status"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v from a request nobody took", err)
+	}
+
+	// Once the event loop stops, requests are turned away, including any it has taken
+	// but not answered.
+	taken := make(chan struct{})
+	go func() {
+		<-requests
+		close(taken)
+	}()
+	result := make(chan int, 2)
+	send := func(method, path, op string) {
+		w := httptest.NewRecorder()
+		sendControlRequest(w, httptest.NewRequest(method, path, nil), requests, controlRequest{op: op})
+		result <- w.Code
+	}
+	go send("POST", "/wake", "wake")
+	<-taken
+	close(done)
+	go send("GET", "/status", "status")
+	for i := 0; i < 2; i++ {
+		select {
+		case code := <-result:
+			if code != http.StatusServiceUnavailable {
+				t.Errorf("got %d after the event loop stopped", code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("request still waiting after the event loop stopped")
+		}
+	}
+}
@@ -0,0 +1,159 @@
+//
+// Server-sent events for busylightd.
+//
+// Clients may ask for GET /events to be told about changes as they happen
+// rather than polling for them. The response is a text/event-stream (as
+// understood by a web browser's EventSource) in which each event is named
+// for the kind of thing which changed, and carries the new state as JSON:
+//
+//    status     - the daemon's state has changed (busylight.DaemonStatus)
+//    meeting    - a meeting has started or ended, or the microphone was muted or unmuted (busylight.MeetingState)
+//    calendar   - the calendar has been polled, or a busy period has started or ended (busylight.CalendarState)
+//    device     - the light device has been found, or can no longer be reached (busylight.DeviceState)
+//    activities - an activity has started or stopped, or its time has changed ([]busylight.Activity)
+//
+// A new client is first sent the latest event of each kind, so it doesn't
+// need to ask for the current state separately.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"internal/busylight"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// eventKeepalive is how often we send something to idle clients so that nothing
+// between us and them decides the connection is dead.
+const eventKeepalive = 30 * time.Second
+
+// serverEvent is one event sent to clients.
+type serverEvent struct {
+	name string
+	data []byte
+}
+
+// eventHub passes events from the event loop to all of the clients listening for them.
+type eventHub struct {
+	lock        sync.Mutex
+	subscribers map[chan serverEvent]bool
+	latest      map[string]serverEvent // the latest event of each kind
+	names       []string               // the kinds of event, in the order first seen
+}
+
+// events is the daemon's one and only event hub.
+var events = &eventHub{
+	subscribers: make(map[chan serverEvent]bool),
+	latest:      make(map[string]serverEvent),
+}
+
+// publish sends an event to every client, unless it's the same as the last event of its kind.
+// A client which isn't keeping up is disconnected rather than allowed to hold up the daemon;
+// it can always connect again and be brought up to date.
+func (h *eventHub) publish(name string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	previous, seen := h.latest[name]
+	if seen && bytes.Equal(previous.data, data) {
+		return
+	}
+	if !seen {
+		h.names = append(h.names, name)
+	}
+	event := serverEvent{name: name, data: data}
+	h.latest[name] = event
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe registers a new client, returning the channel on which it will receive events,
+// which has the latest event of each kind already waiting in it.
+func (h *eventHub) subscribe() chan serverEvent {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	ch := make(chan serverEvent, len(h.names)+16)
+	for _, name := range h.names {
+		ch <- h.latest[name]
+	}
+	h.subscribers[ch] = true
+	return ch
+}
+
+// unsubscribe stops sending events to a client.
+func (h *eventHub) unsubscribe(ch chan serverEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.subscribers[ch] {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// deviceState reports whether we can reach the light device.
+func deviceState(devState *busylight.DevState) busylight.DeviceState {
+	return busylight.DeviceState{
+		Device:    devState.DeviceName,
+		Connected: devState.DeviceName != "" && devState.DeviceError == "",
+		Error:     devState.DeviceError,
+	}
+}
+
+// eventsHandler streams events to a client until it goes away.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.name, event.data); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
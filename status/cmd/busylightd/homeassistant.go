@@ -0,0 +1,142 @@
+//
+// Home Assistant MQTT discovery for busylightd.
+//
+// If enabled, we publish discovery messages so Home Assistant adds the
+// busylight as a device with these entities, all driven by the topics
+// described in mqtt.go:
+//
+//    select        Override        - pick a status from StatusLights to show until
+//                                    cancelled, or "none" to cancel
+//    sensor        Status          - status displayed now (with the rest of the
+//                                    StatusEvent as attributes)
+//    sensor        Next transition - when the daemon next expects to change the lights
+//    binary_sensor In meeting
+//    binary_sensor Muted
+//    binary_sensor Calendar busy
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"encoding/json"
+	"internal/busylight"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// haEntity is the discovery configuration for one Home Assistant entity. Fields which
+// don't apply to a given kind of entity are left empty.
+type haEntity struct {
+	Name                string   `json:"name"`
+	UniqueID            string   `json:"unique_id"`
+	ObjectID            string   `json:"object_id"`
+	Icon                string   `json:"icon,omitempty"`
+	DeviceClass         string   `json:"device_class,omitempty"`
+	StateTopic          string   `json:"state_topic"`
+	ValueTemplate       string   `json:"value_template,omitempty"`
+	JSONAttributesTopic string   `json:"json_attributes_topic,omitempty"`
+	PayloadOn           string   `json:"payload_on,omitempty"`
+	PayloadOff          string   `json:"payload_off,omitempty"`
+	CommandTopic        string   `json:"command_topic,omitempty"`
+	CommandTemplate     string   `json:"command_template,omitempty"`
+	Options             []string `json:"options,omitempty"`
+	AvailabilityTopic   string   `json:"availability_topic"`
+	Device              haDevice `json:"device"`
+}
+
+// haDevice identifies the device all our entities belong to.
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+// haStatusOptions returns the status names offered in the Override select entity.
+func haStatusOptions(config *busylight.ConfigData) []string {
+	var names []string
+	for name := range config.StatusLights {
+		// These are only flashed by the daemon itself as it starts and stops.
+		if name != "start" && name != "stop" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{"none"}, names...)
+}
+
+// advertise queues the Home Assistant discovery messages for our entities to be published.
+func (b *mqttBridge) advertise(config *busylight.ConfigData) {
+	discovery := strings.TrimSuffix(config.MQTT.DiscoveryPrefix, "/")
+	if discovery == "" {
+		discovery = "homeassistant"
+	}
+	node := "busylight_" + regexp.MustCompile(`[^a-zA-Z0-9_-]`).ReplaceAllString(b.user, "_")
+	device := haDevice{
+		Identifiers:  []string{node},
+		Name:         "Busylight (" + b.user + ")",
+		Manufacturer: "MadScienceZone",
+		Model:        "busylight",
+	}
+
+	entities := map[string]haEntity{
+		"select/override": {
+			Name:            "Override",
+			Icon:            "mdi:traffic-light",
+			StateTopic:      b.prefix + "/override",
+			CommandTopic:    b.prefix + "/cmd/status",
+			CommandTemplate: "{{ '' if value == 'none' else value }}",
+			Options:         haStatusOptions(config),
+		},
+		"sensor/status": {
+			Name:                "Status",
+			Icon:                "mdi:traffic-light",
+			StateTopic:          b.prefix + "/status",
+			ValueTemplate:       "{{ value_json.Status }}",
+			JSONAttributesTopic: b.prefix + "/status",
+		},
+		"sensor/next_transition": {
+			Name:          "Next transition",
+			DeviceClass:   "timestamp",
+			StateTopic:    b.prefix + "/status",
+			ValueTemplate: "{{ value_json.NextTransition | default(None) }}",
+		},
+		"binary_sensor/in_meeting": {
+			Name:          "In meeting",
+			Icon:          "mdi:account-voice",
+			StateTopic:    b.prefix + "/meeting",
+			ValueTemplate: "{{ 'OFF' if value == 'none' else 'ON' }}",
+		},
+		"binary_sensor/muted": {
+			Name:          "Muted",
+			Icon:          "mdi:microphone-off",
+			StateTopic:    b.prefix + "/meeting",
+			ValueTemplate: "{{ 'ON' if value == 'muted' else 'OFF' }}",
+		},
+		"binary_sensor/calendar_busy": {
+			Name:       "Calendar busy",
+			Icon:       "mdi:calendar-clock",
+			StateTopic: b.prefix + "/calendar",
+			PayloadOn:  "busy",
+			PayloadOff: "free",
+		},
+	}
+
+	for kind, entity := range entities {
+		component, object, _ := strings.Cut(kind, "/")
+		entity.UniqueID = node + "_" + object
+		entity.ObjectID = node + "_" + object
+		entity.AvailabilityTopic = b.prefix + "/availability"
+		entity.Device = device
+		data, err := json.Marshal(entity)
+		if err != nil {
+			b.devState.Logger.Error("Unable to encode Home Assistant discovery message", "err", err)
+			continue
+		}
+		b.publishTopic(discovery+"/"+component+"/"+node+"/"+object+"/config", data)
+	}
+}
@@ -0,0 +1,220 @@
+//
+// Hook commands for busylightd.
+//
+// The user may configure commands to be run when certain things happen,
+// such as entering or leaving a status or starting or ending a meeting.
+// These run in the background, a limited number at a time, so that a slow
+// hook can never hold up the event loop. If too many pile up waiting to
+// run, new ones are dropped (and logged) rather than blocking.
+//
+// Each command is given information about the event in its environment:
+//
+//    BUSYLIGHT_EVENT       - the event (enter, leave, meeting-start, ...)
+//    BUSYLIGHT_STATUS      - for enter and leave hooks, the status entered or left
+//    BUSYLIGHT_OLD_STATUS  - the status displayed before the event
+//    BUSYLIGHT_NEW_STATUS  - the status displayed after the event
+//    BUSYLIGHT_LAYER       - the layer(s) the new status came from
+//    BUSYLIGHT_RULE        - the rule which chose the new status, if any
+//    BUSYLIGHT_REASON      - why the new status is displayed
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"internal/busylight"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHookTimeout     = 30 * time.Second // how long hooks may run if not configured
+	defaultConcurrentHooks = 4                // how many hooks may run at once if not configured
+	maxQueuedHooks         = 32               // how many hooks may be waiting to run
+)
+
+// hookJob is a hook command waiting to be run.
+type hookJob struct {
+	hook  busylight.HookConfigData
+	event string
+	env   []string
+}
+
+// hookRunner runs hook commands in the background.
+type hookRunner struct {
+	devState *busylight.DevState
+	queue    chan hookJob
+	pending  sync.WaitGroup
+}
+
+// newHookRunner starts the background workers which run hooks.
+func newHookRunner(config *busylight.ConfigData, devState *busylight.DevState) *hookRunner {
+	h := &hookRunner{
+		devState: devState,
+		queue:    make(chan hookJob, maxQueuedHooks),
+	}
+	workers := config.MaxConcurrentHooks
+	if workers <= 0 {
+		workers = defaultConcurrentHooks
+	}
+	for i := 0; i < workers; i++ {
+		go h.worker()
+	}
+	return h
+}
+
+// checkHooks reports any errors in the hook definitions in the configuration.
+func checkHooks(config *busylight.ConfigData) error {
+	for i, hook := range config.Hooks {
+		switch hook.Event {
+		case "enter", "leave", "meeting-start", "meeting-end", "start", "stop":
+		default:
+			return fmt.Errorf("hook #%d: unknown event \"%s\"", i+1, hook.Event)
+		}
+		if len(hook.Command) == 0 {
+			return fmt.Errorf("hook #%d: no command given", i+1)
+		}
+		if hook.Timeout != "" {
+			if _, err := time.ParseDuration(hook.Timeout); err != nil {
+				return fmt.Errorf("hook #%d: invalid timeout: %v", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// hookEnvironment builds the environment variables describing a change from old to new.
+func hookEnvironment(event, status string, old, new busylight.Explanation) []string {
+	return []string{
+		"BUSYLIGHT_EVENT=" + event,
+		"BUSYLIGHT_STATUS=" + status,
+		"BUSYLIGHT_OLD_STATUS=" + old.Status,
+		"BUSYLIGHT_NEW_STATUS=" + new.Status,
+		"BUSYLIGHT_LAYER=" + new.ResolvedLayer,
+		"BUSYLIGHT_RULE=" + new.Rule,
+		"BUSYLIGHT_REASON=" + new.Reason,
+	}
+}
+
+// Fire queues all hooks configured for the event to be run. For "enter" and "leave" events,
+// status is the status entered or left, and hooks which name a different status are skipped.
+func (h *hookRunner) Fire(config *busylight.ConfigData, event, status string, old, new busylight.Explanation) {
+	for _, hook := range config.Hooks {
+		if hook.Event == event && (hook.Status == "" || hook.Status == status) {
+			h.enqueue(hook, event, status, old, new)
+		}
+	}
+}
+
+// enqueue adds a hook to the queue of those waiting to run, unless the queue is full.
+func (h *hookRunner) enqueue(hook busylight.HookConfigData, event, status string, old, new busylight.Explanation) {
+	h.pending.Add(1)
+	select {
+	case h.queue <- hookJob{hook: hook, event: event, env: hookEnvironment(event, status, old, new)}:
+	default:
+		h.pending.Done()
+		h.devState.Logger.Warn("Too many hooks waiting to run; dropped hook", "event", event, "command", hook.Command)
+	}
+}
+
+// StatusChanged fires the "leave" and "enter" hooks for a change of status. Hooks which
+// name a status are fired when that status starts or stops being part of what's displayed
+// (so going from "busy" to "busy+lowpri" enters "lowpri" but does not leave "busy").
+// Hooks which don't name a status are fired once for any change.
+func (h *hookRunner) StatusChanged(config *busylight.ConfigData, old, new busylight.Explanation) {
+	if old.Status == new.Status {
+		return
+	}
+	oldParts := strings.Split(old.Status, "+")
+	newParts := strings.Split(new.Status, "+")
+	contains := func(list []string, s string) bool {
+		for _, item := range list {
+			if item == s {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, hook := range config.Hooks {
+		switch {
+		case hook.Event == "leave" && old.Status != "" && hook.Status == "":
+			h.enqueue(hook, "leave", old.Status, old, new)
+		case hook.Event == "leave" && contains(oldParts, hook.Status) && !contains(newParts, hook.Status):
+			h.enqueue(hook, "leave", hook.Status, old, new)
+		}
+	}
+	for _, hook := range config.Hooks {
+		switch {
+		case hook.Event == "enter" && hook.Status == "":
+			h.enqueue(hook, "enter", new.Status, old, new)
+		case hook.Event == "enter" && contains(newParts, hook.Status) && !contains(oldParts, hook.Status):
+			h.enqueue(hook, "enter", hook.Status, old, new)
+		}
+	}
+}
+
+// Wait waits for all queued hooks to finish, but no longer than the given time.
+func (h *hookRunner) Wait(limit time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		h.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(limit):
+		h.devState.Logger.Warn("Gave up waiting for hooks to finish")
+	}
+}
+
+// worker runs hooks from the queue, one at a time.
+func (h *hookRunner) worker() {
+	for job := range h.queue {
+		h.run(job)
+		h.pending.Done()
+	}
+}
+
+// run runs a single hook command, logging the outcome.
+func (h *hookRunner) run(job hookJob) {
+	timeout := defaultHookTimeout
+	if job.hook.Timeout != "" {
+		if t, err := time.ParseDuration(job.hook.Timeout); err == nil {
+			timeout = t
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, job.hook.Command[0], job.hook.Command[1:]...)
+	cmd.Env = append(os.Environ(), job.env...)
+	cmd.WaitDelay = 5 * time.Second
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	elapsed := time.Since(start).Round(time.Millisecond)
+
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		h.devState.Logger.Error("Hook killed after timeout", "event", job.event, "command", job.hook.Command, "timeout", timeout)
+	case errors.As(err, &exitErr):
+		h.devState.Logger.Warn("Hook failed", "event", job.event, "command", job.hook.Command, "status", exitErr.ExitCode(), "elapsed", elapsed)
+	case err != nil:
+		h.devState.Logger.Error("Hook could not be run", "event", job.event, "command", job.hook.Command, "err", err)
+	default:
+		h.devState.Logger.Info("Hook finished", "event", job.event, "command", job.hook.Command, "status", 0, "elapsed", elapsed)
+	}
+	if out := strings.TrimSpace(string(output)); out != "" {
+		h.devState.Logger.Info("Hook output", "event", job.event, "command", job.hook.Command, "output", out)
+	}
+}
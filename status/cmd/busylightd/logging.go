@@ -0,0 +1,225 @@
+//
+// Logging for busylightd.
+//
+// The daemon logs via log/slog, as text or JSON, at the level given in
+// config.json (which may be changed by reloading the configuration). When
+// logging to LogFile, we start a new file whenever the current one gets too
+// big or too old, keeping a few of the old ones around. The log may also be
+// reopened on request via the control socket, for the benefit of external
+// tools like logrotate which move the file out from under us.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"fmt"
+	"internal/busylight"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLogMaxSize = 10 // megabytes
+	defaultLogBackups = 5
+)
+
+// logLevel is how much the daemon logs; it can be changed while we run.
+var logLevel slog.LevelVar
+
+// logFile is the file we're logging to, or nil if we're logging to the standard error.
+var logFile *rotatingLog
+
+// logSettings are the logging settings from the configuration, checked and ready for use.
+type logSettings struct {
+	level   slog.Level
+	json    bool
+	maxSize int64 // bytes, or 0 for no limit
+	maxAge  time.Duration
+	backups int
+}
+
+// checkLogging interprets the logging settings in the configuration, reporting any errors in them.
+func checkLogging(config *busylight.ConfigData) (logSettings, error) {
+	s := logSettings{
+		maxSize: defaultLogMaxSize << 20,
+		backups: defaultLogBackups,
+	}
+	if config.LogLevel != "" {
+		if err := s.level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+			return s, fmt.Errorf("invalid LogLevel \"%s\"", config.LogLevel)
+		}
+	}
+	switch strings.ToLower(config.LogFormat) {
+	case "", "text":
+	case "json":
+		s.json = true
+	default:
+		return s, fmt.Errorf("LogFormat must be \"text\" or \"json\"")
+	}
+	switch {
+	case config.LogMaxSize < 0:
+		s.maxSize = 0
+	case config.LogMaxSize > 0:
+		s.maxSize = int64(config.LogMaxSize) << 20
+	}
+	if config.LogMaxAge != "" {
+		age, err := time.ParseDuration(config.LogMaxAge)
+		if err != nil {
+			return s, fmt.Errorf("invalid LogMaxAge: %v", err)
+		}
+		if age < time.Minute {
+			return s, fmt.Errorf("LogMaxAge %v is too short", age)
+		}
+		s.maxAge = age
+	}
+	if config.LogBackups > 0 {
+		s.backups = config.LogBackups
+	}
+	return s, nil
+}
+
+// newLogger creates the daemon's logger, writing to the standard error if we're running in the
+// foreground or to LogFile otherwise.
+func newLogger(config *busylight.ConfigData, settings logSettings) (*slog.Logger, error) {
+	var w io.Writer = os.Stderr
+	options := &slog.HandlerOptions{Level: &logLevel}
+	logLevel.Set(settings.level)
+
+	if *Fforeground {
+		if os.Getenv("JOURNAL_STREAM") != "" {
+			// journald already notes when each message was logged.
+			options.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 && a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return a
+			}
+		}
+	} else {
+		f, err := openRotatingLog(config.LogFile, settings)
+		if err != nil {
+			return nil, err
+		}
+		logFile, w = f, f
+	}
+
+	if settings.json {
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return slog.New(slog.NewTextHandler(w, options)), nil
+}
+
+// applyLogSettings puts new logging settings into effect, as far as that's possible
+// without starting over with a new logger.
+func applyLogSettings(settings logSettings) {
+	logLevel.Set(settings.level)
+	if logFile != nil {
+		logFile.configure(settings)
+	}
+}
+
+// rotatingLog is a log file which is started over (keeping some old ones) when it gets
+// too big or too old.
+type rotatingLog struct {
+	lock    sync.Mutex
+	path    string
+	file    *os.File
+	size    int64     // how much is in the file now
+	opened  time.Time // when we started writing to the file
+	maxSize int64
+	maxAge  time.Duration
+	backups int
+}
+
+// openRotatingLog opens the log file at path, appending to anything already there.
+func openRotatingLog(path string, settings logSettings) (*rotatingLog, error) {
+	l := &rotatingLog{path: path}
+	l.configure(settings)
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// configure changes when the log is started over.
+func (l *rotatingLog) configure(settings logSettings) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.maxSize, l.maxAge, l.backups = settings.maxSize, settings.maxAge, settings.backups
+}
+
+// open opens the log file. The caller must hold the lock (or be the only one with access to l).
+func (l *rotatingLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open logfile: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Unable to open logfile: %v", err)
+	}
+	l.file, l.size, l.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+// Write adds to the log, starting a new file first if it's time to do so.
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.size > 0 && ((l.maxSize > 0 && l.size+int64(len(p)) > l.maxSize) || (l.maxAge > 0 && time.Since(l.opened) > l.maxAge)) {
+		if err := l.rotate(); err != nil {
+			// Keep logging to the old file rather than losing messages.
+			fmt.Fprintf(os.Stderr, "busylightd: %v\n", err)
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate moves the log file to LogFile.1 (and older ones to LogFile.2, etc., discarding
+// the oldest) and starts a new one. The caller must hold the lock.
+func (l *rotatingLog) rotate() error {
+	for i := l.backups; i > 0; i-- {
+		older := fmt.Sprintf("%s.%d", l.path, i)
+		if i == l.backups {
+			os.Remove(older)
+			continue
+		}
+		os.Rename(older, fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if l.backups > 0 {
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return fmt.Errorf("Unable to rotate logfile: %v", err)
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return fmt.Errorf("Unable to rotate logfile: %v", err)
+	}
+	return l.reopen()
+}
+
+// reopen closes the log file and opens it again. The caller must hold the lock.
+func (l *rotatingLog) reopen() error {
+	old := l.file
+	if err := l.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+// Reopen closes the log file and opens it again, as when something else has moved it away.
+func (l *rotatingLog) Reopen() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.reopen()
+}
@@ -0,0 +1,269 @@
+//
+// Meeting detection for busylightd.
+//
+// Rather than relying on external automation to send us signals, the
+// daemon can notice on its own when the user is in a meeting, by
+// periodically looking for the processes and/or window titles which the
+// MeetingDetectors in config.json say only appear during one. When a
+// meeting starts, we show it in the meeting layer (as if -open had been
+// given, unless the meeting state was already signalled some other way),
+// and when it ends we clear the meeting layer (as if -cal had been given).
+//
+// For example, a Zoom meeting might be recognized by a "CptHost" process
+// running under the "zoom" process, while a Google Meet call in a web
+// browser would need to be recognized by its window title.
+//
+// If the microphone is being watched as well (see microphone.go), what it
+// tells us takes precedence, since it knows whether the mic is muted.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"internal/busylight"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const defaultDetectInterval = 10 * time.Second // how often detectors check if not configured
+
+// detectorEvent reports a change in something one of the detectors watches for.
+type detectorEvent struct {
+	source string // which detector noticed
+	layer  string // which layer it affects
+	status string // the status it suggests for that layer ("" when the condition has ended)
+	reason string // why
+}
+
+// meetingDetector is a MeetingDetectorConfigData from the configuration, prepared for use.
+type meetingDetector struct {
+	busylight.MeetingDetectorConfigData
+	process *regexp.Regexp // compiled Process, or nil
+	child   *regexp.Regexp // compiled Child, or nil
+	window  *regexp.Regexp // compiled WindowTitle, or nil
+}
+
+// detectInterval returns how often the detectors should look around.
+func detectInterval(config *busylight.ConfigData) (time.Duration, error) {
+	if config.DetectInterval == "" {
+		return defaultDetectInterval, nil
+	}
+	interval, err := time.ParseDuration(config.DetectInterval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid DetectInterval: %v", err)
+	}
+	if interval < time.Second {
+		return 0, fmt.Errorf("DetectInterval %v is too short", interval)
+	}
+	return interval, nil
+}
+
+// compileMeetingDetectors prepares the meeting detectors from the configuration for use,
+// reporting any errors in them.
+func compileMeetingDetectors(config *busylight.ConfigData) ([]meetingDetector, error) {
+	var detectors []meetingDetector
+	var err error
+
+	if _, err = detectInterval(config); err != nil {
+		return nil, err
+	}
+	for i, dc := range config.MeetingDetectors {
+		d := meetingDetector{MeetingDetectorConfigData: dc}
+		if d.Name == "" {
+			d.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if d.Process == "" && d.WindowTitle == "" {
+			return nil, fmt.Errorf("meeting detector %s: must have Process or WindowTitle", d.Name)
+		}
+		if d.Child != "" && d.Process == "" {
+			return nil, fmt.Errorf("meeting detector %s: Child requires Process", d.Name)
+		}
+		if d.WindowTitle != "" && len(config.WindowTitleCommand) == 0 {
+			return nil, fmt.Errorf("meeting detector %s: WindowTitle requires WindowTitleCommand", d.Name)
+		}
+		for _, pattern := range []struct {
+			field string
+			value string
+			re    **regexp.Regexp
+		}{
+			{"Process", d.Process, &d.process},
+			{"Child", d.Child, &d.child},
+			{"WindowTitle", d.WindowTitle, &d.window},
+		} {
+			if pattern.value != "" {
+				if *pattern.re, err = regexp.Compile(pattern.value); err != nil {
+					return nil, fmt.Errorf("meeting detector %s: %s: %v", d.Name, pattern.field, err)
+				}
+			}
+		}
+		detectors = append(detectors, d)
+	}
+	return detectors, nil
+}
+
+// matches reports whether a process's name or command line matches the pattern.
+func matches(re *regexp.Regexp, p process) bool {
+	return re.MatchString(p.Name) || re.MatchString(p.CommandLine)
+}
+
+// detect reports whether the detector's patterns all match what's running now.
+func (d meetingDetector) detect(procs map[int]process, titles []string) bool {
+	if d.process != nil {
+		found := false
+		for _, p := range procs {
+			if d.child != nil {
+				found = matches(d.child, p) && descendsFrom(procs, p, func(parent process) bool { return matches(d.process, parent) })
+			} else {
+				found = matches(d.process, p)
+			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if d.window != nil {
+		for _, title := range titles {
+			if d.window.MatchString(title) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// windowTitles runs the configured command to list the titles of the open windows.
+func windowTitles(command []string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, command[0], command[1:]...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", command, err)
+	}
+	return strings.Split(strings.TrimRight(string(output), "\n"), "\n"), nil
+}
+
+// watchMeetings checks for meetings every so often until told to quit, reporting to the
+// event loop via `events` when one starts or ends (and what it finds the first time).
+func watchMeetings(config *busylight.ConfigData, devState *busylight.DevState, detectors []meetingDetector, events chan<- detectorEvent, quit <-chan struct{}) {
+	interval, _ := detectInterval(config)
+	root := procRoot(config)
+	titleCommand := config.WindowTitleCommand
+	needTitles := false
+	for _, d := range detectors {
+		if d.window != nil {
+			needTitles = true
+		}
+	}
+
+	var lastError string
+	var lastEvent *detectorEvent
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var problems []string
+		procs, err := scanProcesses(root)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		var titles []string
+		if needTitles {
+			if titles, err = windowTitles(titleCommand); err != nil {
+				problems = append(problems, fmt.Sprintf("Unable to list window titles: %v", err))
+			}
+		}
+		// Only log a problem once, rather than every time we look.
+		if problem := strings.Join(problems, "; "); problem != lastError {
+			if problem != "" {
+				devState.Logger.Error("Meeting detection failed", "err", problem)
+			}
+			lastError = problem
+		}
+
+		event := detectorEvent{source: "meetings", layer: "meeting"}
+		for _, d := range detectors {
+			if d.detect(procs, titles) {
+				event.status = "open"
+				event.reason = fmt.Sprintf("in a meeting (%s detected)", d.Name)
+				break
+			}
+		}
+		if lastEvent == nil || lastEvent.status != event.status {
+			select {
+			case events <- event:
+			case <-quit:
+				return
+			}
+			lastEvent = &event
+		}
+
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// applyDetection updates the layers to reflect a change reported by a detector.
+// The detections map holds the latest report from each detector. Returns false
+// if nothing actually changed.
+func applyDetection(devState *busylight.DevState, layers *statusResolver, detections map[string]detectorEvent, event detectorEvent) bool {
+	old := detections[event.source]
+	if old.status == event.status && old.reason == event.reason {
+		return false
+	}
+	if event.status == "" {
+		delete(detections, event.source)
+	} else {
+		detections[event.source] = event
+	}
+
+	switch event.layer {
+	case "meeting":
+		// What the microphone is doing is more specific than just knowing there's
+		// a meeting, which is in turn more specific than knowing nothing.
+		mic, micInUse := detections["microphone"]
+		meeting, inMeeting := detections["meetings"]
+		switch {
+		case micInUse:
+			devState.Logger.Info("Meeting detected", "reason", mic.reason)
+			layers.Set("meeting", statusCandidate{Status: mic.status, Reason: mic.reason})
+		case inMeeting && event.source == "meetings":
+			if _, ok := layers.Get("meeting"); !ok {
+				// If we were already told we're in a meeting, that's more specific than we know.
+				devState.Logger.Info("Meeting detected", "reason", meeting.reason)
+				layers.Set("meeting", statusCandidate{Status: meeting.status, Reason: meeting.reason})
+			}
+		case inMeeting:
+			// The microphone is no longer in use, but the meeting carries on, so
+			// leave the meeting layer as it was.
+		default:
+			devState.Logger.Info("Meeting no longer detected")
+			layers.Clear("meeting")
+		}
+
+	default:
+		if event.status == "" {
+			devState.Logger.Info("No longer detected", "layer", old.layer, "reason", old.reason)
+			layers.Clear(event.layer)
+		} else {
+			devState.Logger.Info("Detected", "layer", event.layer, "reason", event.reason)
+			layers.Set(event.layer, statusCandidate{Status: event.status, Reason: event.reason})
+		}
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"internal/busylight"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFakeProcess adds a process to a fake /proc filesystem at root.
+func writeFakeProcess(t *testing.T, root string, pid, ppid int, comm string, args ...string) {
+	t.Helper()
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"comm":    comm + "\n",
+		"cmdline": strings.Join(args, "\x00") + "\x00",
+		"stat":    strconv.Itoa(pid) + " (" + comm + ") S " + strconv.Itoa(ppid) + " 1 1 0 -1 4194560",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestScanProcesses(t *testing.T) {
+	root := t.TempDir()
+	writeFakeProcess(t, root, 1, 0, "systemd", "/sbin/init")
+	writeFakeProcess(t, root, 100, 1, "zoom", "/opt/zoom/zoom", "--url=x")
+	writeFakeProcess(t, root, 200, 100, "Web (Content) 1", "/usr/lib/firefox")
+	os.MkdirAll(filepath.Join(root, "self"), 0755)
+	os.WriteFile(filepath.Join(root, "uptime"), []byte("1 1\n"), 0644)
+
+	procs, err := scanProcesses(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(procs) != 3 {
+		t.Fatalf("found %d processes, want 3: %v", len(procs), procs)
+	}
+	if p := procs[100]; p.Name != "zoom" || p.CommandLine != "/opt/zoom/zoom --url=x" || p.PPID != 1 {
+		t.Errorf("process 100 is %+v", p)
+	}
+	if p := procs[200]; p.Name != "Web (Content) 1" || p.PPID != 100 {
+		t.Errorf("process 200 is %+v", p)
+	}
+}
+
+func TestMeetingDetectors(t *testing.T) {
+	config := &busylight.ConfigData{
+		WindowTitleCommand: []string{"printf", "Inbox - Mail\nMeet - standup\n"},
+		MeetingDetectors: []busylight.MeetingDetectorConfigData{
+			{Name: "zoom", Process: "^zoom$", Child: "^CptHost$"},
+			{Name: "meet", WindowTitle: "^Meet - "},
+			{Name: "teams", WindowTitle: "^Microsoft Teams meeting"},
+		},
+	}
+	detectors, err := compileMeetingDetectors(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	titles, err := windowTitles(config.WindowTitleCommand)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := t.TempDir()
+	writeFakeProcess(t, root, 1, 0, "systemd", "/sbin/init")
+	writeFakeProcess(t, root, 100, 1, "zoom", "/opt/zoom/zoom")
+	writeFakeProcess(t, root, 300, 1, "CptHost", "/opt/zoom/cpthost")
+	procs, _ := scanProcesses(root)
+	if detectors[0].detect(procs, nil) {
+		t.Error("zoom detected from a CptHost which isn't zoom's")
+	}
+
+	writeFakeProcess(t, root, 200, 100, "zoom-helper", "/opt/zoom/helper")
+	writeFakeProcess(t, root, 201, 200, "CptHost", "/opt/zoom/cpthost")
+	procs, _ = scanProcesses(root)
+	if !detectors[0].detect(procs, nil) {
+		t.Error("zoom not detected from its CptHost grandchild")
+	}
+
+	if !detectors[1].detect(procs, titles) {
+		t.Errorf("meet not detected from window titles %q", titles)
+	}
+	if detectors[2].detect(procs, titles) {
+		t.Errorf("teams detected from window titles %q", titles)
+	}
+}
+
+func TestCompileMeetingDetectorsErrors(t *testing.T) {
+	for _, test := range []struct {
+		detector busylight.MeetingDetectorConfigData
+		problem  string
+	}{
+		{busylight.MeetingDetectorConfigData{Name: "empty"}, "must have Process or WindowTitle"},
+		{busylight.MeetingDetectorConfigData{Name: "orphan", Child: "x", WindowTitle: "y"}, "Child requires Process"},
+		{busylight.MeetingDetectorConfigData{Name: "browser", WindowTitle: "x"}, "requires WindowTitleCommand"},
+		{busylight.MeetingDetectorConfigData{Name: "bad", Process: "("}, "Process:"},
+	} {
+		config := &busylight.ConfigData{MeetingDetectors: []busylight.MeetingDetectorConfigData{test.detector}}
+		if _, err := compileMeetingDetectors(config); err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("detector %+v: error %v, want one about %q", test.detector, err, test.problem)
+		}
+	}
+}
+
+func TestWatchMeetings(t *testing.T) {
+	root := t.TempDir()
+	writeFakeProcess(t, root, 1, 0, "systemd", "/sbin/init")
+	writeFakeProcess(t, root, 100, 1, "zoom", "/opt/zoom/zoom")
+	config := &busylight.ConfigData{
+		ProcRoot:         root,
+		DetectInterval:   "1s",
+		MeetingDetectors: []busylight.MeetingDetectorConfigData{{Name: "zoom", Process: "^zoom$", Child: "^CptHost$"}},
+	}
+	detectors, err := compileMeetingDetectors(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan detectorEvent)
+	quit := make(chan struct{})
+	defer close(quit)
+	go watchMeetings(config, quietDevState(), detectors, events, quit)
+
+	expect := func(status string) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event.source != "meetings" || event.layer != "meeting" || event.status != status {
+				t.Fatalf("got %+v, want status %q", event, status)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event reporting status %q", status)
+		}
+	}
+
+	expect("")
+	writeFakeProcess(t, root, 101, 100, "CptHost", "/opt/zoom/cpthost")
+	expect("open")
+	os.RemoveAll(filepath.Join(root, "101"))
+	expect("")
+}
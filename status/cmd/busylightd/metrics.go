@@ -0,0 +1,186 @@
+//
+// Prometheus metrics for busylightd.
+//
+// The daemon keeps track of what it has been showing, how its calendar
+// polls have gone, and how well the light device has been behaving, and
+// reports all of that in Prometheus's text format at /metrics. This is
+// always available on the control socket, and also on a TCP port (where
+// Prometheus can scrape it) if MetricsAddress is set in config.json.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"fmt"
+	"internal/busylight"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// daemonMetrics is what we've counted so far. The event loop updates it, while
+// /metrics requests read it from other goroutines.
+type daemonMetrics struct {
+	lock        sync.Mutex
+	devState    *busylight.DevState
+	active      bool
+	inMeeting   bool
+	muted       bool
+	status      string                   // what we're showing now
+	statusSince time.Time                // when we started showing it
+	transitions map[string]uint64        // how many times we've changed to each status
+	statusTime  map[string]time.Duration // how long we've shown each status (not counting the current stretch)
+	polls       map[bool]uint64          // calendar polls which succeeded (true) or failed (false)
+	pollTime    time.Duration            // total time spent polling calendars
+	lastPoll    time.Time                // when we last polled the calendars successfully
+}
+
+var metrics = daemonMetrics{
+	transitions: make(map[string]uint64),
+	statusTime:  make(map[string]time.Duration),
+	polls:       make(map[bool]uint64),
+}
+
+// calendarPolled records the outcome of a calendar poll which took `elapsed` to complete.
+func (m *daemonMetrics) calendarPolled(elapsed time.Duration, ok bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.polls[ok]++
+	m.pollTime += elapsed
+	if ok {
+		m.lastPoll = time.Now()
+	}
+}
+
+// update records the daemon's current state, noting when the status changes.
+func (m *daemonMetrics) update(devState *busylight.DevState, status busylight.DaemonStatus) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	m.devState = devState
+	m.active, m.inMeeting, m.muted = status.Active, status.InMeeting, status.Muted
+	if status.Status != m.status {
+		if m.status != "" {
+			m.statusTime[m.status] += now.Sub(m.statusSince)
+		}
+		m.status, m.statusSince = status.Status, now
+		m.transitions[status.Status]++
+	}
+}
+
+// write reports the metrics in the Prometheus text exposition format.
+func (m *daemonMetrics) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+
+	// Every status we've shown, including the current one.
+	var statuses []string
+	for s := range m.transitions {
+		statuses = append(statuses, s)
+	}
+	sort.Strings(statuses)
+
+	writeMetricHeader(w, "busylight_status", "gauge", "Whether the light is showing each status (1) or not (0).")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "busylight_status{status=\"%s\"} %d\n", escapeLabel(s), boolMetric(s == m.status))
+	}
+	writeMetricHeader(w, "busylight_active", "gauge", "Whether the daemon is active (1) or sleeping (0).")
+	fmt.Fprintf(w, "busylight_active %d\n", boolMetric(m.active))
+	writeMetricHeader(w, "busylight_meeting", "gauge", "Whether the user is in a meeting (1) or not (0).")
+	fmt.Fprintf(w, "busylight_meeting %d\n", boolMetric(m.inMeeting))
+	writeMetricHeader(w, "busylight_muted", "gauge", "Whether the user is muted in a meeting (1) or not (0).")
+	fmt.Fprintf(w, "busylight_muted %d\n", boolMetric(m.muted))
+
+	writeMetricHeader(w, "busylight_status_transitions_total", "counter", "Times the light has changed to each status.")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "busylight_status_transitions_total{status=\"%s\"} %d\n", escapeLabel(s), m.transitions[s])
+	}
+	writeMetricHeader(w, "busylight_status_seconds_total", "counter", "Time the light has spent showing each status.")
+	for _, s := range statuses {
+		elapsed := m.statusTime[s]
+		if s == m.status {
+			elapsed += now.Sub(m.statusSince)
+		}
+		fmt.Fprintf(w, "busylight_status_seconds_total{status=\"%s\"} %g\n", escapeLabel(s), elapsed.Seconds())
+	}
+
+	writeMetricHeader(w, "busylight_calendar_polls_total", "counter", "Calendar polls, by whether they succeeded.")
+	fmt.Fprintf(w, "busylight_calendar_polls_total{result=\"success\"} %d\n", m.polls[true])
+	fmt.Fprintf(w, "busylight_calendar_polls_total{result=\"failure\"} %d\n", m.polls[false])
+	writeMetricHeader(w, "busylight_calendar_poll_duration_seconds", "summary", "Time taken to poll the calendars.")
+	fmt.Fprintf(w, "busylight_calendar_poll_duration_seconds_sum %g\n", m.pollTime.Seconds())
+	fmt.Fprintf(w, "busylight_calendar_poll_duration_seconds_count %d\n", m.polls[true]+m.polls[false])
+	if !m.lastPoll.IsZero() {
+		writeMetricHeader(w, "busylight_calendar_last_success_timestamp_seconds", "gauge", "When the calendars were last polled successfully.")
+		fmt.Fprintf(w, "busylight_calendar_last_success_timestamp_seconds %d\n", m.lastPoll.Unix())
+	}
+
+	if m.devState != nil {
+		writeMetricHeader(w, "busylight_device_attaches_total", "counter", "Times the light device was opened.")
+		fmt.Fprintf(w, "busylight_device_attaches_total %d\n", m.devState.Attaches.Load())
+		writeMetricHeader(w, "busylight_device_open_errors_total", "counter", "Times the light device could not be opened.")
+		fmt.Fprintf(w, "busylight_device_open_errors_total %d\n", m.devState.OpenErrors.Load())
+		writeMetricHeader(w, "busylight_device_errors_total", "counter", "Commands which could not be sent to the light device.")
+		fmt.Fprintf(w, "busylight_device_errors_total %d\n", m.devState.WriteErrors.Load())
+	}
+}
+
+// writeMetricHeader describes a metric.
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// boolMetric gives the value of a gauge which is either on or off.
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel makes a string safe to use as a label value.
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// metricsHandler serves the metrics to Prometheus (or anyone else who asks).
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.write(w)
+}
+
+// startMetricsServer begins serving metrics on MetricsAddress, if one is configured.
+// Otherwise it returns a nil listener; the metrics are still available on the control socket.
+func startMetricsServer(config *busylight.ConfigData, devState *busylight.DevState) (net.Listener, error) {
+	if config.MetricsAddress == "" {
+		return nil, nil
+	}
+	listener, err := net.Listen("tcp", config.MetricsAddress)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen for metrics requests on %s: %v", config.MetricsAddress, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			devState.Logger.Info("Metrics server closed", "err", err)
+		}
+	}()
+	devState.Logger.Info("Serving metrics", "address", listener.Addr().String())
+	return listener, nil
+}
@@ -0,0 +1,237 @@
+//
+// Microphone watching for busylightd.
+//
+// If WatchMicrophone is set in config.json, we follow PulseAudio's (or
+// PipeWire's) event stream via "pactl subscribe". Whenever something
+// changes with the audio sources or the streams recording from them, we
+// ask pactl which applications are recording and whether the default
+// source is muted. While any application matching MicrophoneApps is using
+// the microphone, we're in a meeting, with the mic muted or open according
+// to the source's mute state.
+//
+// The pactl program may be replaced (see PactlCommand) by anything which
+// responds the same way to these invocations:
+//
+//    pactl subscribe                         - print a line for each event
+//    pactl list source-outputs               - describe each recording stream
+//    pactl get-source-mute @DEFAULT_SOURCE@  - print "Mute: yes" or "Mute: no"
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"internal/busylight"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// sourceOutputProperty matches the properties of a recording stream which identify its application.
+var sourceOutputProperty = regexp.MustCompile(`^\s*application\.(?:name|process\.binary)\s*=\s*"(.*)"\s*$`)
+
+// microphoneWatcher follows the state of the microphone.
+type microphoneWatcher struct {
+	devState *busylight.DevState
+	pactl    string
+	apps     *regexp.Regexp // which applications count, or nil for any
+	events   chan<- detectorEvent
+	quit     <-chan struct{}
+}
+
+// pactlCommand returns the program used to talk to PulseAudio.
+func pactlCommand(config *busylight.ConfigData) string {
+	if config.PactlCommand != "" {
+		return config.PactlCommand
+	}
+	return "pactl"
+}
+
+// checkMicrophone reports any errors in the microphone watching settings in the configuration.
+func checkMicrophone(config *busylight.ConfigData) error {
+	if config.MicrophoneApps != "" {
+		if _, err := regexp.Compile(config.MicrophoneApps); err != nil {
+			return fmt.Errorf("MicrophoneApps: %v", err)
+		}
+	}
+	return nil
+}
+
+// watchMicrophone follows the microphone's state until told to quit, reporting to the event loop
+// via `events` when applications start or stop using it or it is muted or unmuted. If pactl exits,
+// it is started again after a short wait.
+func watchMicrophone(config *busylight.ConfigData, devState *busylight.DevState, events chan<- detectorEvent, quit <-chan struct{}) {
+	w := microphoneWatcher{
+		devState: devState,
+		pactl:    pactlCommand(config),
+		events:   events,
+		quit:     quit,
+	}
+	if config.MicrophoneApps != "" {
+		w.apps = regexp.MustCompile(config.MicrophoneApps)
+	}
+
+	var last *detectorEvent
+	for {
+		if err := w.follow(&last); err != nil {
+			devState.Logger.Error("Unable to watch microphone (will try again)", "err", err)
+			// We can't tell what the microphone is doing any more, so don't
+			// leave its last known state in effect.
+			if last != nil && last.status != "" {
+				last = &detectorEvent{source: "microphone", layer: "meeting"}
+				select {
+				case events <- *last:
+				case <-quit:
+					return
+				}
+			}
+		}
+		select {
+		case <-time.After(30 * time.Second):
+		case <-quit:
+			return
+		}
+	}
+}
+
+// follow runs "pactl subscribe", checking the microphone's state at first and whenever pactl
+// reports a relevant change, until pactl exits or we're told to quit. The last event reported
+// is kept in *last so we only report changes.
+func (w microphoneWatcher) follow(last **detectorEvent) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, w.pactl, "subscribe")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		cancel()
+		cmd.Wait()
+	}()
+
+	// Read events in the background, passing along only that something happened.
+	changed := make(chan struct{}, 1)
+	ended := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.Contains(line, " on source") || strings.Contains(line, " on server") {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			ended <- err
+		} else {
+			ended <- fmt.Errorf("%s subscribe exited", w.pactl)
+		}
+	}()
+
+	for {
+		event, err := w.state()
+		if err != nil {
+			return err
+		}
+		if *last == nil || (*last).status != event.status || (*last).reason != event.reason {
+			select {
+			case w.events <- event:
+			case <-w.quit:
+				return nil
+			}
+			*last = &event
+		}
+
+		select {
+		case <-changed:
+			// Events tend to come in bunches; let them settle before looking.
+			time.Sleep(200 * time.Millisecond)
+			select {
+			case <-changed:
+			default:
+			}
+		case err := <-ended:
+			return err
+		case <-w.quit:
+			return nil
+		}
+	}
+}
+
+// state asks pactl which applications are recording and whether the default source is muted.
+func (w microphoneWatcher) state() (detectorEvent, error) {
+	event := detectorEvent{source: "microphone", layer: "meeting"}
+
+	streams, err := w.run("list", "source-outputs")
+	if err != nil {
+		return event, err
+	}
+	var apps []string
+	for _, stream := range strings.Split(streams, "Source Output #")[1:] {
+		var ids []string
+		for _, line := range strings.Split(stream, "\n") {
+			if m := sourceOutputProperty.FindStringSubmatch(line); m != nil {
+				ids = append(ids, m[1])
+			}
+		}
+		for _, id := range ids {
+			if w.apps == nil || w.apps.MatchString(id) {
+				apps = append(apps, ids[0])
+				break
+			}
+		}
+	}
+	if len(apps) == 0 {
+		return event, nil
+	}
+
+	mute, err := w.run("get-source-mute", "@DEFAULT_SOURCE@")
+	if err != nil {
+		return event, err
+	}
+	if strings.Contains(mute, "yes") {
+		event.status = "muted"
+	} else {
+		event.status = "open"
+	}
+	event.reason = fmt.Sprintf("microphone in use by %s, %s", strings.Join(uniqueStrings(apps), ", "), event.status)
+	return event, nil
+}
+
+// run runs pactl with the given arguments and returns its output.
+func (w microphoneWatcher) run(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, w.pactl, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v", w.pactl, strings.Join(args, " "), err)
+	}
+	return string(output), nil
+}
+
+// uniqueStrings returns the list with any repeated values removed.
+func uniqueStrings(list []string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			result = append(result, s)
+		}
+	}
+	return result
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"internal/busylight"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// fakePactl is a stand-in for pactl, driven by files in its directory: "outputs" is what
+// it lists as the source outputs, "mute" is what it says about the default source, and
+// each line added to "events" is passed along by "subscribe", which exits when a file
+// called "stop" appears.
+const fakePactl = `#!/bin/sh
+dir=$(dirname "$0")
+case "$1" in
+subscribe)
+	n=0
+	while [ ! -e "$dir/stop" ]; do
+		lines=$(wc -l < "$dir/events")
+		if [ "$lines" -gt "$n" ]; then
+			tail -n +$((n + 1)) "$dir/events" | head -n $((lines - n))
+			n=$lines
+		fi
+		sleep 0.05
+	done
+	;;
+list)
+	cat "$dir/outputs"
+	;;
+get-source-mute)
+	cat "$dir/mute"
+	;;
+*)
+	echo "unexpected arguments: $*" >&2
+	exit 1
+	;;
+esac
+`
+
+const zoomSourceOutput = `Source Output #42
+	Driver: protocol-native.c
+	Source: 1
+	Properties:
+		media.name = "capture"
+		application.name = "ZOOM VoiceEngine"
+		application.process.binary = "zoom"
+`
+
+const dictationSourceOutput = `Source Output #43
+	Driver: protocol-native.c
+	Source: 1
+	Properties:
+		application.name = "Dictation"
+		application.process.binary = "nerd-dictation"
+`
+
+// newFakePactl sets up a fakePactl in a temporary directory, returning its pathname.
+func newFakePactl(t *testing.T) string {
+	dir := t.TempDir()
+	pactl := filepath.Join(dir, "pactl")
+	if err := os.WriteFile(pactl, []byte(fakePactl), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"events", "outputs"} {
+		setPactl(t, pactl, name, "")
+	}
+	setPactl(t, pactl, "mute", "Mute: no\n")
+	return pactl
+}
+
+// setPactl sets one of the files which drive a fakePactl.
+func setPactl(t *testing.T, pactl, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(filepath.Dir(pactl), name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pactlEvent has a fakePactl report an event from "subscribe".
+func pactlEvent(t *testing.T, pactl, line string) {
+	t.Helper()
+	f, err := os.OpenFile(filepath.Join(filepath.Dir(pactl), "events"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(line + "\n"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMicrophoneState(t *testing.T) {
+	pactl := newFakePactl(t)
+	config := &busylight.ConfigData{PactlCommand: pactl, MicrophoneApps: "^zoom$"}
+	if err := checkMicrophone(config); err != nil {
+		t.Fatal(err)
+	}
+	w := microphoneWatcher{devState: quietDevState(), pactl: pactlCommand(config), apps: regexp.MustCompile(config.MicrophoneApps)}
+
+	check := func(status, reason string) {
+		t.Helper()
+		event, err := w.state()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.source != "microphone" || event.layer != "meeting" || event.status != status || event.reason != reason {
+			t.Errorf("got %+v, want status %q and reason %q", event, status, reason)
+		}
+	}
+
+	check("", "")
+	setPactl(t, pactl, "outputs", dictationSourceOutput)
+	check("", "")
+	setPactl(t, pactl, "outputs", zoomSourceOutput+"\n"+dictationSourceOutput)
+	check("open", "microphone in use by ZOOM VoiceEngine, open")
+	setPactl(t, pactl, "mute", "Mute: yes\n")
+	check("muted", "microphone in use by ZOOM VoiceEngine, muted")
+
+	// Without MicrophoneApps, any application counts.
+	w.apps = nil
+	check("muted", "microphone in use by ZOOM VoiceEngine, Dictation, muted")
+
+	if err := checkMicrophone(&busylight.ConfigData{MicrophoneApps: "("}); err == nil {
+		t.Error("invalid MicrophoneApps accepted")
+	}
+}
+
+func TestWatchMicrophone(t *testing.T) {
+	pactl := newFakePactl(t)
+	config := &busylight.ConfigData{PactlCommand: pactl, MicrophoneApps: "^zoom$"}
+	events := make(chan detectorEvent)
+	quit := make(chan struct{})
+	defer close(quit)
+	go watchMicrophone(config, quietDevState(), events, quit)
+
+	expect := func(status string) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event.source != "microphone" || event.status != status {
+				t.Fatalf("got %+v, want status %q", event, status)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event reporting status %q", status)
+		}
+	}
+
+	expect("")
+	setPactl(t, pactl, "outputs", zoomSourceOutput)
+	pactlEvent(t, pactl, "Event 'new' on source-output #42")
+	expect("open")
+
+	// Changes to the speakers don't matter...
+	setPactl(t, pactl, "mute", "Mute: yes\n")
+	pactlEvent(t, pactl, "Event 'change' on sink #0")
+	select {
+	case event := <-events:
+		t.Fatalf("got %+v from a sink event", event)
+	case <-time.After(500 * time.Millisecond):
+	}
+	// ...but those to the microphone do.
+	pactlEvent(t, pactl, "Event 'change' on source #1")
+	expect("muted")
+
+	// If pactl goes away, we can no longer say what the microphone is doing.
+	setPactl(t, pactl, "stop", "")
+	expect("")
+}
@@ -0,0 +1,387 @@
+//
+// MQTT integration for busylightd.
+//
+// If an MQTT broker is configured, the daemon publishes its state there as
+// retained messages, so home automation systems and the like can follow
+// along, and accepts commands there as an alternative to signals. All topics
+// start with the configured TopicPrefix (by default, busylight/<user>):
+//
+//    <prefix>/availability  - "online" or "offline" (set by the broker if we drop off)
+//    <prefix>/status        - status displayed now (busylight.StatusEvent)
+//    <prefix>/meeting       - "muted", "open", or "none"
+//    <prefix>/calendar      - "busy" or "free"
+//    <prefix>/override      - status set via cmd/status or cmd/override, or "none"
+//    <prefix>/lights        - what the lights are showing (busylight.LightPattern)
+//
+//    <prefix>/cmd/mute      - in meeting, muted (like -mute)
+//    <prefix>/cmd/open      - in meeting, unmuted (like -open)
+//    <prefix>/cmd/cal       - out of meeting (like -cal)
+//    <prefix>/cmd/status    - payload is a status name to show until cancelled,
+//                             or empty to cancel
+//    <prefix>/cmd/override  - payload is "<status> [<duration or RFC 3339 time>]",
+//                             or a busylight.Override as JSON, or empty to cancel
+//
+// The client reconnects automatically if the connection to the broker is
+// lost, re-publishing our current state when it does.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"internal/busylight"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttBridge connects the daemon to the MQTT broker.
+type mqttBridge struct {
+	devState *busylight.DevState
+	client   mqtt.Client
+	prefix   string
+	requests chan<- controlRequest
+	user     string
+	last     busylight.StatusEvent // what we last published on the status topic
+
+	lock     sync.Mutex
+	retained map[string][]byte   // latest payload for each (full) topic we publish
+	dirty    map[string]struct{} // topics waiting to be (re-)published
+	wake     chan struct{}       // signalled when something becomes dirty
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// newMQTTBridge starts connecting to the configured MQTT broker, or returns nil if none is configured.
+// Commands received from the broker are passed to the event loop via the `requests` channel.
+func newMQTTBridge(config *busylight.ConfigData, devState *busylight.DevState, requests chan<- controlRequest) (*mqttBridge, error) {
+	if config.MQTT.Broker == "" {
+		return nil, nil
+	}
+
+	b := &mqttBridge{
+		devState: devState,
+		prefix:   strings.TrimSuffix(config.MQTT.TopicPrefix, "/"),
+		requests: requests,
+		user:     userName(config),
+		retained: make(map[string][]byte),
+		dirty:    make(map[string]struct{}),
+		wake:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if b.prefix == "" {
+		b.prefix = "busylight/" + b.user
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(config.MQTT.Broker)
+	if config.MQTT.ClientID != "" {
+		opts.SetClientID(config.MQTT.ClientID)
+	} else {
+		opts.SetClientID("busylightd-" + b.user)
+	}
+	opts.SetUsername(config.MQTT.Username)
+	opts.SetPassword(config.MQTT.Password)
+	if config.MQTT.CAFile != "" || config.MQTT.CertFile != "" || config.MQTT.InsecureSkipVerify {
+		tlsConfig, err := mqttTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	opts.SetWill(b.prefix+"/availability", "offline", 1, true)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(10 * time.Second)
+	opts.SetMaxReconnectInterval(2 * time.Minute)
+	opts.SetOrderMatters(false)
+	opts.SetOnConnectHandler(b.connected)
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		devState.Logger.Warn("Lost connection to MQTT broker (will reconnect)", "err", err)
+	})
+
+	b.client = mqtt.NewClient(opts)
+	b.Publish("availability", []byte("online"))
+	if config.MQTT.HomeAssistant {
+		b.advertise(config)
+	}
+	go b.publisher()
+	// With ConnectRetry set, this keeps trying in the background until it succeeds.
+	b.client.Connect()
+	devState.Logger.Info("Connecting to MQTT broker", "broker", config.MQTT.Broker, "prefix", b.prefix)
+	return b, nil
+}
+
+// mqttTLSConfig builds the TLS settings for connecting to the broker.
+func mqttTLSConfig(config *busylight.ConfigData) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.MQTT.InsecureSkipVerify}
+	if config.MQTT.CAFile != "" {
+		pem, err := os.ReadFile(config.MQTT.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read MQTT CA file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in MQTT CA file %s", config.MQTT.CAFile)
+		}
+	}
+	if config.MQTT.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.MQTT.CertFile, config.MQTT.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load MQTT client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// connected is called each time we (re-)connect to the broker. We need to subscribe
+// to our command topics again and make sure the broker has our current state.
+func (b *mqttBridge) connected(client mqtt.Client) {
+	b.devState.Logger.Info("Connected to MQTT broker")
+	if token := client.Subscribe(b.prefix+"/cmd/+", 1, b.command); token.WaitTimeout(10*time.Second) && token.Error() != nil {
+		b.devState.Logger.Error("Unable to subscribe to MQTT command topics", "err", token.Error())
+	}
+
+	b.lock.Lock()
+	for topic := range b.retained {
+		b.dirty[topic] = struct{}{}
+	}
+	b.lock.Unlock()
+	b.signal()
+}
+
+// Publish arranges for the payload to be published (retained) on the topic under our prefix,
+// unless it's what we already published there. This never blocks waiting on the broker.
+func (b *mqttBridge) Publish(topic string, payload []byte) {
+	if b == nil {
+		return
+	}
+	b.publishTopic(b.prefix+"/"+topic, payload)
+}
+
+// publishTopic is like Publish but takes the full topic name.
+func (b *mqttBridge) publishTopic(topic string, payload []byte) {
+	b.lock.Lock()
+	if old, ok := b.retained[topic]; ok && string(old) == string(payload) {
+		b.lock.Unlock()
+		return
+	}
+	b.retained[topic] = payload
+	b.dirty[topic] = struct{}{}
+	b.lock.Unlock()
+	b.signal()
+}
+
+// signal wakes up the publisher.
+func (b *mqttBridge) signal() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// publisher sends dirty topics to the broker whenever we're connected. When told to quit,
+// it sends anything still waiting first.
+func (b *mqttBridge) publisher() {
+	defer close(b.done)
+	for stopping := false; !stopping; {
+		select {
+		case <-b.wake:
+		case <-b.quit:
+			stopping = true
+		}
+		if !b.client.IsConnectionOpen() {
+			// connected() will wake us again when we can send.
+			continue
+		}
+
+		b.lock.Lock()
+		var topics []string
+		for topic := range b.dirty {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+		payloads := make([][]byte, len(topics))
+		for i, topic := range topics {
+			payloads[i] = b.retained[topic]
+			delete(b.dirty, topic)
+		}
+		b.lock.Unlock()
+
+		failed := false
+		for i, topic := range topics {
+			token := b.client.Publish(topic, 1, true, payloads[i])
+			if !token.WaitTimeout(10*time.Second) || token.Error() != nil {
+				b.devState.Logger.Warn("Unable to publish MQTT topic (will retry)", "topic", topic, "err", token.Error())
+				b.lock.Lock()
+				b.dirty[topic] = struct{}{}
+				b.lock.Unlock()
+				failed = true
+			}
+		}
+		if failed && !stopping {
+			time.AfterFunc(10*time.Second, b.signal)
+		}
+	}
+}
+
+// Update publishes the daemon's current state. What the lights are showing is taken from
+// the status rather than asked of the device, so that publishing never waits on the device.
+func (b *mqttBridge) Update(status busylight.DaemonStatus) {
+	if b == nil {
+		return
+	}
+
+	event := busylight.StatusEvent{
+		User:     b.user,
+		Status:   status.Status,
+		Reason:   status.Reason,
+		Layer:    status.Layer,
+		Rule:     status.Rule,
+		Previous: b.last.Previous,
+		Time:     b.last.Time,
+	}
+	if !status.NextTransition.IsZero() {
+		event.NextTransition = &status.NextTransition
+	}
+	if event.Status != b.last.Status {
+		event.Previous = b.last.Status
+	}
+	// Only publish (with a new timestamp) if something other than the time changed.
+	if !reflect.DeepEqual(event, b.last) {
+		event.Time = time.Now()
+		b.last = event
+		if data, err := json.Marshal(event); err == nil {
+			b.Publish("status", data)
+		}
+	}
+
+	switch {
+	case !status.InMeeting:
+		b.Publish("meeting", []byte("none"))
+	case status.Muted:
+		b.Publish("meeting", []byte("muted"))
+	default:
+		b.Publish("meeting", []byte("open"))
+	}
+
+	if status.CalendarBusy {
+		b.Publish("calendar", []byte("busy"))
+	} else {
+		b.Publish("calendar", []byte("free"))
+	}
+
+	if status.Override != nil {
+		b.Publish("override", []byte(status.Override.Status))
+	} else {
+		b.Publish("override", []byte("none"))
+	}
+
+	if data, err := json.Marshal(status.Lights); err == nil {
+		b.Publish("lights", data)
+	}
+}
+
+// Close announces that we're going offline and disconnects from the broker.
+func (b *mqttBridge) Close() {
+	if b == nil {
+		return
+	}
+	close(b.quit)
+	<-b.done
+	if b.client.IsConnectionOpen() {
+		b.client.Publish(b.prefix+"/availability", 1, true, "offline").WaitTimeout(5 * time.Second)
+	}
+	b.client.Disconnect(500)
+}
+
+// command handles a message received on one of our command topics.
+func (b *mqttBridge) command(_ mqtt.Client, msg mqtt.Message) {
+	name := strings.TrimPrefix(msg.Topic(), b.prefix+"/cmd/")
+	payload := strings.TrimSpace(string(msg.Payload()))
+	var req controlRequest
+
+	switch name {
+	case "mute":
+		req = controlRequest{op: "meeting", override: busylight.Override{Status: "muted"}}
+	case "open":
+		req = controlRequest{op: "meeting", override: busylight.Override{Status: "open"}}
+	case "cal":
+		req = controlRequest{op: "meeting"}
+	case "status":
+		if payload == "" {
+			req = controlRequest{op: "clear", layer: "override"}
+		} else {
+			req = controlRequest{op: "set", layer: "override", override: busylight.Override{Status: payload}}
+		}
+	case "override":
+		o, err := parseOverride(payload)
+		if err != nil {
+			b.devState.Logger.Error("Invalid MQTT override command", "err", err)
+			return
+		}
+		if o.Status == "" {
+			req = controlRequest{op: "clear", layer: "override"}
+		} else {
+			req = controlRequest{op: "set", layer: "override", override: o}
+		}
+	default:
+		b.devState.Logger.Warn("Unknown MQTT command (ignored)", "command", name)
+		return
+	}
+
+	b.devState.Logger.Info("MQTT command", "command", name, "payload", payload)
+	reply, err := submitRequest(context.Background(), b.requests, req)
+	if err == nil {
+		err = reply.err
+	}
+	if err != nil {
+		b.devState.Logger.Error("MQTT command failed", "command", name, "err", err)
+	}
+}
+
+// parseOverride interprets the payload of an override command. It may be a busylight.Override
+// as JSON, or a status name optionally followed by a duration or RFC 3339 time at which it ends.
+// An empty payload (or "cancel") yields an Override with no Status.
+func parseOverride(payload string) (busylight.Override, error) {
+	var o busylight.Override
+
+	if strings.HasPrefix(payload, "{") {
+		err := json.Unmarshal([]byte(payload), &o)
+		return o, err
+	}
+
+	fields := strings.Fields(payload)
+	switch {
+	case len(fields) == 0 || (len(fields) == 1 && fields[0] == "cancel"):
+		return o, nil
+	case len(fields) > 2:
+		return o, fmt.Errorf("expected \"<status> [<duration or time>]\", got \"%s\"", payload)
+	}
+
+	o.Status = fields[0]
+	if len(fields) == 2 {
+		if d, err := time.ParseDuration(fields[1]); err == nil {
+			o.Until = time.Now().Add(d)
+		} else if t, err := time.Parse(time.RFC3339, fields[1]); err == nil {
+			o.Until = t
+		} else {
+			return o, fmt.Errorf("\"%s\" is neither a duration nor an RFC 3339 time", fields[1])
+		}
+	}
+	return o, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"internal/busylight"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// testBroker is an MQTT broker running inside the test, which remembers the last
+// message published on each topic.
+type testBroker struct {
+	*mochi.Server
+	address string
+	mu      sync.Mutex
+	last    map[string]string
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	b := &testBroker{
+		Server: mochi.New(&mochi.Options{InlineClient: true, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}),
+		last:   make(map[string]string),
+	}
+	if err := b.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	if err := b.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	b.address = "tcp://" + tcp.Address()
+
+	err := b.Subscribe("#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		b.mu.Lock()
+		b.last[pk.TopicName] = string(pk.Payload)
+		b.mu.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// waitFor waits until the last message on the topic is the one wanted.
+func (b *testBroker) waitFor(t *testing.T, topic, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.Lock()
+		got, ok := b.last[topic]
+		b.mu.Unlock()
+		if ok && got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is %q, want %q", topic, got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (b *testBroker) message(topic string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.last[topic]
+}
+
+func newTestBridge(t *testing.T, broker *testBroker, requests chan<- controlRequest) *mqttBridge {
+	config := &busylight.ConfigData{UserName: "tester"}
+	config.MQTT.Broker = broker.address
+	config.MQTT.TopicPrefix = "test/me/"
+	bridge, err := newMQTTBridge(config, quietDevState(), requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.waitFor(t, "test/me/availability", "online")
+	return bridge
+}
+
+func TestMQTTPublishesState(t *testing.T) {
+	broker := newTestBroker(t)
+	bridge := newTestBridge(t, broker, make(chan controlRequest))
+
+	bridge.Update(busylight.DaemonStatus{
+		Status:       "muted",
+		Layer:        "meeting",
+		Reason:       "in a meeting with mic muted",
+		InMeeting:    true,
+		Muted:        true,
+		CalendarBusy: true,
+		Lights:       busylight.LightPattern{Steady: '3', Strobe: []byte("4")},
+	})
+	broker.waitFor(t, "test/me/meeting", "muted")
+	broker.waitFor(t, "test/me/calendar", "busy")
+	broker.waitFor(t, "test/me/override", "none")
+	broker.waitFor(t, "test/me/lights", `{"Steady":"3","Strobe":"4"}`)
+
+	var event busylight.StatusEvent
+	if err := json.Unmarshal([]byte(broker.message("test/me/status")), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.User != "tester" || event.Status != "muted" || event.Layer != "meeting" || event.Previous != "" {
+		t.Errorf("status event %+v is wrong", event)
+	}
+
+	bridge.Update(busylight.DaemonStatus{
+		Status:   "busy",
+		Layer:    "override",
+		Override: &busylight.Override{Status: "busy"},
+		Lights:   busylight.LightPattern{Steady: '3'},
+	})
+	broker.waitFor(t, "test/me/meeting", "none")
+	broker.waitFor(t, "test/me/calendar", "free")
+	broker.waitFor(t, "test/me/override", "busy")
+	broker.waitFor(t, "test/me/lights", `{"Steady":"3"}`)
+	if err := json.Unmarshal([]byte(broker.message("test/me/status")), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Status != "busy" || event.Previous != "muted" {
+		t.Errorf("status event %+v is wrong", event)
+	}
+
+	bridge.Close()
+	broker.waitFor(t, "test/me/availability", "offline")
+}
+
+func TestMQTTCommands(t *testing.T) {
+	broker := newTestBroker(t)
+	requests := make(chan controlRequest)
+	bridge := newTestBridge(t, broker, requests)
+	defer bridge.Close()
+
+	for _, test := range []struct {
+		topic, payload string
+		op, layer      string
+		status         string
+		until          bool
+	}{
+		{"cmd/mute", "", "meeting", "", "muted", false},
+		{"cmd/open", "", "meeting", "", "open", false},
+		{"cmd/cal", "", "meeting", "", "", false},
+		{"cmd/status", "busy", "set", "override", "busy", false},
+		{"cmd/status", "", "clear", "override", "", false},
+		{"cmd/override", "away 30m", "set", "override", "away", true},
+		{"cmd/override", `{"Status":"free"}`, "set", "override", "free", false},
+		{"cmd/override", "cancel", "clear", "override", "", false},
+	} {
+		if err := broker.Publish("test/me/"+test.topic, []byte(test.payload), false, 1); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case req := <-requests:
+			if req.op != test.op || req.layer != test.layer || req.override.Status != test.status || req.override.Until.IsZero() == test.until {
+				t.Errorf("%s %q: got request %+v", test.topic, test.payload, req)
+			}
+			req.reply <- controlReply{}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s %q: no request received", test.topic, test.payload)
+		}
+	}
+}
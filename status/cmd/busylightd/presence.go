@@ -0,0 +1,283 @@
+//
+// Presence watching for busylightd.
+//
+// If WatchPresence is set in config.json, we ask systemd-logind over D-Bus
+// about the user's session. While the session is locked, or once it has
+// been idle (as the desktop environment reports it to logind) for AwayAfter,
+// the presence layer offers the "away" status, so nobody comes looking for
+// us because the lights say we're free.
+//
+// We also listen for logind's PrepareForSleep signal, so the daemon goes
+// into its inactive (zzz) state when the computer is about to suspend, and
+// wakes up again when it resumes. We hold a "delay" inhibitor lock so the
+// lights get turned off before the computer actually goes to sleep.
+//
+// Anything which provides the same D-Bus interfaces may stand in for logind
+// (see PresenceBus), so this can be tried out on a private bus.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"fmt"
+	"internal/busylight"
+	"os"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	defaultAwayAfter = 5 * time.Minute // how long to be idle before we're away, if not configured
+	logindName       = "org.freedesktop.login1"
+	logindPath       = dbus.ObjectPath("/org/freedesktop/login1")
+	logindManager    = "org.freedesktop.login1.Manager"
+	logindSession    = "org.freedesktop.login1.Session"
+)
+
+// suspendEvent tells the event loop that the computer is about to suspend (or has resumed).
+// The event loop closes done once it has dealt with it.
+type suspendEvent struct {
+	sleeping bool
+	done     chan struct{}
+}
+
+// presenceWatcher follows the state of the user's login session.
+type presenceWatcher struct {
+	devState  *busylight.DevState
+	bus       string
+	awayAfter time.Duration
+	events    chan<- detectorEvent
+	suspend   chan<- suspendEvent
+	quit      <-chan struct{}
+	inhibitor *os.File // our delay lock on sleeping, or nil if we don't hold one
+}
+
+// awayAfter returns how long the session must be idle before the user is away.
+func awayAfter(config *busylight.ConfigData) (time.Duration, error) {
+	if config.AwayAfter == "" {
+		return defaultAwayAfter, nil
+	}
+	d, err := time.ParseDuration(config.AwayAfter)
+	if err != nil {
+		return 0, fmt.Errorf("invalid AwayAfter: %v", err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("AwayAfter %v may not be negative", d)
+	}
+	return d, nil
+}
+
+// connectPresenceBus opens a private connection to the bus where we find logind.
+func connectPresenceBus(bus string) (*dbus.Conn, error) {
+	switch bus {
+	case "", "system":
+		return dbus.ConnectSystemBus()
+	case "session":
+		return dbus.ConnectSessionBus()
+	default:
+		return dbus.Connect(bus)
+	}
+}
+
+// watchPresence follows the user's session until told to quit, reporting to the event loop via
+// `events` when the user goes away or comes back, and via `suspend` when the computer is about
+// to suspend or has resumed. If we lose touch with logind, we try again after a short wait.
+func watchPresence(config *busylight.ConfigData, devState *busylight.DevState, events chan<- detectorEvent, suspend chan<- suspendEvent, quit <-chan struct{}) {
+	w := presenceWatcher{
+		devState: devState,
+		bus:      config.PresenceBus,
+		events:   events,
+		suspend:  suspend,
+		quit:     quit,
+	}
+	w.awayAfter, _ = awayAfter(config)
+
+	var last *detectorEvent
+	for {
+		if err := w.follow(&last); err != nil {
+			devState.Logger.Error("Unable to watch presence (will try again)", "err", err)
+			// We can't tell whether the user is here any more, so don't
+			// leave its last known state in effect.
+			if last != nil && last.status != "" {
+				last = &detectorEvent{source: "presence", layer: "presence"}
+				select {
+				case events <- *last:
+				case <-quit:
+					return
+				}
+			}
+		}
+		select {
+		case <-time.After(30 * time.Second):
+		case <-quit:
+			return
+		}
+	}
+}
+
+// follow connects to logind and reports the session's state at first and whenever it changes,
+// until the connection is lost or we're told to quit. The last event reported is kept in *last
+// so we only report changes.
+func (w *presenceWatcher) follow(last **detectorEvent) error {
+	conn, err := connectPresenceBus(w.bus)
+	if err != nil {
+		return fmt.Errorf("Unable to connect to D-Bus: %v", err)
+	}
+	defer conn.Close()
+	defer w.release()
+
+	manager := conn.Object(logindName, logindPath)
+	sessionID := os.Getenv("XDG_SESSION_ID")
+	if sessionID == "" {
+		sessionID = "auto"
+	}
+	var sessionPath dbus.ObjectPath
+	if err := manager.Call(logindManager+".GetSession", 0, sessionID).Store(&sessionPath); err != nil {
+		return fmt.Errorf("Unable to find login session %s: %v", sessionID, err)
+	}
+	session := conn.Object(logindName, sessionPath)
+
+	if err := conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(sessionPath),
+		dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
+		dbus.WithMatchMember("PropertiesChanged"),
+	); err != nil {
+		return err
+	}
+	if err := conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(logindPath),
+		dbus.WithMatchInterface(logindManager),
+		dbus.WithMatchMember("PrepareForSleep"),
+	); err != nil {
+		return err
+	}
+	signals := make(chan *dbus.Signal, 10)
+	conn.Signal(signals)
+	w.inhibit(manager)
+
+	// This goes off when the session will have been idle long enough for us to be away.
+	idleTimer := time.NewTimer(time.Hour)
+	idleTimer.Stop()
+	defer idleTimer.Stop()
+
+	for {
+		event, wait, err := w.state(session)
+		if err != nil {
+			return err
+		}
+		if *last == nil || **last != event {
+			select {
+			case w.events <- event:
+			case <-w.quit:
+				return nil
+			}
+			*last = &event
+		}
+		if wait > 0 {
+			idleTimer.Reset(wait)
+		}
+
+		select {
+		case signal, ok := <-signals:
+			if !ok {
+				return fmt.Errorf("lost connection to D-Bus")
+			}
+			if signal.Name == logindManager+".PrepareForSleep" && len(signal.Body) > 0 {
+				if sleeping, ok := signal.Body[0].(bool); ok {
+					if !w.prepareForSleep(sleeping, manager) {
+						return nil
+					}
+				}
+			}
+		case <-idleTimer.C:
+		case <-w.quit:
+			return nil
+		}
+		if !idleTimer.Stop() {
+			select {
+			case <-idleTimer.C:
+			default:
+			}
+		}
+	}
+}
+
+// state asks logind whether the session is locked or idle. If the session is idle but the user isn't
+// away yet, it also returns how much longer it will be until they are.
+func (w *presenceWatcher) state(session dbus.BusObject) (detectorEvent, time.Duration, error) {
+	event := detectorEvent{source: "presence", layer: "presence"}
+
+	var props map[string]dbus.Variant
+	if err := session.Call("org.freedesktop.DBus.Properties.GetAll", 0, logindSession).Store(&props); err != nil {
+		return event, 0, fmt.Errorf("Unable to get login session properties: %v", err)
+	}
+	locked, _ := props["LockedHint"].Value().(bool)
+	idle, _ := props["IdleHint"].Value().(bool)
+	since, _ := props["IdleSinceHint"].Value().(uint64) // µs since the epoch
+
+	switch {
+	case locked:
+		event.status = "away"
+		event.reason = "session locked"
+	case idle:
+		idleSince := time.Now()
+		if since > 0 {
+			idleSince = time.UnixMicro(int64(since))
+		}
+		if wait := time.Until(idleSince.Add(w.awayAfter)); wait > 0 {
+			return event, wait, nil
+		}
+		event.status = "away"
+		event.reason = fmt.Sprintf("idle since %s", idleSince.Local().Format("15:04"))
+	}
+	return event, 0, nil
+}
+
+// prepareForSleep tells the event loop that the computer is about to suspend or has resumed,
+// waiting until it's done with that before letting the computer go to sleep. Returns false if
+// we were told to quit in the meantime.
+func (w *presenceWatcher) prepareForSleep(sleeping bool, manager dbus.BusObject) bool {
+	event := suspendEvent{sleeping: sleeping, done: make(chan struct{})}
+	select {
+	case w.suspend <- event:
+	case <-w.quit:
+		return false
+	}
+	select {
+	case <-event.done:
+	case <-w.quit:
+		return false
+	}
+	if sleeping {
+		w.release()
+	} else {
+		w.inhibit(manager)
+	}
+	return true
+}
+
+// inhibit takes a delay lock from logind, so the computer waits for us to turn off the
+// lights before it suspends. If we can't get one, we carry on without it.
+func (w *presenceWatcher) inhibit(manager dbus.BusObject) {
+	if w.inhibitor != nil {
+		return
+	}
+	var fd dbus.UnixFD
+	if err := manager.Call(logindManager+".Inhibit", 0, "sleep", "busylightd", "Turning off the busylight", "delay").Store(&fd); err != nil {
+		w.devState.Logger.Warn("Unable to delay suspend until the lights are off", "err", err)
+		return
+	}
+	w.inhibitor = os.NewFile(uintptr(fd), "inhibitor")
+}
+
+// release gives up our delay lock, if we have one, letting the computer suspend.
+func (w *presenceWatcher) release() {
+	if w.inhibitor != nil {
+		w.inhibitor.Close()
+		w.inhibitor = nil
+	}
+}
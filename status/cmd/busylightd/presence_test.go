@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"internal/busylight"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// privateBusConfig sets up a bus anyone may use for anything, listening at %s.
+const privateBusConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:path=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// startPrivateBus runs a dbus-daemon of our own, returning its address and the process
+// (so the test can kill it). The test is skipped if there's no dbus-daemon to run.
+func startPrivateBus(t *testing.T) (string, *exec.Cmd) {
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon is not available")
+	}
+	dir := t.TempDir()
+	config := filepath.Join(dir, "bus.conf")
+	socket := filepath.Join(dir, "bus")
+	if err := os.WriteFile(config, []byte(strings.Replace(privateBusConfig, "%s", socket, 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(daemon, "--config-file="+config, "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("dbus-daemon didn't say where it's listening: %v", err)
+	}
+	return strings.TrimSpace(address), cmd
+}
+
+// fakeLogind answers on the bus the way logind does, for a single session.
+type fakeLogind struct {
+	conn     *dbus.Conn
+	mu       sync.Mutex
+	props    map[string]dbus.Variant
+	inhibits int
+	pipes    []*os.File
+}
+
+const fakeSessionPath = dbus.ObjectPath("/org/freedesktop/login1/session/auto")
+
+func newFakeLogind(t *testing.T, address string) *fakeLogind {
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &fakeLogind{conn: conn}
+	l.set(false, false, time.Time{})
+	t.Cleanup(func() {
+		conn.Close()
+		for _, f := range l.pipes {
+			f.Close()
+		}
+	})
+
+	if err := conn.Export(fakeLogindManager{l}, logindPath, logindManager); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Export(fakeLogindSession{l}, fakeSessionPath, "org.freedesktop.DBus.Properties"); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := conn.RequestName(logindName, dbus.NameFlagDoNotQueue); err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("unable to take the name %s: %v", logindName, err)
+	}
+	return l
+}
+
+// set changes the session's state and announces it.
+func (l *fakeLogind) set(locked, idle bool, idleSince time.Time) {
+	var since uint64
+	if !idleSince.IsZero() {
+		since = uint64(idleSince.UnixMicro())
+	}
+	l.mu.Lock()
+	l.props = map[string]dbus.Variant{
+		"LockedHint":    dbus.MakeVariant(locked),
+		"IdleHint":      dbus.MakeVariant(idle),
+		"IdleSinceHint": dbus.MakeVariant(since),
+	}
+	changed := l.props
+	l.mu.Unlock()
+	l.conn.Emit(fakeSessionPath, "org.freedesktop.DBus.Properties.PropertiesChanged", logindSession, changed, []string{})
+}
+
+func (l *fakeLogind) inhibitCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inhibits
+}
+
+type fakeLogindManager struct{ l *fakeLogind }
+
+func (m fakeLogindManager) GetSession(id string) (dbus.ObjectPath, *dbus.Error) {
+	if id != "auto" {
+		return "", dbus.MakeFailedError(os.ErrNotExist)
+	}
+	return fakeSessionPath, nil
+}
+
+func (m fakeLogindManager) Inhibit(what, who, why, mode string) (dbus.UnixFD, *dbus.Error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, dbus.MakeFailedError(err)
+	}
+	m.l.mu.Lock()
+	defer m.l.mu.Unlock()
+	m.l.inhibits++
+	m.l.pipes = append(m.l.pipes, r, w)
+	return dbus.UnixFD(r.Fd()), nil
+}
+
+type fakeLogindSession struct{ l *fakeLogind }
+
+func (s fakeLogindSession) GetAll(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	s.l.mu.Lock()
+	defer s.l.mu.Unlock()
+	return s.l.props, nil
+}
+
+func TestWatchPresence(t *testing.T) {
+	address, bus := startPrivateBus(t)
+	logind := newFakeLogind(t, address)
+	t.Setenv("XDG_SESSION_ID", "")
+
+	config := &busylight.ConfigData{PresenceBus: address, AwayAfter: "300ms"}
+	events := make(chan detectorEvent)
+	suspend := make(chan suspendEvent)
+	quit := make(chan struct{})
+	defer close(quit)
+	go watchPresence(config, quietDevState(), events, suspend, quit)
+
+	expect := func(status, reason string) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event.source != "presence" || event.layer != "presence" || event.status != status || !strings.HasPrefix(event.reason, reason) {
+				t.Fatalf("got %+v, want status %q and reason %q", event, status, reason)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event reporting status %q", status)
+		}
+	}
+	expectSuspend := func(sleeping bool) {
+		t.Helper()
+		select {
+		case event := <-suspend:
+			if event.sleeping != sleeping {
+				t.Fatalf("got suspend event %+v, want sleeping %v", event, sleeping)
+			}
+			close(event.done)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no suspend event with sleeping %v", sleeping)
+		}
+	}
+
+	expect("", "")
+	logind.set(true, false, time.Time{})
+	expect("away", "session locked")
+	logind.set(false, false, time.Time{})
+	expect("", "")
+
+	// Being idle only counts once it has gone on for AwayAfter.
+	start := time.Now()
+	logind.set(false, true, start)
+	expect("away", "idle since")
+	if waited := time.Since(start); waited < 250*time.Millisecond {
+		t.Errorf("away after being idle for only %v", waited)
+	}
+	logind.set(false, false, time.Time{})
+	expect("", "")
+
+	// We hold an inhibitor lock except while the computer sleeps.
+	if n := logind.inhibitCount(); n != 1 {
+		t.Errorf("%d inhibitor locks taken, want 1", n)
+	}
+	logind.conn.Emit(logindPath, logindManager+".PrepareForSleep", true)
+	expectSuspend(true)
+	logind.conn.Emit(logindPath, logindManager+".PrepareForSleep", false)
+	expectSuspend(false)
+	for deadline := time.Now().Add(5 * time.Second); logind.inhibitCount() != 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d inhibitor locks taken after resuming, want 2", logind.inhibitCount())
+		}
+	}
+
+	// If we lose touch with logind, we can no longer say whether the user is away.
+	logind.set(true, false, time.Time{})
+	expect("away", "session locked")
+	bus.Process.Kill()
+	expect("", "")
+}
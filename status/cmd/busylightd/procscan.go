@@ -0,0 +1,120 @@
+//
+// Process table scanning for busylightd.
+//
+// Some of the daemon's detectors need to know what is running on the
+// user's computer. We get that from the Linux /proc filesystem, which may
+// be found somewhere else (see ProcRoot in config.json) so a fake one can
+// be used to try out detection patterns.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"fmt"
+	"internal/busylight"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// process is what we know about a running process.
+type process struct {
+	PID         int
+	PPID        int    // parent's PID
+	Name        string // short name of the program (from comm)
+	CommandLine string // arguments separated by spaces (from cmdline)
+}
+
+// procRoot returns the directory where the /proc filesystem is found.
+func procRoot(config *busylight.ConfigData) string {
+	if config.ProcRoot != "" {
+		return config.ProcRoot
+	}
+	return "/proc"
+}
+
+// scanProcesses reads the table of running processes from the /proc filesystem at root.
+// Processes which exit while we're looking are quietly skipped.
+func scanProcesses(root string) (map[int]process, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to scan processes: %v", err)
+	}
+
+	procs := make(map[int]process)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		p, err := readProcess(filepath.Join(root, entry.Name()), pid)
+		if err != nil {
+			continue
+		}
+		procs[pid] = p
+	}
+	return procs, nil
+}
+
+// readProcess reads what we need to know about a process from its directory under /proc.
+func readProcess(dir string, pid int) (process, error) {
+	p := process{PID: pid}
+
+	comm, err := os.ReadFile(filepath.Join(dir, "comm"))
+	if err != nil {
+		return p, err
+	}
+	p.Name = strings.TrimSpace(string(comm))
+
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		p.CommandLine = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	}
+
+	// The stat file is "<pid> (<comm>) <state> <ppid> ...", where comm may itself
+	// contain spaces or parentheses, so look for the fields after the last ')'.
+	if stat, err := os.ReadFile(filepath.Join(dir, "stat")); err == nil {
+		if end := strings.LastIndexByte(string(stat), ')'); end >= 0 {
+			if fields := strings.Fields(string(stat[end+1:])); len(fields) >= 2 {
+				p.PPID, _ = strconv.Atoi(fields[1])
+			}
+		}
+	}
+	return p, nil
+}
+
+// openFiles returns the names of the files a process has open. Any we aren't
+// allowed to see (such as those of other users' processes) are left out.
+func openFiles(root string, pid int) []string {
+	dir := filepath.Join(root, strconv.Itoa(pid), "fd")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		if target, err := os.Readlink(filepath.Join(dir, entry.Name())); err == nil {
+			names = append(names, target)
+		}
+	}
+	return names
+}
+
+// descendsFrom reports whether the process is a descendant of any process for which match is true.
+func descendsFrom(procs map[int]process, p process, match func(process) bool) bool {
+	// Guard against loops in case the table changed while we read it.
+	for seen := 0; p.PPID > 0 && seen < len(procs); seen++ {
+		parent, ok := procs[p.PPID]
+		if !ok {
+			return false
+		}
+		if match(parent) {
+			return true
+		}
+		p = parent
+	}
+	return false
+}
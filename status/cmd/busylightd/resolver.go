@@ -0,0 +1,188 @@
+//
+// Status resolution for busylightd.
+//
+// Each source of information the daemon has about the user (calendar,
+// meeting state, manual overrides, etc.) is a "layer" which may offer
+// a candidate status. The highest-priority candidate currently offered
+// is the one displayed on the lights. Overlay layers don't compete in this
+// way; instead their status is displayed on top of the winner's (e.g., adding
+// a strober to a steady light). Layer priorities may be adjusted (or layers
+// disabled entirely) in the Layers section of config.json.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"internal/busylight"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultLayerPriorities gives the priority of each layer the daemon knows about
+// if config.json doesn't say otherwise.
+var defaultLayerPriorities = map[string]int{
+	"override": 100, // set manually via busylight -status ... -for/-until
+	"flag":     90,  // extra indicator set manually via busylight -flag
+	"camera":   85,  // a camera is in use
+	"meeting":  80,  // in a video call (signalled by external automation)
+	"activity": 70,  // doing one of the user's activities (set via busylight -activity)
+	"presence": 60,  // away from the computer (idle or locked session)
+	"calendar": 50,  // busy time on a monitored calendar
+	"default":  0,   // what we show if nothing else has anything to say
+}
+
+// defaultOverlayLayers lists the layers which are overlays unless config.json says otherwise.
+var defaultOverlayLayers = map[string]bool{
+	"flag": true,
+}
+
+// statusCandidate is one layer's opinion of what the lights should show.
+type statusCandidate struct {
+	Status  string    // name of the status (from StatusLights) to display
+	Reason  string    // human-readable explanation of why
+	Expires time.Time // when this candidate lapses on its own (zero if it doesn't)
+}
+
+// isExpired reports whether the candidate has lapsed as of the given time.
+func (c statusCandidate) isExpired(now time.Time) bool {
+	return !c.Expires.IsZero() && !now.Before(c.Expires)
+}
+
+// statusResolver collects the candidate status from each layer and decides which one wins.
+type statusResolver struct {
+	candidates map[string]statusCandidate
+}
+
+// newStatusResolver creates a resolver with nothing but the default layer's candidate.
+func newStatusResolver() *statusResolver {
+	r := &statusResolver{candidates: make(map[string]statusCandidate)}
+	r.Set("default", statusCandidate{Status: "free", Reason: "nothing else going on"})
+	return r
+}
+
+// Set records the candidate offered by a layer, replacing any it offered before.
+func (r *statusResolver) Set(layer string, c statusCandidate) {
+	r.candidates[layer] = c
+}
+
+// Clear withdraws any candidate offered by a layer.
+func (r *statusResolver) Clear(layer string) {
+	delete(r.candidates, layer)
+}
+
+// Get returns the candidate currently offered by a layer, if any.
+func (r *statusResolver) Get(layer string) (statusCandidate, bool) {
+	c, ok := r.candidates[layer]
+	return c, ok
+}
+
+// Expire removes all candidates which have lapsed as of the given time,
+// returning the names of the layers which were affected.
+func (r *statusResolver) Expire(now time.Time) []string {
+	var expired []string
+	for layer, c := range r.candidates {
+		if c.isExpired(now) {
+			expired = append(expired, layer)
+			delete(r.candidates, layer)
+		}
+	}
+	sort.Strings(expired)
+	return expired
+}
+
+// NextExpiry returns the earliest time after now at which any candidate will lapse,
+// or the zero time if none of them will.
+func (r *statusResolver) NextExpiry(now time.Time) time.Time {
+	var next time.Time
+	for _, c := range r.candidates {
+		if c.Expires.After(now) && (next.IsZero() || c.Expires.Before(next)) {
+			next = c.Expires
+		}
+	}
+	return next
+}
+
+// layerPriority gives the configured priority of a layer, and whether it is enabled at all.
+func layerPriority(config *busylight.ConfigData, layer string) (int, bool) {
+	if lc, ok := config.Layers[layer]; ok {
+		if lc.Priority != nil {
+			return *lc.Priority, !lc.Disabled
+		}
+		return defaultLayerPriorities[layer], !lc.Disabled
+	}
+	return defaultLayerPriorities[layer], true
+}
+
+// isOverlay reports whether a layer's status is displayed on top of the others rather than
+// competing with them.
+func isOverlay(config *busylight.ConfigData, layer string) bool {
+	if lc, ok := config.Layers[layer]; ok && lc.Overlay != nil {
+		return *lc.Overlay
+	}
+	return defaultOverlayLayers[layer]
+}
+
+// Ranked returns the names of the enabled layers which currently offer a candidate,
+// highest priority first.
+func (r *statusResolver) Ranked(config *busylight.ConfigData) []string {
+	var layers []string
+	for layer := range r.candidates {
+		if _, enabled := layerPriority(config, layer); enabled {
+			layers = append(layers, layer)
+		}
+	}
+	sort.Slice(layers, func(i, j int) bool {
+		pi, _ := layerPriority(config, layers[i])
+		pj, _ := layerPriority(config, layers[j])
+		if pi != pj {
+			return pi > pj
+		}
+		return layers[i] < layers[j]
+	})
+	return layers
+}
+
+// Pick returns the layer whose candidate wins (the highest-priority layer which isn't an
+// overlay, or "" if there is none) and the overlay layers offering a candidate, lowest
+// priority first.
+func (r *statusResolver) Pick(config *busylight.ConfigData) (winner string, overlays []string) {
+	for _, l := range r.Ranked(config) {
+		if isOverlay(config, l) {
+			overlays = append([]string{l}, overlays...)
+		} else if winner == "" {
+			winner = l
+		}
+	}
+	return winner, overlays
+}
+
+// Resolve decides what should be displayed now. The winning candidate is the one
+// offered by the highest-priority layer which isn't an overlay. The status of every
+// overlay layer is then combined with it (lowest priority first), so the returned
+// candidate's Status may be several status names joined with "+", and the returned
+// layer name may likewise be several layer names joined with "+". If no enabled layer
+// has anything to offer, ok is false.
+func (r *statusResolver) Resolve(config *busylight.ConfigData) (layer string, c statusCandidate, ok bool) {
+	var statuses, reasons []string
+
+	winner, layers := r.Pick(config)
+	if winner != "" {
+		layers = append([]string{winner}, layers...)
+	}
+	if len(layers) == 0 {
+		return "", statusCandidate{}, false
+	}
+	for _, l := range layers {
+		statuses = append(statuses, r.candidates[l].Status)
+		reasons = append(reasons, r.candidates[l].Reason)
+	}
+	return strings.Join(layers, "+"), statusCandidate{
+		Status:  strings.Join(statuses, "+"),
+		Reason:  strings.Join(reasons, "; "),
+		Expires: r.candidates[layers[0]].Expires,
+	}, true
+}
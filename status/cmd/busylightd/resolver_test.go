@@ -0,0 +1,153 @@
+package main
+
+import (
+	"internal/busylight"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolve(t *testing.T) {
+	priority := func(p int) *int { return &p }
+	yes, no := true, false
+	later := time.Now().Add(time.Hour)
+
+	for _, test := range []struct {
+		name       string
+		layers     map[string]busylight.LayerConfigData
+		candidates map[string]statusCandidate
+		ranked     string
+		layer      string
+		status     string
+		ok         bool
+	}{
+		{
+			name:   "nothing but the default",
+			ranked: "default", layer: "default", status: "free", ok: true,
+		},
+		{
+			name: "highest priority wins",
+			candidates: map[string]statusCandidate{
+				"calendar": {Status: "busy"},
+				"meeting":  {Status: "muted"},
+				"presence": {Status: "away"},
+			},
+			ranked: "meeting,presence,calendar,default", layer: "meeting", status: "muted", ok: true,
+		},
+		{
+			name:   "disabled layer",
+			layers: map[string]busylight.LayerConfigData{"meeting": {Disabled: true}},
+			candidates: map[string]statusCandidate{
+				"calendar": {Status: "busy"},
+				"meeting":  {Status: "muted"},
+			},
+			ranked: "calendar,default", layer: "calendar", status: "busy", ok: true,
+		},
+		{
+			name:   "priority from config",
+			layers: map[string]busylight.LayerConfigData{"calendar": {Priority: priority(95)}},
+			candidates: map[string]statusCandidate{
+				"calendar": {Status: "busy"},
+				"meeting":  {Status: "muted"},
+			},
+			ranked: "calendar,meeting,default", layer: "calendar", status: "busy", ok: true,
+		},
+		{
+			name:   "equal priorities go by name",
+			layers: map[string]busylight.LayerConfigData{"presence": {Priority: priority(50)}},
+			candidates: map[string]statusCandidate{
+				"presence": {Status: "away"},
+				"calendar": {Status: "busy"},
+			},
+			ranked: "calendar,presence,default", layer: "calendar", status: "busy", ok: true,
+		},
+		{
+			name: "overlay on top of the winner",
+			candidates: map[string]statusCandidate{
+				"flag":     {Status: "lowpri"},
+				"calendar": {Status: "busy", Expires: later},
+			},
+			ranked: "flag,calendar,default", layer: "calendar+flag", status: "busy+lowpri", ok: true,
+		},
+		{
+			name:   "overlays lowest priority first",
+			layers: map[string]busylight.LayerConfigData{"camera": {Overlay: &yes}},
+			candidates: map[string]statusCandidate{
+				"flag":     {Status: "lowpri"},
+				"camera":   {Status: "camera"},
+				"calendar": {Status: "busy"},
+			},
+			ranked: "flag,camera,calendar,default", layer: "calendar+camera+flag", status: "busy+camera+lowpri", ok: true,
+		},
+		{
+			name:   "flag made an ordinary layer",
+			layers: map[string]busylight.LayerConfigData{"flag": {Overlay: &no}},
+			candidates: map[string]statusCandidate{
+				"flag":     {Status: "lowpri"},
+				"calendar": {Status: "busy"},
+			},
+			ranked: "flag,calendar,default", layer: "flag", status: "lowpri", ok: true,
+		},
+		{
+			name:       "only an overlay",
+			layers:     map[string]busylight.LayerConfigData{"default": {Disabled: true}},
+			candidates: map[string]statusCandidate{"flag": {Status: "lowpri"}},
+			ranked:     "flag", layer: "flag", status: "lowpri", ok: true,
+		},
+		{
+			name:   "no winner at all",
+			layers: map[string]busylight.LayerConfigData{"default": {Disabled: true}},
+			ranked: "", ok: false,
+		},
+	} {
+		r := newStatusResolver()
+		for layer, c := range test.candidates {
+			r.Set(layer, c)
+		}
+		config := &busylight.ConfigData{Layers: test.layers}
+
+		if ranked := strings.Join(r.Ranked(config), ","); ranked != test.ranked {
+			t.Errorf("%s: ranked %s, want %s", test.name, ranked, test.ranked)
+		}
+		layer, c, ok := r.Resolve(config)
+		if layer != test.layer || c.Status != test.status || ok != test.ok {
+			t.Errorf("%s: resolved %q from %q (%v), want %q from %q (%v)", test.name, c.Status, layer, ok, test.status, test.layer, test.ok)
+		}
+		if ok && c.Expires != test.candidates[strings.Split(layer, "+")[0]].Expires {
+			t.Errorf("%s: expires %v, want the winner's", test.name, c.Expires)
+		}
+	}
+}
+
+func TestResolverExpiry(t *testing.T) {
+	now := time.Now()
+	r := newStatusResolver()
+	r.Set("override", statusCandidate{Status: "busy", Expires: now.Add(time.Minute)})
+	r.Set("flag", statusCandidate{Status: "lowpri", Expires: now.Add(time.Hour)})
+	r.Set("calendar", statusCandidate{Status: "busy"})
+
+	if next := r.NextExpiry(now); !next.Equal(now.Add(time.Minute)) {
+		t.Errorf("next expiry %v, want in a minute", next)
+	}
+	if expired := r.Expire(now); len(expired) != 0 {
+		t.Errorf("%v expired too soon", expired)
+	}
+	if expired := r.Expire(now.Add(time.Minute)); strings.Join(expired, ",") != "override" {
+		t.Errorf("%v expired, want override", expired)
+	}
+	if _, ok := r.Get("override"); ok {
+		t.Error("expired override still offered")
+	}
+	if next := r.NextExpiry(now.Add(time.Minute)); !next.Equal(now.Add(time.Hour)) {
+		t.Errorf("next expiry %v, want in an hour", next)
+	}
+	if expired := r.Expire(now.Add(2 * time.Hour)); strings.Join(expired, ",") != "flag" {
+		t.Errorf("%v expired, want flag", expired)
+	}
+	if next := r.NextExpiry(now.Add(2 * time.Hour)); !next.IsZero() {
+		t.Errorf("next expiry %v with nothing left to expire", next)
+	}
+	if layer, c, _ := r.Resolve(&busylight.ConfigData{}); layer != "calendar" || c.Status != "busy" {
+		t.Errorf("resolved %q from %q after expiry", c.Status, layer)
+	}
+}
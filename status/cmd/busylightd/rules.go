@@ -0,0 +1,242 @@
+//
+// Rules for busylightd.
+//
+// After the status resolver picks a status from the layers, the rules from
+// config.json are checked in order. The first rule whose conditions all hold
+// replaces that status with the one it names (still adding any overlays on top). Each time we do this we keep
+// a record of how each rule fared so busylight -explain can show it.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"fmt"
+	"internal/busylight"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// rule is a RuleConfigData from the configuration, prepared for evaluation.
+type rule struct {
+	busylight.RuleConfigData
+	calendar *regexp.Regexp // compiled If.Calendar, or nil
+	status   *regexp.Regexp // compiled If.Status, or nil
+	after    int            // If.After in minutes past midnight, or -1
+	before   int            // If.Before in minutes past midnight, or -1
+}
+
+// ruleContext holds the facts the rules' conditions are tested against.
+type ruleContext struct {
+	Now       time.Time
+	Status    string   // status of the winning layer (without any overlays), or "off"
+	Meeting   string   // "muted", "open", or "" if not in a meeting
+	Override  string   // override status in effect, or ""
+	Presence  string   // "present" or "away"
+	Calendars []string // titles of calendars busy now
+}
+
+// parseTimeOfDay converts HH:MM to minutes past midnight.
+func parseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day \"%s\" (must be HH:MM)", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// compileRules prepares the rules from the configuration for use, reporting any errors in them.
+func compileRules(config *busylight.ConfigData) ([]rule, error) {
+	var rules []rule
+	var err error
+
+	for i, rc := range config.Rules {
+		r := rule{RuleConfigData: rc, after: -1, before: -1}
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if _, err = busylight.StatusCommand(config, r.Show); err != nil {
+			return nil, fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+		if r.If.Calendar != "" {
+			if r.calendar, err = regexp.Compile(r.If.Calendar); err != nil {
+				return nil, fmt.Errorf("rule %s: Calendar: %v", r.Name, err)
+			}
+		}
+		if r.If.Status != "" {
+			if r.status, err = regexp.Compile("^(?:" + r.If.Status + ")$"); err != nil {
+				return nil, fmt.Errorf("rule %s: Status: %v", r.Name, err)
+			}
+		}
+		switch r.If.Meeting {
+		case "", "muted", "open", "yes", "no":
+		default:
+			return nil, fmt.Errorf("rule %s: Meeting must be \"muted\", \"open\", \"yes\", or \"no\"", r.Name)
+		}
+		switch r.If.Presence {
+		case "", "present", "away":
+		default:
+			return nil, fmt.Errorf("rule %s: Presence must be \"present\" or \"away\"", r.Name)
+		}
+		if r.If.After != "" {
+			if r.after, err = parseTimeOfDay(r.If.After); err != nil {
+				return nil, fmt.Errorf("rule %s: After: %v", r.Name, err)
+			}
+		}
+		if r.If.Before != "" {
+			if r.before, err = parseTimeOfDay(r.If.Before); err != nil {
+				return nil, fmt.Errorf("rule %s: Before: %v", r.Name, err)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// check tests the rule's conditions against the context, returning whether they all hold
+// along with a description of how each condition fared.
+func (r rule) check(ctx ruleContext) (bool, []string) {
+	var details []string
+	matched := true
+
+	result := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			matched = false
+		}
+		details = append(details, fmt.Sprintf(format, args...))
+	}
+
+	if r.calendar != nil {
+		var hit string
+		for _, title := range ctx.Calendars {
+			if r.calendar.MatchString(title) {
+				hit = title
+				break
+			}
+		}
+		if hit != "" {
+			result(true, "calendar \"%s\" is busy and matches /%s/", hit, r.If.Calendar)
+		} else {
+			result(false, "no busy calendar matches /%s/", r.If.Calendar)
+		}
+	}
+
+	if r.If.Meeting != "" {
+		var ok bool
+		switch r.If.Meeting {
+		case "yes":
+			ok = ctx.Meeting != ""
+		case "no":
+			ok = ctx.Meeting == ""
+		default:
+			ok = ctx.Meeting == r.If.Meeting
+		}
+		state := ctx.Meeting
+		if state == "" {
+			state = "not in a meeting"
+		} else {
+			state = "in a meeting, mic " + state
+		}
+		result(ok, "meeting: wanted %s, %s", r.If.Meeting, state)
+	}
+
+	if r.If.Override != "" {
+		var ok bool
+		switch r.If.Override {
+		case "yes":
+			ok = ctx.Override != ""
+		case "no":
+			ok = ctx.Override == ""
+		default:
+			ok = ctx.Override == r.If.Override
+		}
+		if ctx.Override == "" {
+			result(ok, "override: wanted %s, none in effect", r.If.Override)
+		} else {
+			result(ok, "override: wanted %s, \"%s\" in effect", r.If.Override, ctx.Override)
+		}
+	}
+
+	if r.If.Presence != "" {
+		result(ctx.Presence == r.If.Presence, "presence: wanted %s, user is %s", r.If.Presence, ctx.Presence)
+	}
+
+	if r.status != nil {
+		if r.status.MatchString(ctx.Status) {
+			result(true, "status \"%s\" matches /%s/", ctx.Status, r.If.Status)
+		} else {
+			result(false, "status \"%s\" does not match /%s/", ctx.Status, r.If.Status)
+		}
+	}
+
+	if r.after >= 0 || r.before >= 0 {
+		now := ctx.Now.Hour()*60 + ctx.Now.Minute()
+		var ok bool
+		switch {
+		case r.before < 0:
+			ok = now >= r.after
+		case r.after < 0:
+			ok = now < r.before
+		case r.after <= r.before:
+			ok = now >= r.after && now < r.before
+		default:
+			// the range wraps around midnight
+			ok = now >= r.after || now < r.before
+		}
+		var window []string
+		if r.after >= 0 {
+			window = append(window, "at or after "+r.If.After)
+		}
+		if r.before >= 0 {
+			window = append(window, "before "+r.If.Before)
+		}
+		if ok {
+			result(true, "time %s is %s", ctx.Now.Format("15:04"), strings.Join(window, " and "))
+		} else {
+			result(false, "time %s is not %s", ctx.Now.Format("15:04"), strings.Join(window, " and "))
+		}
+	}
+
+	return matched, details
+}
+
+// applyRules checks the rules in order, returning the first one which applies (or nil)
+// along with a report of each rule checked.
+func applyRules(rules []rule, ctx ruleContext) (*rule, []busylight.RuleReport) {
+	var reports []busylight.RuleReport
+
+	for i := range rules {
+		matched, details := rules[i].check(ctx)
+		reports = append(reports, busylight.RuleReport{Name: rules[i].Name, Matched: matched, Details: details})
+		if matched {
+			return &rules[i], reports
+		}
+	}
+	return nil, reports
+}
+
+// nextRuleBoundary returns the next time after now at which any rule's After or Before
+// time of day arrives (so we can check the rules again then), or the zero time if there
+// are none.
+func nextRuleBoundary(rules []rule, now time.Time) time.Time {
+	var next time.Time
+
+	for _, r := range rules {
+		for _, minutes := range []int{r.after, r.before} {
+			if minutes < 0 {
+				continue
+			}
+			t := time.Date(now.Year(), now.Month(), now.Day(), minutes/60, minutes%60, 0, 0, now.Location())
+			if !t.After(now) {
+				t = t.AddDate(0, 0, 1)
+			}
+			if next.IsZero() || t.Before(next) {
+				next = t
+			}
+		}
+	}
+	return next
+}
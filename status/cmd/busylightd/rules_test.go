@@ -0,0 +1,164 @@
+package main
+
+import (
+	"internal/busylight"
+	"strings"
+	"testing"
+	"time"
+)
+
+// at returns today's date at the given time of day.
+func at(hour, minute int) time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, time.Local)
+}
+
+func TestCompileRulesErrors(t *testing.T) {
+	for _, test := range []struct {
+		rule    busylight.RuleConfigData
+		problem string
+	}{
+		{busylight.RuleConfigData{Show: "nonesuch"}, "rule #1: undefined color code"},
+		{busylight.RuleConfigData{Name: "cal", Show: "busy", If: busylight.RuleConditions{Calendar: "("}}, "rule cal: Calendar:"},
+		{busylight.RuleConfigData{Name: "status", Show: "busy", If: busylight.RuleConditions{Status: "busy|("}}, "rule status: Status:"},
+		{busylight.RuleConfigData{Name: "meeting", Show: "busy", If: busylight.RuleConditions{Meeting: "maybe"}}, "Meeting must be"},
+		{busylight.RuleConfigData{Name: "presence", Show: "busy", If: busylight.RuleConditions{Presence: "here"}}, "Presence must be"},
+		{busylight.RuleConfigData{Name: "after", Show: "busy", If: busylight.RuleConditions{After: "5pm"}}, "rule after: After: invalid time of day"},
+		{busylight.RuleConfigData{Name: "before", Show: "busy", If: busylight.RuleConditions{Before: "25:00"}}, "rule before: Before: invalid time of day"},
+	} {
+		config := &busylight.ConfigData{Rules: []busylight.RuleConfigData{test.rule}}
+		if _, err := compileRules(config); err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("rule %+v: error %v, want one about %q", test.rule, err, test.problem)
+		}
+	}
+}
+
+func TestRuleConditions(t *testing.T) {
+	for _, test := range []struct {
+		conditions busylight.RuleConditions
+		ctx        ruleContext
+		want       bool
+	}{
+		{busylight.RuleConditions{}, ruleContext{}, true},
+		{busylight.RuleConditions{Calendar: "^Focus"}, ruleContext{Calendars: []string{"Work", "Focus time"}}, true},
+		{busylight.RuleConditions{Calendar: "^Focus"}, ruleContext{Calendars: []string{"Work"}}, false},
+		{busylight.RuleConditions{Meeting: "yes"}, ruleContext{Meeting: "muted"}, true},
+		{busylight.RuleConditions{Meeting: "yes"}, ruleContext{}, false},
+		{busylight.RuleConditions{Meeting: "no"}, ruleContext{}, true},
+		{busylight.RuleConditions{Meeting: "open"}, ruleContext{Meeting: "muted"}, false},
+		{busylight.RuleConditions{Override: "yes"}, ruleContext{Override: "busy"}, true},
+		{busylight.RuleConditions{Override: "no"}, ruleContext{Override: "busy"}, false},
+		{busylight.RuleConditions{Override: "busy"}, ruleContext{Override: "busy"}, true},
+		{busylight.RuleConditions{Presence: "away"}, ruleContext{Presence: "away"}, true},
+		{busylight.RuleConditions{Presence: "away"}, ruleContext{Presence: "present"}, false},
+		// Status must match all of the name.
+		{busylight.RuleConditions{Status: "busy|free"}, ruleContext{Status: "free"}, true},
+		{busylight.RuleConditions{Status: "busy"}, ruleContext{Status: "busybody"}, false},
+		{busylight.RuleConditions{Status: "busy"}, ruleContext{Status: "notbusy"}, false},
+		// After is inclusive, Before isn't.
+		{busylight.RuleConditions{After: "17:00"}, ruleContext{Now: at(17, 0)}, true},
+		{busylight.RuleConditions{After: "17:00"}, ruleContext{Now: at(16, 59)}, false},
+		{busylight.RuleConditions{Before: "09:00"}, ruleContext{Now: at(8, 59)}, true},
+		{busylight.RuleConditions{Before: "09:00"}, ruleContext{Now: at(9, 0)}, false},
+		{busylight.RuleConditions{After: "09:00", Before: "17:00"}, ruleContext{Now: at(12, 0)}, true},
+		{busylight.RuleConditions{After: "09:00", Before: "17:00"}, ruleContext{Now: at(17, 30)}, false},
+		// A window which wraps past midnight.
+		{busylight.RuleConditions{After: "22:00", Before: "06:00"}, ruleContext{Now: at(23, 0)}, true},
+		{busylight.RuleConditions{After: "22:00", Before: "06:00"}, ruleContext{Now: at(5, 59)}, true},
+		{busylight.RuleConditions{After: "22:00", Before: "06:00"}, ruleContext{Now: at(6, 0)}, false},
+		{busylight.RuleConditions{After: "22:00", Before: "06:00"}, ruleContext{Now: at(12, 0)}, false},
+		// Every condition must hold.
+		{busylight.RuleConditions{Status: "busy", Presence: "away"}, ruleContext{Status: "busy", Presence: "present"}, false},
+	} {
+		config := &busylight.ConfigData{Rules: []busylight.RuleConfigData{{If: test.conditions, Show: "busy"}}}
+		rules, err := compileRules(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, details := rules[0].check(test.ctx); got != test.want {
+			t.Errorf("%+v with %+v: got %v (%s)", test.conditions, test.ctx, got, strings.Join(details, "; "))
+		}
+	}
+}
+
+func TestApplyRulesOrder(t *testing.T) {
+	config := &busylight.ConfigData{Rules: []busylight.RuleConfigData{
+		{Name: "meeting", If: busylight.RuleConditions{Meeting: "yes"}, Show: "muted"},
+		{Name: "evening", If: busylight.RuleConditions{Status: "busy", After: "17:00"}, Show: "away"},
+		{Name: "late", If: busylight.RuleConditions{After: "17:00"}, Show: "off"},
+	}}
+	rules, err := compileRules(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fired, reports := applyRules(rules, ruleContext{Now: at(18, 0), Status: "busy"})
+	if fired == nil || fired.Name != "evening" {
+		t.Fatalf("rule %v fired, want evening", fired)
+	}
+	if len(reports) != 2 || reports[0].Matched || !reports[1].Matched {
+		t.Errorf("reports %+v are wrong", reports)
+	}
+
+	if fired, reports = applyRules(rules, ruleContext{Now: at(12, 0), Status: "busy"}); fired != nil || len(reports) != 3 {
+		t.Errorf("rule %v fired, with reports %+v", fired, reports)
+	}
+	if fired, _ = applyRules(rules, ruleContext{Now: at(18, 0), Status: "free"}); fired == nil || fired.Name != "late" {
+		t.Errorf("rule %v fired, want late", fired)
+	}
+}
+
+func TestNextRuleBoundary(t *testing.T) {
+	config := &busylight.ConfigData{Rules: []busylight.RuleConfigData{
+		{If: busylight.RuleConditions{After: "22:00", Before: "06:00"}, Show: "away"},
+		{If: busylight.RuleConditions{After: "09:00"}, Show: "busy"},
+	}}
+	rules, err := compileRules(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		now, want time.Time
+	}{
+		{at(7, 0), at(9, 0)},
+		{at(9, 0), at(22, 0)},
+		{at(23, 0), at(6, 0).AddDate(0, 0, 1)},
+		{at(5, 0), at(6, 0)},
+	} {
+		if got := nextRuleBoundary(rules, test.now); !got.Equal(test.want) {
+			t.Errorf("after %v: got %v, want %v", test.now, got, test.want)
+		}
+	}
+	if got := nextRuleBoundary(nil, at(7, 0)); !got.IsZero() {
+		t.Errorf("got %v with no rules", got)
+	}
+}
+
+// Rules look at the winning status, not what the overlays add to it, and the overlays stay
+// on top of the status a rule shows instead.
+func TestDecideStatusWithOverlay(t *testing.T) {
+	config := &busylight.ConfigData{
+		StatusLights: map[string]string{"lowpri": "*5$"},
+		Rules:        []busylight.RuleConfigData{{Name: "after-hours", If: busylight.RuleConditions{Status: "busy"}, Show: "away"}},
+	}
+	rules, err := compileRules(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers := newStatusResolver()
+	layers.Set("calendar", statusCandidate{Status: "busy", Reason: "meeting"})
+	layers.Set("flag", statusCandidate{Status: "lowpri", Reason: "flagged"})
+
+	ex := decideStatus(config, &CalendarAvailability{}, layers, rules)
+	if ex.Resolved != "busy+lowpri" || ex.ResolvedLayer != "calendar+flag" {
+		t.Errorf("resolved %q from %q, want busy+lowpri from calendar+flag", ex.Resolved, ex.ResolvedLayer)
+	}
+	if ex.Rule != "after-hours" || ex.Status != "away+lowpri" {
+		t.Errorf("rule %q gave %q, want after-hours giving away+lowpri", ex.Rule, ex.Status)
+	}
+
+	layers.Set("calendar", statusCandidate{Status: "free", Reason: "nothing on"})
+	if ex = decideStatus(config, &CalendarAvailability{}, layers, rules); ex.Rule != "" || ex.Status != "free+lowpri" {
+		t.Errorf("rule %q gave %q, want no rule and free+lowpri", ex.Rule, ex.Status)
+	}
+}
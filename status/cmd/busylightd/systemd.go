@@ -0,0 +1,87 @@
+//
+// systemd integration for busylightd.
+//
+// When run as a systemd service (see the unit files in the systemd
+// directory), the daemon tells systemd when it's ready and what it's
+// showing, pets the watchdog if one is configured, and accepts the control
+// socket from systemd if the service was socket-activated. None of this
+// needs anything more than the environment variables systemd sets, and
+// all of it quietly does nothing when we weren't started by systemd.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const sdListenFdsStart = 3 // the first file descriptor systemd passes to socket-activated services
+
+// sdNotify sends a state notification (such as "READY=1") to systemd.
+// If we aren't running under systemd, it does nothing.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("Unable to notify systemd: %v", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("Unable to notify systemd: %v", err)
+	}
+	return nil
+}
+
+// sdWatchdogInterval returns how often we should tell systemd we're still alive,
+// or 0 if systemd isn't watching us.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	// Check in twice as often as required, so a little delay doesn't get us killed.
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// sdListener returns the listening socket systemd passed to us if we were socket-activated,
+// or nil if we weren't.
+func sdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	if count > 1 {
+		return nil, fmt.Errorf("systemd passed %d sockets but we only know what to do with one", count)
+	}
+
+	// Don't pass any of this on to the hooks we run.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	syscall.CloseOnExec(sdListenFdsStart)
+	f := os.NewFile(sdListenFdsStart, "systemd socket")
+	defer f.Close()
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to use socket from systemd: %v", err)
+	}
+	return listener, nil
+}
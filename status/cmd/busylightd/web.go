@@ -0,0 +1,140 @@
+//
+// Web page for busylightd.
+//
+// If ListenAddress is set in config.json, the daemon serves a small web
+// page there which shows what the lights are doing and lets the user change
+// the status, signal a meeting, or start and stop activities (from a phone,
+// say, or from another room). The page itself is built into the daemon, and
+// keeps up to date using /events. The same address also serves the control
+// requests the page needs (see control.go).
+//
+// If WebPassword is set, every request must give it. If not, anyone who can
+// reach the page by IP address can see it, but requests which change anything
+// must come from this computer. Either way, changes must come from the page
+// itself, not from some other web site the user has open.
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"crypto/subtle"
+	"embed"
+	"fmt"
+	"internal/busylight"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// startWebServer begins serving the web page and control requests on ListenAddress,
+// if one is configured. Otherwise it returns a nil listener.
+func startWebServer(config *busylight.ConfigData, devState *busylight.DevState, requests chan<- controlRequest) (net.Listener, error) {
+	if config.ListenAddress == "" {
+		return nil, nil
+	}
+	content, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", config.ListenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen for web requests on %s: %v", config.ListenAddress, err)
+	}
+
+	mux := http.NewServeMux()
+	handleSharedRequests(mux, requests)
+	mux.Handle("/", http.FileServer(http.FS(content)))
+	handler := requireWebPassword(config.WebPassword, mux)
+	go func() {
+		if err := http.Serve(listener, handler); err != nil {
+			devState.Logger.Info("Web server closed", "err", err)
+		}
+	}()
+	devState.Logger.Info("Serving web page", "address", listener.Addr().String())
+	return listener, nil
+}
+
+// requireWebPassword only lets requests through to the handler if they give the password,
+// when there is one. If there isn't, it only lets through those which look at things, and
+// those which change anything from this computer. Either way, requests which change
+// anything must come from our own page.
+func requireWebPassword(password string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		changes := r.Method != http.MethodGet && r.Method != http.MethodHead
+		switch {
+		case password != "":
+			_, given, ok := r.BasicAuth()
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(password)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="busylight", charset="UTF-8"`)
+				http.Error(w, "the password is needed", http.StatusUnauthorized)
+				return
+			}
+		case !addressedByIP(r):
+			// Without a password, another web site could have the user's browser look
+			// things up here, or make changes, by pointing its own name at this address.
+			http.Error(w, "this page may only be reached by IP address or as localhost, since WebPassword isn't set", http.StatusForbidden)
+			return
+		case changes && !(fromLoopback(r) && isLoopbackName(requestHost(r))):
+			http.Error(w, "changes may only be made from the computer running busylightd, since WebPassword isn't set", http.StatusForbidden)
+			return
+		}
+		if changes && !sameOrigin(r) {
+			http.Error(w, "changes may only be made from the busylightd web page", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// fromLoopback reports whether a request came from this computer.
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requestHost returns the host name or address the request was sent to, without the port.
+func requestHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
+}
+
+// isLoopbackName reports whether host names this computer by a loopback address or as localhost.
+func isLoopbackName(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return host == "localhost" || strings.HasSuffix(host, ".localhost")
+}
+
+// addressedByIP reports whether the request was sent to an IP address or to localhost,
+// rather than to a name which someone else could point at us.
+func addressedByIP(r *http.Request) bool {
+	host := requestHost(r)
+	return net.ParseIP(host) != nil || isLoopbackName(host)
+}
+
+// sameOrigin reports whether the request came from a page served from here. Web browsers
+// always say where a request which changes things came from; other clients don't.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
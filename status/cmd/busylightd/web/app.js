@@ -0,0 +1,233 @@
+// Busylight web page: shows what the lights are doing and sends the daemon
+// requests to change it. Everything is kept up to date by the daemon's
+// /events stream.
+"use strict";
+
+// How the device's firmware animates the lights (see busylight.ino).
+const FLASH_STEP = 200;   // ms each step of a flasher sequence is shown
+const STROBE_ON = 50;     // ms each strober flash is lit
+const STROBE_OFF = 2000;  // ms between strober flashes
+const FIRMWARE_LIGHTS = 7; // lights the firmware drives
+
+// Colors to use for lights which have no ColorValues entry.
+const DEFAULT_COLORS = {
+	R: "red", G: "lime", B: "blue", Y: "yellow", W: "white",
+	O: "orange", A: "orange", P: "purple", C: "cyan", M: "magenta",
+};
+
+let display = {Colors: "", Statuses: []};
+let status = null;
+let patternStart = 0;
+let activities = [];
+let activitiesReceived = 0;
+
+const $ = (id) => document.getElementById(id);
+
+// ledIndex returns the light number named by a character in a command, or -1 for none,
+// as the device's firmware does: "_" is none, a letter in Colors names that light, and so
+// does a digit (those beyond the lights the firmware drives being none).
+function ledIndex(c) {
+	if (c === "_") {
+		return -1;
+	}
+	const i = display.Colors.indexOf(c);
+	if (i >= 0) {
+		return i;
+	}
+	const n = c.charCodeAt(0) - 48;
+	return n >= 0 && n < FIRMWARE_LIGHTS ? n : -1;
+}
+
+// colorOf returns the color to draw a light with.
+function colorOf(letter) {
+	if (display.ColorValues && display.ColorValues[letter]) {
+		return display.ColorValues[letter];
+	}
+	return DEFAULT_COLORS[letter.toUpperCase()] || "gray";
+}
+
+function drawLightColumn() {
+	const lights = $("lights");
+	lights.replaceChildren();
+	for (const letter of display.Colors) {
+		const led = document.createElement("div");
+		led.className = "led";
+		led.style.background = led.style.color = colorOf(letter);
+		led.title = letter;
+		lights.appendChild(led);
+	}
+}
+
+// litNow works out which lights are lit at this moment for the pattern being shown.
+function litNow() {
+	const lit = new Set();
+	const p = (status && status.Lights) || {};
+	const t = Date.now() - patternStart;
+
+	if (p.Steady) {
+		lit.add(ledIndex(p.Steady));
+	}
+	if (p.Flash) {
+		if (p.Flash.length === 1) {
+			if (Math.floor(t / FLASH_STEP) % 2 === 0) {
+				lit.add(ledIndex(p.Flash));
+			}
+		} else {
+			lit.add(ledIndex(p.Flash[Math.floor(t / FLASH_STEP) % p.Flash.length]));
+		}
+	}
+	if (p.Strobe) {
+		const period = STROBE_ON + STROBE_OFF;
+		if (t % period < STROBE_ON) {
+			lit.add(ledIndex(p.Strobe[Math.floor(t / period) % p.Strobe.length]));
+		}
+	}
+	return lit;
+}
+
+function animate() {
+	const lit = litNow();
+	const leds = $("lights").children;
+	for (let i = 0; i < leds.length; i++) {
+		leds[i].classList.toggle("lit", lit.has(i));
+	}
+}
+
+function showStatus() {
+	if (!status.Active) {
+		$("status").textContent = "sleeping";
+	} else {
+		$("status").textContent = status.Status;
+	}
+	let reason = status.Reason;
+	if (status.Flag) {
+		reason += " (flag: " + status.Flag.Status + ")";
+	}
+	$("reason").textContent = reason;
+
+	for (const button of $("statuses").children) {
+		button.classList.toggle("current", !!status.Override && status.Override.Status === button.textContent);
+	}
+	$("cancel-override").disabled = !status.Override;
+	$("meeting-muted").classList.toggle("current", status.InMeeting && status.Muted);
+	$("meeting-open").classList.toggle("current", status.InMeeting && !status.Muted);
+	$("meeting-end").disabled = !status.InMeeting;
+}
+
+function formatMinutes(minutes) {
+	const m = Math.floor(minutes);
+	return Math.floor(m / 60) + ":" + String(m % 60).padStart(2, "0");
+}
+
+function showActivities() {
+	$("activity-section").hidden = activities.length === 0;
+	const table = $("activities");
+	table.replaceChildren();
+	let active = false;
+	for (const a of activities) {
+		const row = table.insertRow();
+		const button = document.createElement("button");
+		button.textContent = a.Name;
+		button.classList.toggle("current", !!a.Active);
+		button.onclick = () => send("PUT", "/activity", {Name: a.Name});
+		row.insertCell().appendChild(button);
+		const time = row.insertCell();
+		time.className = "time";
+		time.dataset.elapsed = a.Elapsed;
+		time.dataset.active = a.Active ? "yes" : "";
+		active = active || !!a.Active;
+	}
+	$("stop-activity").disabled = !active;
+	tickActivities();
+}
+
+// tickActivities updates the time shown for each activity, counting up for the one going on now.
+function tickActivities() {
+	const running = status && status.Active ? (Date.now() - activitiesReceived) / 60000 : 0;
+	for (const cell of document.querySelectorAll("#activities td.time")) {
+		let minutes = Number(cell.dataset.elapsed);
+		if (cell.dataset.active) {
+			minutes += running;
+		}
+		cell.textContent = formatMinutes(minutes);
+	}
+}
+
+// send makes a request of the daemon, showing any error it reports.
+async function send(method, path, body) {
+	const options = {method: method};
+	if (body !== undefined) {
+		options.headers = {"Content-Type": "application/json"};
+		options.body = JSON.stringify(body);
+	}
+	try {
+		const response = await fetch(path, options);
+		if (!response.ok) {
+			throw new Error((await response.text()).trim() || response.statusText);
+		}
+		$("message").hidden = true;
+	} catch (err) {
+		$("message").textContent = err.message;
+		$("message").hidden = false;
+	}
+}
+
+function setOverride(name) {
+	const minutes = Number($("duration").value);
+	const override = {Status: name};
+	if (minutes > 0) {
+		override.Until = new Date(Date.now() + minutes * 60000).toISOString();
+	}
+	send("PUT", "/override", override);
+}
+
+async function loadDisplay() {
+	const response = await fetch("/display");
+	display = await response.json();
+	drawLightColumn();
+	const buttons = $("statuses");
+	buttons.replaceChildren();
+	for (const name of display.Statuses) {
+		const button = document.createElement("button");
+		button.textContent = name;
+		button.onclick = () => setOverride(name);
+		buttons.appendChild(button);
+	}
+	if (status) {
+		showStatus();
+	}
+}
+
+function listen() {
+	const source = new EventSource("/events");
+	source.onopen = () => { $("connection").textContent = ""; };
+	source.onerror = () => { $("connection").textContent = "Lost contact with busylightd; retrying…"; };
+	source.addEventListener("status", (e) => {
+		const previous = status;
+		status = JSON.parse(e.data);
+		if (!previous || JSON.stringify(previous.Lights) !== JSON.stringify(status.Lights)) {
+			patternStart = Date.now();
+		}
+		showStatus();
+		tickActivities();
+	});
+	source.addEventListener("activities", (e) => {
+		activities = JSON.parse(e.data) || [];
+		activitiesReceived = Date.now();
+		showActivities();
+	});
+}
+
+$("cancel-override").onclick = () => send("DELETE", "/override");
+$("meeting-muted").onclick = () => send("PUT", "/meeting", {Status: "muted"});
+$("meeting-open").onclick = () => send("PUT", "/meeting", {Status: "open"});
+$("meeting-end").onclick = () => send("DELETE", "/meeting");
+$("stop-activity").onclick = () => send("DELETE", "/activity");
+
+loadDisplay().catch((err) => {
+	$("message").textContent = "Unable to load light details: " + err.message;
+	$("message").hidden = false;
+});
+listen();
+setInterval(animate, 25);
+setInterval(tickActivities, 10000);
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireWebPassword(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, test := range []struct {
+		password, method, host, remote, origin, given string
+		want                                          int
+	}{
+		// Without a password, the page may be watched by address from anywhere...
+		{"", "GET", "192.168.1.5:9199", "192.168.1.9:4000", "", "", http.StatusOK},
+		{"", "GET", "[::1]:9199", "[::1]:4000", "", "", http.StatusOK},
+		// ...but not under a name someone else could point at us...
+		{"", "GET", "evil.example.com:9199", "127.0.0.1:4000", "", "", http.StatusForbidden},
+		{"", "PUT", "evil.example.com:9199", "127.0.0.1:4000", "http://evil.example.com:9199", "", http.StatusForbidden},
+		// ...and changes must come from here.
+		{"", "PUT", "localhost:9199", "127.0.0.1:4000", "http://localhost:9199", "", http.StatusOK},
+		{"", "DELETE", "127.0.0.1:9199", "127.0.0.1:4000", "", "", http.StatusOK},
+		{"", "PUT", "192.168.1.5:9199", "192.168.1.9:4000", "", "", http.StatusForbidden},
+		{"", "PUT", "192.168.1.5:9199", "127.0.0.1:4000", "", "", http.StatusForbidden},
+		{"", "PUT", "localhost:9199", "127.0.0.1:4000", "http://example.com", "", http.StatusForbidden},
+		// With a password, everything needs it, whatever the name.
+		{"sesame", "GET", "desk.lan:9199", "192.168.1.9:4000", "", "", http.StatusUnauthorized},
+		{"sesame", "GET", "desk.lan:9199", "192.168.1.9:4000", "", "wrong", http.StatusUnauthorized},
+		{"sesame", "GET", "desk.lan:9199", "192.168.1.9:4000", "", "sesame", http.StatusOK},
+		{"sesame", "PUT", "desk.lan:9199", "192.168.1.9:4000", "http://desk.lan:9199", "sesame", http.StatusOK},
+		{"sesame", "PUT", "desk.lan:9199", "192.168.1.9:4000", "http://evil.example.com", "sesame", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(test.method, "/status", nil)
+		r.Host = test.host
+		r.RemoteAddr = test.remote
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.given != "" {
+			r.SetBasicAuth("me", test.given)
+		}
+		w := httptest.NewRecorder()
+		requireWebPassword(test.password, ok).ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%+v: got %d", test, w.Code)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+//
+// Webhook notifications for busylightd.
+//
+// Each time the status displayed on the lights changes, the daemon posts
+// a busylight.StatusEvent as JSON to each URL in the Webhooks section of
+// config.json, so that (for example) a team dashboard can show everyone's
+// status.
+//
+// Events are first written to a spool directory (one subdirectory per
+// webhook), then a background worker for each webhook delivers them in
+// order, removing each file once the receiver accepts it. If the receiver
+// can't be reached (or answers with a 5xx or 429 status), the worker
+// keeps retrying with increasing delays, so events aren't lost while we
+// (or it) are offline, even across restarts of the daemon. If it rejects
+// an event outright (any other 4xx status), that event is logged and
+// discarded since sending it again won't help.
+//
+// If a Secret is configured, each request carries the header
+//
+//    X-Busylight-Signature: sha256=<hex HMAC-SHA256 of the body using Secret>
+//
+// Steve Willoughby <steve@madscience.zone>
+// License: BSD 3-Clause open-source license
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"internal/busylight"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWebhookTimeout = 10 * time.Second // how long to wait for a receiver if not configured
+	maxSpooledEvents      = 1000             // most events kept for a webhook before discarding the oldest
+)
+
+// These are variables only so the tests needn't wait as long.
+var (
+	minWebhookRetry = 5 * time.Second  // delay before first retrying a failed delivery
+	maxWebhookRetry = 10 * time.Minute // longest delay between retries
+)
+
+// webhookTarget is one configured webhook, with the state needed to deliver events to it.
+type webhookTarget struct {
+	webhook busylight.WebhookConfigData
+	timeout time.Duration
+	dir     string        // where its undelivered events are spooled
+	wake    chan struct{} // signalled when a new event is spooled
+}
+
+// webhookNotifier spools status change events and delivers them to the webhooks in the background.
+type webhookNotifier struct {
+	devState *busylight.DevState
+	user     string
+	targets  []*webhookTarget
+	quit     chan struct{}
+	running  sync.WaitGroup
+	sequence int // distinguishes events spooled within the same clock tick
+}
+
+// webhookSpoolPath returns the directory where undelivered webhook events are kept.
+func webhookSpoolPath(config *busylight.ConfigData) string {
+	if config.WebhookSpool != "" {
+		return config.WebhookSpool
+	}
+	return filepath.Join(filepath.Dir(config.PidFile), "busylightd-webhooks")
+}
+
+// checkWebhooks reports any errors in the webhook definitions in the configuration.
+func checkWebhooks(config *busylight.ConfigData) error {
+	for i, webhook := range config.Webhooks {
+		u, err := url.Parse(webhook.URL)
+		if err != nil {
+			return fmt.Errorf("webhook #%d: invalid URL: %v", i+1, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("webhook #%d: URL \"%s\" must be http or https", i+1, webhook.URL)
+		}
+		if webhook.Timeout != "" {
+			if _, err := time.ParseDuration(webhook.Timeout); err != nil {
+				return fmt.Errorf("webhook #%d: invalid timeout: %v", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// newWebhookNotifier prepares the spool directories for the configured webhooks and starts
+// delivering any events left undelivered from before.
+func newWebhookNotifier(config *busylight.ConfigData, devState *busylight.DevState) (*webhookNotifier, error) {
+	if err := checkWebhooks(config); err != nil {
+		return nil, err
+	}
+
+	n := &webhookNotifier{
+		devState: devState,
+		user:     userName(config),
+		quit:     make(chan struct{}),
+	}
+
+	spool := webhookSpoolPath(config)
+	for _, webhook := range config.Webhooks {
+		t := &webhookTarget{
+			webhook: webhook,
+			timeout: defaultWebhookTimeout,
+			// Name the directory after the URL so its events stay with it even if
+			// the list of webhooks is rearranged.
+			dir:  filepath.Join(spool, fmt.Sprintf("%x", sha256.Sum256([]byte(webhook.URL)))[:16]),
+			wake: make(chan struct{}, 1),
+		}
+		if webhook.Timeout != "" {
+			t.timeout, _ = time.ParseDuration(webhook.Timeout)
+		}
+		if err := os.MkdirAll(t.dir, 0700); err != nil {
+			return nil, fmt.Errorf("Unable to create webhook spool directory: %v", err)
+		}
+		n.targets = append(n.targets, t)
+	}
+
+	for _, t := range n.targets {
+		n.running.Add(1)
+		go n.worker(t)
+	}
+	return n, nil
+}
+
+// StatusChanged spools an event for each webhook if the status displayed has changed from old to new.
+// The next time the daemon expects to change the lights is included if it is known (non-zero).
+func (n *webhookNotifier) StatusChanged(old, new busylight.Explanation, next time.Time) {
+	if old.Status == new.Status || len(n.targets) == 0 {
+		return
+	}
+
+	event := busylight.StatusEvent{
+		User:     n.user,
+		Status:   new.Status,
+		Reason:   new.Reason,
+		Layer:    new.ResolvedLayer,
+		Rule:     new.Rule,
+		Previous: old.Status,
+		Time:     time.Now(),
+	}
+	if !next.IsZero() {
+		event.NextTransition = &next
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		n.devState.Logger.Error("Unable to encode webhook event", "err", err)
+		return
+	}
+
+	n.sequence++
+	name := fmt.Sprintf("%020d-%06d.json", event.Time.UnixNano(), n.sequence%1000000)
+	for _, t := range n.targets {
+		if err := t.spool(name, data); err != nil {
+			n.devState.Logger.Error("Unable to queue event for webhook", "url", t.webhook.URL, "err", err)
+			continue
+		}
+		if discarded := t.trim(maxSpooledEvents); discarded > 0 {
+			n.devState.Logger.Warn("Too many undelivered events for webhook; discarded oldest", "url", t.webhook.URL, "discarded", discarded)
+		}
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Stop asks the workers to finish up once they have nothing left they can deliver right away,
+// waiting no longer than the given time. Anything still undelivered stays in the spool for
+// next time.
+func (n *webhookNotifier) Stop(limit time.Duration) {
+	close(n.quit)
+	done := make(chan struct{})
+	go func() {
+		n.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(limit):
+		n.devState.Logger.Warn("Gave up waiting for webhook deliveries to finish")
+	}
+}
+
+// spool writes an event into the target's spool directory. It is written under a temporary
+// name first so the worker never sees a partly-written file.
+func (t *webhookTarget) spool(name string, data []byte) error {
+	temp := filepath.Join(t.dir, name+".tmp")
+	if err := os.WriteFile(temp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, filepath.Join(t.dir, name))
+}
+
+// pending returns the names of the target's spooled events, oldest first.
+func (t *webhookTarget) pending() ([]string, error) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// trim removes the oldest spooled events so that no more than limit remain,
+// returning how many were removed.
+func (t *webhookTarget) trim(limit int) int {
+	names, err := t.pending()
+	if err != nil || len(names) <= limit {
+		return 0
+	}
+	for _, name := range names[:len(names)-limit] {
+		os.Remove(filepath.Join(t.dir, name))
+	}
+	return len(names) - limit
+}
+
+// worker delivers the target's spooled events in order until told to quit.
+func (n *webhookNotifier) worker(t *webhookTarget) {
+	defer n.running.Done()
+	retry := minWebhookRetry
+
+	for {
+		names, err := t.pending()
+		if err != nil {
+			n.devState.Logger.Error("Unable to read webhook spool directory", "dir", t.dir, "err", err)
+		}
+		if len(names) == 0 {
+			select {
+			case <-t.wake:
+				continue
+			case <-n.quit:
+				return
+			}
+		}
+
+		path := filepath.Join(t.dir, names[0])
+		data, err := os.ReadFile(path)
+		if err == nil {
+			var permanent bool
+			if permanent, err = t.deliver(data); err == nil || permanent {
+				if err != nil {
+					n.devState.Logger.Error("Webhook rejected event (discarded)", "url", t.webhook.URL, "event", names[0], "err", err)
+				}
+				os.Remove(path)
+				retry = minWebhookRetry
+				continue
+			}
+		} else if os.IsNotExist(err) {
+			// trimmed out from under us
+			continue
+		}
+
+		n.devState.Logger.Warn("Unable to deliver event to webhook (will retry)", "url", t.webhook.URL, "retry", retry, "err", err)
+		select {
+		case <-time.After(retry):
+		case <-n.quit:
+			return
+		}
+		if retry *= 2; retry > maxWebhookRetry {
+			retry = maxWebhookRetry
+		}
+	}
+}
+
+// deliver posts a single event to the target. If it fails, permanent indicates whether
+// the receiver rejected the event itself (as opposed to a failure worth retrying).
+func (t *webhookTarget) deliver(data []byte) (permanent bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, t.webhook.URL, bytes.NewReader(data))
+	if err != nil {
+		return true, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "busylightd")
+	if t.webhook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(t.webhook.Secret))
+		mac.Write(data)
+		req.Header.Set("X-Busylight-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := &http.Client{Timeout: t.timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return false, fmt.Errorf("server responded %s", resp.Status)
+	default:
+		return true, fmt.Errorf("server responded %s", resp.Status)
+	}
+}
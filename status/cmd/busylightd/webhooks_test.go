@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"internal/busylight"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// quietDevState returns a DevState whose log messages go nowhere.
+func quietDevState() *busylight.DevState {
+	return &busylight.DevState{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+}
+
+// webhookReceiver is a test server which records the events posted to it, answering
+// each request with the next of the given status codes (and 200 once they run out).
+type webhookReceiver struct {
+	*httptest.Server
+	mu        sync.Mutex
+	responses []int
+	events    []busylight.StatusEvent
+	failures  int
+	received  chan struct{}
+}
+
+func newWebhookReceiver(t *testing.T, secret string, responses ...int) *webhookReceiver {
+	r := &webhookReceiver{responses: responses, received: make(chan struct{}, 100)}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if secret != "" {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(body)
+			if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); req.Header.Get("X-Busylight-Signature") != want {
+				t.Errorf("signature %q, want %q", req.Header.Get("X-Busylight-Signature"), want)
+			}
+		}
+
+		r.mu.Lock()
+		code := http.StatusOK
+		if len(r.responses) > 0 {
+			code, r.responses = r.responses[0], r.responses[1:]
+		}
+		if code == http.StatusOK {
+			var event busylight.StatusEvent
+			if err := json.Unmarshal(body, &event); err != nil {
+				t.Errorf("can't decode event %q: %v", body, err)
+			}
+			r.events = append(r.events, event)
+		} else {
+			r.failures++
+		}
+		r.mu.Unlock()
+		w.WriteHeader(code)
+		r.received <- struct{}{}
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// waitFor waits until the receiver has had n requests.
+func (r *webhookReceiver) waitFor(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d requests received", i, n)
+		}
+	}
+}
+
+func (r *webhookReceiver) statuses() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var statuses []string
+	for _, e := range r.events {
+		statuses = append(statuses, e.Status)
+	}
+	return statuses
+}
+
+func shortWebhookRetries(t *testing.T) {
+	oldMin, oldMax := minWebhookRetry, maxWebhookRetry
+	minWebhookRetry, maxWebhookRetry = 10*time.Millisecond, 50*time.Millisecond
+	t.Cleanup(func() { minWebhookRetry, maxWebhookRetry = oldMin, oldMax })
+}
+
+func webhookConfig(t *testing.T, urls ...string) *busylight.ConfigData {
+	config := &busylight.ConfigData{UserName: "tester", WebhookSpool: t.TempDir()}
+	for _, u := range urls {
+		config.Webhooks = append(config.Webhooks, busylight.WebhookConfigData{URL: u, Secret: "sesame"})
+	}
+	return config
+}
+
+func expectStatuses(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("delivered %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("delivered %v, want %v", got, want)
+		}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	receiver := newWebhookReceiver(t, "sesame")
+	config := webhookConfig(t, receiver.URL)
+	n, err := newWebhookNotifier(config, quietDevState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop(time.Second)
+
+	n.StatusChanged(busylight.Explanation{Status: "free"}, busylight.Explanation{Status: "busy", Reason: "meeting", ResolvedLayer: "calendar"}, time.Time{})
+	n.StatusChanged(busylight.Explanation{Status: "busy"}, busylight.Explanation{Status: "busy"}, time.Time{})
+	n.StatusChanged(busylight.Explanation{Status: "busy"}, busylight.Explanation{Status: "free"}, time.Now().Add(time.Hour))
+	receiver.waitFor(t, 2)
+	expectStatuses(t, receiver.statuses(), "busy", "free")
+
+	receiver.mu.Lock()
+	first, second := receiver.events[0], receiver.events[1]
+	receiver.mu.Unlock()
+	if first.User != "tester" || first.Previous != "free" || first.Reason != "meeting" || first.Layer != "calendar" || first.NextTransition != nil {
+		t.Errorf("first event %+v is wrong", first)
+	}
+	if second.NextTransition == nil {
+		t.Errorf("second event %+v has no NextTransition", second)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	shortWebhookRetries(t)
+	receiver := newWebhookReceiver(t, "sesame", http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK, http.StatusBadRequest)
+	config := webhookConfig(t, receiver.URL)
+	n, err := newWebhookNotifier(config, quietDevState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop(time.Second)
+
+	// The first event is retried until it is accepted; the second is rejected outright
+	// and discarded; the third goes straight through.
+	n.StatusChanged(busylight.Explanation{Status: "free"}, busylight.Explanation{Status: "busy"}, time.Time{})
+	receiver.waitFor(t, 3)
+	n.StatusChanged(busylight.Explanation{Status: "busy"}, busylight.Explanation{Status: "muted"}, time.Time{})
+	receiver.waitFor(t, 1)
+	n.StatusChanged(busylight.Explanation{Status: "muted"}, busylight.Explanation{Status: "free"}, time.Time{})
+	receiver.waitFor(t, 1)
+	expectStatuses(t, receiver.statuses(), "busy", "free")
+	if receiver.failures != 3 {
+		t.Errorf("%d failed deliveries, want 3", receiver.failures)
+	}
+}
+
+func TestWebhookSpoolSurvivesRestart(t *testing.T) {
+	shortWebhookRetries(t)
+	down := make([]int, 1000)
+	for i := range down {
+		down[i] = http.StatusServiceUnavailable
+	}
+	receiver := newWebhookReceiver(t, "sesame", down...)
+	config := webhookConfig(t, receiver.URL)
+
+	// While the receiver is down, the event stays in the spool...
+	n, err := newWebhookNotifier(config, quietDevState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.StatusChanged(busylight.Explanation{Status: "free"}, busylight.Explanation{Status: "busy"}, time.Time{})
+	receiver.waitFor(t, 2)
+	n.Stop(time.Second)
+	if names, err := n.targets[0].pending(); err != nil || len(names) != 1 {
+		t.Fatalf("spooled %v (%v), want one event", names, err)
+	}
+
+	// ...until the next daemon finds it back up.
+	receiver.mu.Lock()
+	receiver.responses = nil
+	receiver.mu.Unlock()
+	for len(receiver.received) > 0 {
+		<-receiver.received
+	}
+	n, err = newWebhookNotifier(config, quietDevState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop(time.Second)
+	receiver.waitFor(t, 1)
+	expectStatuses(t, receiver.statuses(), "busy")
+}
@@ -1,9 +1,12 @@
 module github.com/madsciencezone/busylight
 
-go 1.20
+go 1.21
 
 require (
-	golang.org/x/net v0.1.0
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/godbus/dbus/v5 v5.1.0
+	github.com/mochi-mqtt/server/v2 v2.7.9
+	golang.org/x/net v0.33.0
 	golang.org/x/oauth2 v0.0.0-20210220000619-9bb904979d93
 	google.golang.org/api v0.41.0
 	internal/busylight v0.0.0
@@ -15,14 +18,18 @@ require (
 	github.com/golang/groupcache v0.0.0-20200121045136-8c9f03a8e57e // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/googleapis/gax-go/v2 v2.0.5 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/rs/xid v1.4.0 // indirect
 	go.bug.st/serial v1.3.5 // indirect
 	go.opencensus.io v0.23.0 // indirect
-	golang.org/x/sys v0.1.0 // indirect
-	golang.org/x/text v0.4.0 // indirect
+	golang.org/x/sync v0.10.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/genproto v0.0.0-20210303154014-9728d6b83eeb // indirect
 	google.golang.org/grpc v1.49.0 // indirect
-	google.golang.org/protobuf v1.27.1 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
 replace internal/busylight => ./internal/busylight
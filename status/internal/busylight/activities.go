@@ -0,0 +1,99 @@
+package busylight
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Activity is something the user does which the daemon keeps time for. While it's
+// going on, the daemon shows the activity's status.
+//
+// This is the same format as blight's activities file, so that file may be used
+// as-is (see ActivityFile).
+type Activity struct {
+	// What the activity is called.
+	Name string
+
+	// What to show during the activity. Each entry is the name of a status from
+	// StatusLights, or (as in blight's activities file) a busylight option which
+	// sets one: "-status name", "-mute", or "-open". If there are several, they
+	// are shown together.
+	Status []string
+
+	// How many minutes have been spent on the activity so far.
+	Elapsed int
+
+	// Whether the activity is going on now.
+	Active bool `json:",omitempty"`
+}
+
+// ActivityStatus returns the status to show during an activity.
+func ActivityStatus(a Activity) (string, error) {
+	var names []string
+	for _, s := range a.Status {
+		fields := strings.Fields(s)
+		switch {
+		case len(fields) == 1 && !strings.HasPrefix(fields[0], "-"):
+			names = append(names, fields[0])
+		case len(fields) == 2 && (fields[0] == "-status" || fields[0] == "--status"):
+			names = append(names, fields[1])
+		case len(fields) == 1 && (fields[0] == "-mute" || fields[0] == "--mute"):
+			names = append(names, "muted")
+		case len(fields) == 1 && (fields[0] == "-open" || fields[0] == "--open"):
+			names = append(names, "open")
+		default:
+			return "", fmt.Errorf("activity %s: can't understand status \"%s\"", a.Name, s)
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("activity %s has no status", a.Name)
+	}
+	return strings.Join(names, "+"), nil
+}
+
+// ActivityPath returns the pathname of the file where the daemon keeps track of the time spent
+// on each activity. If not explicitly configured, it lives alongside the PID file.
+func ActivityPath(config *ConfigData) string {
+	if config.ActivityFile != "" {
+		return config.ActivityFile
+	}
+	return filepath.Join(filepath.Dir(config.PidFile), "activities.json")
+}
+
+// ReadActivities reads the activities file. If it doesn't exist, there are no activities.
+func ReadActivities(path string) ([]Activity, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unable to read activities file: %v", err)
+	}
+	var activities []Activity
+	if err := json.Unmarshal(data, &activities); err != nil {
+		return nil, fmt.Errorf("Unable to understand activities file %s: %v", path, err)
+	}
+	return activities, nil
+}
+
+// WriteActivities replaces the activities file with a new one. The new file is written
+// alongside the old one and moved into place, so the old one is never left half-written.
+func WriteActivities(path string, activities []Activity) error {
+	data, err := json.MarshalIndent(activities, "", "    ")
+	if err != nil {
+		return fmt.Errorf("Unable to encode activities: %v", err)
+	}
+	temp := path + ".new"
+	if err := ioutil.WriteFile(temp, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("Unable to write activities file: %v", err)
+	}
+	if err := os.Rename(temp, path); err != nil {
+		os.Remove(temp)
+		return fmt.Errorf("Unable to write activities file: %v", err)
+	}
+	return nil
+}
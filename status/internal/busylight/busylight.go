@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"go.bug.st/serial"
@@ -19,6 +22,118 @@ type CalendarConfigData struct {
 	IgnoreAllDayEvents bool   // If true, ignore this calendar if booked the whole time
 }
 
+// LayerConfigData adjusts how the daemon weighs one of the sources of information
+// it uses to decide what status to display. These are read from the config.json file.
+type LayerConfigData struct {
+	Priority *int  // Layers with higher priority win over lower ones (if omitted, use the default)
+	Disabled bool  // If true, ignore this layer entirely
+	Overlay  *bool // If true, show this layer's status on top of the winning one (if omitted, use the default)
+}
+
+// RuleConditions lists the conditions under which a rule applies. All of the
+// conditions given must hold for the rule to apply; those left empty are ignored.
+type RuleConditions struct {
+	Calendar string // Regular expression matching the Title of any calendar busy now
+	Meeting  string // Meeting state: "muted", "open", "yes" (either), or "no"
+	Override string // "yes" or "no" (is an override in effect?), or the name of the override status
+	Presence string // Presence state: "present" or "away"
+	Status   string // Regular expression matching the status the daemon would otherwise show, without overlays
+	After    string // Time of day (HH:MM) at or after which the rule applies
+	Before   string // Time of day (HH:MM) before which the rule applies
+}
+
+// RuleConfigData describes a rule which changes the status the daemon displays
+// when certain conditions hold. These are read from the config.json file.
+type RuleConfigData struct {
+	Name string         // Arbitrary user-friendly name for the rule
+	If   RuleConditions // When the rule applies
+	Show string         // Status to display instead (may be several names joined with "+")
+}
+
+// HookConfigData describes a command the daemon runs when something happens.
+// These are read from the config.json file.
+type HookConfigData struct {
+	// What the hook is run for: "enter" or "leave" (a status), "meeting-start",
+	// "meeting-end", "start" or "stop" (the daemon).
+	Event string
+
+	// For "enter" and "leave", the status name to run for. If empty, the hook
+	// is run for every change of status.
+	Status string
+
+	// The program to run, followed by its arguments.
+	Command []string
+
+	// How long to let the command run before killing it (e.g., "10s"). Defaults to 30 seconds.
+	Timeout string
+}
+
+// WebhookConfigData describes a URL to which the daemon posts a StatusEvent each
+// time the status it displays changes. These are read from the config.json file.
+type WebhookConfigData struct {
+	// Where to POST the events.
+	URL string
+
+	// If not empty, each request carries an X-Busylight-Signature header with
+	// the HMAC-SHA256 of the request body using this as the key.
+	Secret string
+
+	// How long to wait for the receiver to respond (e.g., "10s"). Defaults to 10 seconds.
+	Timeout string
+}
+
+// MQTTConfigData describes how the daemon connects to an MQTT broker to publish
+// its status and receive commands. These are read from the config.json file.
+type MQTTConfigData struct {
+	// The broker's URL, such as "tcp://localhost:1883" or "ssl://broker:8883".
+	// If empty, the daemon doesn't use MQTT.
+	Broker string
+
+	// The client ID to connect as. Defaults to "busylightd-" followed by UserName.
+	ClientID string
+
+	// Credentials to log in to the broker, if it requires them.
+	Username string
+	Password string
+
+	// All topics published and subscribed to start with this. Defaults to "busylight/"
+	// followed by UserName.
+	TopicPrefix string
+
+	// For TLS connections, a file of CA certificates to trust instead of the system's,
+	// a client certificate and key to present to the broker, and whether to skip
+	// verifying the broker's certificate (which is insecure).
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+
+	// If true, announce the busylight to Home Assistant using its MQTT discovery
+	// protocol, with discovery topics starting with DiscoveryPrefix (default "homeassistant").
+	HomeAssistant   bool
+	DiscoveryPrefix string
+}
+
+// MeetingDetectorConfigData describes how to recognize that the user is in a meeting
+// using a particular conferencing application. All of the patterns given must
+// match for a meeting to be detected. These are read from the config.json file.
+type MeetingDetectorConfigData struct {
+	// Arbitrary user-friendly name for the application (e.g., "zoom").
+	Name string
+
+	// Regular expression matching the name or command line of a running process
+	// belonging to the application.
+	Process string
+
+	// Regular expression matching the name or command line of a process, descended
+	// from one matching Process, which only runs during a meeting (e.g., Zoom's "CptHost").
+	Child string
+
+	// Regular expression matching the title of a window only shown during a meeting
+	// (e.g., for meetings held in a web browser).
+	WindowTitle string
+}
+
 // ConfigData holds the configuration specified by the user in the config.json file
 // as well as some run-time values we need to refer to throughout the run of the daemon.
 type ConfigData struct {
@@ -26,6 +141,10 @@ type ConfigData struct {
 	// on this particular hardware device, starting with light #0.
 	Colors string
 
+	// The actual color to draw for each of the characters in Colors when
+	// showing the lights on screen, as a color name or #rrggbb value.
+	ColorValues map[string]string
+
 	// A map of all Google calendars being monitored by the daemon.Calendars
 	// The key is the Google-provided calendar ID; the value is a CalendarConfigData
 	// structure describing what we want to do with that calendar.
@@ -34,6 +153,64 @@ type ConfigData struct {
 	// Definitions of named light effects
 	StatusLights map[string]string
 
+	// Adjustments to the priority of each layer the daemon uses to decide which
+	// status to display ("override", "flag", "camera", "meeting", "activity",
+	// "presence", "calendar", "default").
+	// The key is the layer name.
+	Layers map[string]LayerConfigData
+
+	// Rules which change the status to display under certain conditions.
+	// They are checked in order, and the first one which applies is used.
+	Rules []RuleConfigData
+
+	// Commands to run when the daemon's status changes, meetings start or end, etc.,
+	// and how many of them may run at the same time (default 4).
+	Hooks              []HookConfigData
+	MaxConcurrentHooks int
+
+	// URLs to notify when the daemon's status changes, and the directory where
+	// notifications are kept until they are delivered (defaults to busylightd-webhooks
+	// in the same directory as PidFile).
+	Webhooks     []WebhookConfigData
+	WebhookSpool string
+
+	// How to connect to an MQTT broker to publish status and receive commands.
+	MQTT MQTTConfigData
+
+	// The name by which the user is identified to others (e.g., in webhook
+	// notifications and MQTT topics). Defaults to the user's login name.
+	UserName string
+
+	// How to tell when the user is in a meeting without being signalled, how often
+	// to check (e.g., "10s"; the default), where the /proc filesystem is, and a
+	// command which prints the titles of all open windows, one per line.
+	MeetingDetectors   []MeetingDetectorConfigData
+	DetectInterval     string
+	ProcRoot           string
+	WindowTitleCommand []string
+
+	// If WatchMicrophone is true, watch PulseAudio (or PipeWire) using the
+	// PactlCommand program (default "pactl") to tell when applications matching the
+	// regular expression MicrophoneApps (default: any) are using the microphone,
+	// and whether it's muted.
+	WatchMicrophone bool
+	PactlCommand    string
+	MicrophoneApps  string
+
+	// If WatchCamera is true, check (every DetectInterval) for processes which have
+	// a camera open, meaning any file whose name matches the regular expression
+	// CameraDevices (default "^/dev/video[0-9]+$").
+	WatchCamera   bool
+	CameraDevices string
+
+	// If WatchPresence is true, ask systemd-logind (over the D-Bus system bus, or
+	// PresenceBus, which may be "session" or a D-Bus address) whether the user's
+	// session is locked or idle, showing the "away" status once it has been idle
+	// for AwayAfter (default "5m"), and sleeping while the computer is suspended.
+	WatchPresence bool
+	PresenceBus   string
+	AwayAfter     string
+
 	// The path to the file where our access credentials to the calendars is cached.
 	TokenFile string
 
@@ -43,9 +220,49 @@ type ConfigData struct {
 	// The path to our logfile where daemon activity is recorded.
 	LogFile string
 
+	// How much to log ("debug", "info" (the default), "warn", or "error"), and
+	// whether to log as "text" (the default) or "json". LogFile is started over
+	// when it grows past LogMaxSize megabytes (default 10; -1 for no limit) or has
+	// been in use for LogMaxAge (e.g., "24h"; default no limit), keeping LogBackups
+	// (default 5) old ones as LogFile.1, LogFile.2, etc.
+	LogLevel   string
+	LogFormat  string
+	LogMaxSize int
+	LogMaxAge  string
+	LogBackups int
+
 	// The path to the file where we store our PID while we're running.
 	PidFile string
 
+	// The path to the Unix-domain socket where the daemon listens for
+	// control requests. Defaults to busylightd.sock in the same directory
+	// as PidFile.
+	ControlSocket string
+
+	// The path to the file where the daemon records each change in the status it
+	// shows. Defaults to history.jsonl in the same directory as PidFile.
+	HistoryFile string
+
+	// Activities the daemon can keep time for (see Activity). The time spent on each is
+	// kept in ActivityFile, which defaults to activities.json in the same directory as
+	// PidFile. If no Activities are listed here, they are taken from ActivityFile,
+	// so blight's activities file may be used as-is.
+	Activities   []Activity
+	ActivityFile string
+
+	// If set, the TCP address (e.g., "localhost:9198") where the daemon serves
+	// Prometheus metrics at /metrics.
+	MetricsAddress string
+
+	// If set, the TCP address (e.g., "localhost:9199" or ":9199") where the daemon
+	// serves its web page and the parts of the control API needed by that page.
+	ListenAddress string
+
+	// If set, every request to ListenAddress must give this password (using HTTP basic
+	// authentication, with any user name). If not, the page may only be reached by IP
+	// address, and requests which change anything are only accepted from this computer.
+	WebPassword string
+
 	// The server endpoint to contact to update the device, and the address to
 	// use when asking it to update.
 	ServerEndpoint string
@@ -66,14 +283,28 @@ type ConfigData struct {
 
 type DevState struct {
 	// These values are used internally by the daemon while it's running.
-	GoogleConfig []byte      // unmarshalled data needed for Google API calls
-	Logger       *log.Logger // logger open on the requested file
-	Port         serial.Port // open serial port device
-	PortOpen     bool        // is `port` valid and open now?
+	GoogleConfig []byte       // unmarshalled data needed for Google API calls
+	Logger       *slog.Logger // where we log what we're doing
+	Port         serial.Port  // open serial port device
+	PortOpen     bool         // is `port` valid and open now?
+
+	// These count what has happened to the device, for the daemon's metrics.
+	Attaches    atomic.Uint64 // times the device was opened
+	OpenErrors  atomic.Uint64 // times the device could not be opened
+	WriteErrors atomic.Uint64 // commands which could not be sent to the device
+
+	// The device most recently opened, and why the last attempt to use it
+	// failed (or "" if it didn't).
+	DeviceName  string
+	DeviceError string
 }
 
 const maxResponseLength = 128 // how much data can we read from the device?
 
+// queryTimeout is how long we wait for the device to answer a query. It may never answer
+// if it missed the ^D ending an earlier command (or isn't a busylight at all).
+const queryTimeout = 2 * time.Second
+
 // LightStatus is the state the hardware device reported when queried.
 type LightStatus struct {
 	// The raw bytes received from the unit.
@@ -96,48 +327,93 @@ type LightSequence struct {
 	// Where in the flashing sequence are we now?
 	SequenceIndex int
 
-	// The sequence pattern of light numbers.
+	// The sequence pattern of light numbers (or LightOff where no light is lit).
 	Sequence []byte
 }
 
-// lightSignal tells the hardware to signal a particular condition on the lights.
-// If `delay` is positive, we wait that long before returning, to make some trivial
-// multi-step (but very quick and short-lived) sequences easy to implement.
-func LightSignal(config *ConfigData, devState *DevState, color string, delay time.Duration) error {
-	// colorCode maps the color strings as passed in to this function to the
-	// actual commands sent to the hardware.
-	// The "color" is the name of a defined pattern from the "StatusLights"
-	// entry in the config file.
-
-	var defaultColorCode = map[string]string{
-		"start": "S0",   // flashed twice as daemon comes online
-		"stop":  "S1",   // flashed twice as daemon goes offline
-		"off":   "X",    // turn off all lights
-		"busy":  "S3",   // signal that the user is busy
-		"free":  "S4",   // signal that the user is free
-		"muted": "S2",   // in meeting with mic muted
-		"open":  "F12$", // in meeting with mic open
+// defaultStatusLights maps the status names the daemon relies upon
+// to the commands used if the configuration doesn't define them.
+var defaultStatusLights = map[string]string{
+	"start":  "S0",   // flashed twice as daemon comes online
+	"stop":   "S1",   // flashed twice as daemon goes offline
+	"off":    "X",    // turn off all lights
+	"busy":   "S3",   // signal that the user is busy
+	"free":   "S4",   // signal that the user is free
+	"muted":  "S2",   // in meeting with mic muted
+	"open":   "F12$", // in meeting with mic open
+	"camera": "F20$", // camera in use
+	"away":   "S0",   // user is away from the computer
+}
+
+// StatusCommand returns the raw device command for the named status.
+// The name is looked up in the "StatusLights" entry in the config file,
+// falling back to the built-in defaults for the statuses the daemon needs.
+// Several names may be joined with "+" to display them all at once (see ComposeStatus).
+func StatusCommand(config *ConfigData, name string) (string, error) {
+	if strings.Contains(name, "+") {
+		return ComposeStatus(config, strings.Split(name, "+"))
 	}
 
-	command, ok := config.StatusLights[color]
+	command, ok := config.StatusLights[name]
 	if !ok {
-		command, ok = defaultColorCode[color]
+		command, ok = defaultStatusLights[name]
 		if !ok {
-			return fmt.Errorf("undefined color code \"%v\"", color)
+			return "", fmt.Errorf("undefined color code \"%v\"", name)
 		}
 	}
+	return command, nil
+}
+
+// StatusNames returns the names of all the statuses defined in the configuration or by
+// default, in alphabetical order, apart from those only used when the daemon starts and stops.
+func StatusNames(config *ConfigData) []string {
+	var names []string
+	for name := range defaultStatusLights {
+		if _, defined := config.StatusLights[name]; !defined && name != "start" && name != "stop" {
+			names = append(names, name)
+		}
+	}
+	for name := range config.StatusLights {
+		if name != "start" && name != "stop" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lightSignal tells the hardware to signal a particular condition on the lights.
+// If `delay` is positive, we wait that long before returning, to make some trivial
+// multi-step (but very quick and short-lived) sequences easy to implement.
+func LightSignal(config *ConfigData, devState *DevState, color string, delay time.Duration) error {
+	command, err := StatusCommand(config, color)
+	if err != nil {
+		return err
+	}
 
 	return RawLightSignal(config, devState, command, delay)
 }
 
+// RawLightSignal sends a raw command string to the device. The device ignores everything
+// after a command until it gets a ^D, so we end the string with one if it doesn't already,
+// so that the device will listen to whatever we send it next.
 func RawLightSignal(config *ConfigData, devState *DevState, command string, delay time.Duration) error {
+	if !strings.HasSuffix(command, "\x04") {
+		command += "\x04"
+	}
 	if !devState.PortOpen {
 		if err := AttachToLight(config, devState); err != nil {
 			return err
 		}
 		defer DetachFromLight(devState)
 	}
-	devState.Port.Write([]byte(command))
+	if _, err := devState.Port.Write([]byte(command)); err != nil {
+		devState.WriteErrors.Add(1)
+		devState.DeviceError = err.Error()
+		devState.Logger.Error("Unable to send command to light device", "command", command, "err", err)
+	} else {
+		devState.DeviceError = ""
+	}
 	if delay > 0 {
 		time.Sleep(delay)
 	}
@@ -154,36 +430,37 @@ func QueryStatus(config *ConfigData, devState *DevState, delay time.Duration) (L
 		}
 		defer DetachFromLight(devState)
 	}
-	devState.Port.Write([]byte{'?'})
+	if err := devState.Port.SetReadTimeout(queryTimeout); err != nil {
+		return status, fmt.Errorf("unable to query light module: %v", err)
+	}
+	if _, err := devState.Port.Write([]byte("?\x04")); err != nil {
+		devState.WriteErrors.Add(1)
+		devState.DeviceError = err.Error()
+		return status, fmt.Errorf("unable to query light module: %v", err)
+	}
+	devState.DeviceError = ""
 	inputbuf := make([]byte, maxResponseLength)
 	status.RawResponse = make([]byte, maxResponseLength)
 	status.ResponseLength = 0
 collectInput:
 	for {
-		devState.Logger.Printf("reading state data from device")
+		devState.Logger.Debug("Reading state data from device")
 		bytesRead, err := devState.Port.Read(inputbuf)
 		if err != nil {
 			return status, err
 		}
 		if bytesRead == 0 {
-			return status, fmt.Errorf("error reading from light module (EOF)")
+			return status, errorOfKind(ErrBadResponse, "no response from light module within %v", queryTimeout)
 		}
-		devState.Logger.Printf("got %d byte%s, total %d", bytesRead,
-			func(n int) string {
-				if n == 1 {
-					return ""
-				}
-				return "s"
-			}(bytesRead),
-			bytesRead+status.ResponseLength)
+		devState.Logger.Debug("Read from device", "bytes", bytesRead, "total", bytesRead+status.ResponseLength)
 
 		for i = 0; i < bytesRead; i++ {
 			if status.ResponseLength >= maxResponseLength {
-				return status, fmt.Errorf("read more than %d bytes from light module", maxResponseLength)
+				return status, errorOfKind(ErrBadResponse, "read more than %d bytes from light module", maxResponseLength)
 			}
 			if inputbuf[i] == '\n' {
 				if i != bytesRead-1 {
-					devState.Logger.Printf("read more bytes than expected (dropped)")
+					devState.Logger.Warn("Read more bytes than expected from device (dropped)")
 				}
 				break collectInput
 			}
@@ -191,86 +468,73 @@ collectInput:
 			status.ResponseLength++
 		}
 	}
+
+	// The response (see report_LED_state in the firmware) is:
 	//
-	// Response string is:
-	//                  sequence
-	//            index  __|___
-	//                | /      \
-	//                n@xxxxx...         n@xxxxx...
-	//    L011100...F0X                S0X             \n
-	//     \______/  | \
-	//        |      |  if no sequence
-	//      0=off  0=off
-	//      1=on   1=on
-	//    Each LED timer
-	//              |_________________|_____________|
-	//                   flasher         strober
+	//    L <light>... $ F <sequence> $ S <sequence> $ \n
 	//
-
-	devState.Logger.Printf("%d byte response from device: %v", status.ResponseLength, status.RawResponse[:status.ResponseLength])
-
-	if status.RawResponse[0] != 'L' {
-		return status, fmt.Errorf("invalid response from device: expected start of LED status")
+	// Each <light> is the light's letter in Colors (or its number, if it has no letter) if it's
+	// lit, or _ if it isn't. Each <sequence> (for the flasher, then the strober) is R or S
+	// (for whether the light it has got to is lit now or not), followed by X if it isn't running,
+	// or else by where it has got to in the sequence (as the character whose code is 48 more
+	// than that), @, and the lights in the sequence, named as above (with _ for none).
+	response := string(status.RawResponse[:status.ResponseLength])
+	devState.Logger.Debug("Response from device", "response", response)
+
+	fields := strings.Split(response, "$")
+	if len(fields) < 3 || !strings.HasPrefix(fields[0], "L") || !strings.HasPrefix(fields[1], "F") || !strings.HasPrefix(fields[2], "S") {
+		return status, errorOfKind(ErrBadResponse, "invalid response from device: \"%s\"", response)
+	}
+	for _, c := range []byte(fields[0][1:]) {
+		status.IsLightOn = append(status.IsLightOn, c != '_')
+	}
+	var err error
+	if status.Flasher, err = parseSequence(config, fields[1][1:]); err != nil {
+		return status, errorOfKind(ErrBadResponse, "invalid response from device: flasher %v", err)
+	}
+	if status.Strober, err = parseSequence(config, fields[2][1:]); err != nil {
+		return status, errorOfKind(ErrBadResponse, "invalid response from device: strober %v", err)
 	}
-readLEDs:
-	for i = 1; i < status.ResponseLength; i++ {
-		switch status.RawResponse[i] {
-		case '0':
-			status.IsLightOn = append(status.IsLightOn, false)
 
-		case '1':
-			status.IsLightOn = append(status.IsLightOn, true)
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return status, nil
+}
 
-		case 'F':
-			break readLEDs
+// parseSequence decodes the state of the flasher or strober as the device reports it in its
+// response to a query.
+func parseSequence(config *ConfigData, field string) (LightSequence, error) {
+	var seq LightSequence
 
-		default:
-			return status, fmt.Errorf("invalid response from device: expected start of flasher status")
-		}
+	if len(field) < 2 || (field[0] != 'R' && field[0] != 'S') {
+		return seq, fmt.Errorf("status \"%s\" isn't R or S followed by its state", field)
 	}
-	if i+3 >= status.ResponseLength {
-		return status, fmt.Errorf("invalid response from device: short data read")
+	seq.IsOn = field[0] == 'R'
+	if field[1:] == "X" {
+		return seq, nil
 	}
-	status.Flasher.IsOn = status.RawResponse[i+1] == '1'
-	if status.RawResponse[i+2] == 'X' {
-		i += 3
-	} else {
-		status.Flasher.SequenceIndex = int(status.RawResponse[i+2] - '0')
-		if status.RawResponse[i+3] != '@' {
-			return status, fmt.Errorf("invalid response from device: expected @")
-		}
-
-		for i += 4; i < status.ResponseLength && status.RawResponse[i] != 'S'; i++ {
-			status.Flasher.Sequence = append(status.Flasher.Sequence, status.RawResponse[i]-'0')
-		}
-	}
-	if i+2 >= status.ResponseLength {
-		return status, fmt.Errorf("invalid response from device: short data read")
+	if len(field) < 3 || field[2] != '@' {
+		return seq, fmt.Errorf("status \"%s\" is missing its sequence", field)
 	}
-	if status.RawResponse[i] != 'S' {
-		return status, fmt.Errorf("invalid response from device: expected start of strober status")
+	seq.SequenceIndex = int(field[1]) - '0'
+	for _, c := range []byte(field[3:]) {
+		seq.Sequence = append(seq.Sequence, lightNumber(config, c))
 	}
-	status.Strober.IsOn = status.RawResponse[i+1] == '1'
-	if status.RawResponse[i+2] == 'X' {
-		i += 3
-	} else {
-		status.Strober.SequenceIndex = int(status.RawResponse[i+2] - '0')
-		if i+3 >= status.ResponseLength {
-			return status, fmt.Errorf("invalid response from device: short data read")
-		}
-		if status.RawResponse[i+3] != '@' {
-			return status, fmt.Errorf("invalid response from device: expected @")
-		}
+	return seq, nil
+}
 
-		for i += 4; i < status.ResponseLength; i++ {
-			status.Strober.Sequence = append(status.Strober.Sequence, status.RawResponse[i]-'0')
-		}
+// lightNumber works out which light the device names with a character in its response
+// to a query: its letter in Colors, its number, or _ for none (or ? if it's out of range),
+// which are both LightOff.
+func lightNumber(config *ConfigData, c byte) byte {
+	if i := strings.IndexByte(config.Colors, c); i >= 0 {
+		return byte(i)
 	}
-
-	if delay > 0 {
-		time.Sleep(delay)
+	if c >= '0' && c <= '9' && int(c-'0') < FirmwareLights {
+		return c - '0'
 	}
-	return status, nil
+	return LightOff
 }
 
 func GetConfigFromFile(filename string, data *ConfigData) error {
@@ -287,6 +551,17 @@ func GetConfigFromFile(filename string, data *ConfigData) error {
 }
 
 func AttachToLight(config *ConfigData, devState *DevState) error {
+	err := attachToLight(config, devState)
+	if err != nil {
+		devState.DeviceError = err.Error()
+	} else {
+		devState.DeviceError = ""
+	}
+	return err
+}
+
+// attachToLight does the work of AttachToLight.
+func attachToLight(config *ConfigData, devState *DevState) error {
 	var err error
 
 	//
@@ -307,21 +582,24 @@ tryOpeningPort:
 			if err != nil {
 				pe, isPortError := err.(*serial.PortError)
 				if isPortError && pe.Code() == serial.PortBusy {
-					devState.Logger.Printf("light device is busy; retrying...")
+					devState.Logger.Info("Light device is busy; retrying", "device", config.Device)
 					time.Sleep(250 * time.Millisecond)
 					continue tryOpeningPort
 				}
-				return fmt.Errorf("can't open serial device %v: %v", config.Device, err)
+				devState.OpenErrors.Add(1)
+				return errorOfKind(ErrNoDevice, "can't open serial device %v: %v", config.Device, err)
 			}
 			devState.PortOpen = true
+			devState.DeviceName = config.Device
 		} else {
 			// On the other hand, maybe we should hunt around to find it.
 			// This is necessary on systems where the USB port is given a
 			// random device name every time.
-			devState.Logger.Printf("Searching for available device port in %s...", config.DeviceDir)
+			devState.Logger.Debug("Searching for available device port", "dir", config.DeviceDir)
 			fileList, err := os.ReadDir(config.DeviceDir)
 			if err != nil {
-				return fmt.Errorf("can't scan directory %s: %v", config.DeviceDir, err)
+				devState.OpenErrors.Add(1)
+				return errorOfKind(ErrNoDevice, "can't scan directory %s: %v", config.DeviceDir, err)
 			}
 			for _, f := range fileList {
 				if !f.IsDir() {
@@ -335,25 +613,29 @@ tryOpeningPort:
 						if err != nil {
 							pe, isPortError := err.(*serial.PortError)
 							if isPortError && pe.Code() == serial.PortBusy {
-								devState.Logger.Printf("found light device %s; waiting for it to be free...", f.Name())
+								devState.Logger.Info("Found light device; waiting for it to be free", "device", f.Name())
 								time.Sleep(250 * time.Millisecond)
 								continue tryOpeningPort
 							} else {
-								devState.Logger.Fatalf("error opening %s: %v", f.Name(), err)
+								devState.Logger.Error("Unable to open light device", "device", f.Name(), "err", err)
+								os.Exit(1)
 							}
 						} else {
-							devState.Logger.Printf("Opened %s%c%s", config.DeviceDir, os.PathSeparator, f.Name())
+							devState.Logger.Debug("Opened light device", "device", fmt.Sprintf("%s%c%s", config.DeviceDir, os.PathSeparator, f.Name()))
 							devState.PortOpen = true
+							devState.DeviceName = fmt.Sprintf("%s%c%s", config.DeviceDir, os.PathSeparator, f.Name())
 							break
 						}
 					}
 				}
 			}
 			if !devState.PortOpen {
-				return fmt.Errorf("unable to open any device matching /%s/ in %s.", config.DeviceRegexp, config.DeviceDir)
+				devState.OpenErrors.Add(1)
+				return errorOfKind(ErrNoDevice, "unable to open any device matching /%s/ in %s.", config.DeviceRegexp, config.DeviceDir)
 			}
 		}
 	}
+	devState.Attaches.Add(1)
 	return nil
 }
 
@@ -0,0 +1,121 @@
+package busylight
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RGB is a color to draw a light with on screen.
+type RGB struct {
+	R, G, B uint8
+}
+
+// Darken returns the color at the given percentage of its brightness, as tk's
+// ::tk::Darken does (blight draws lights which are off at 25%).
+func (c RGB) Darken(percent int) RGB {
+	scale := func(v uint8) uint8 { return uint8(int(v) * percent / 100) }
+	return RGB{scale(c.R), scale(c.G), scale(c.B)}
+}
+
+// String returns the color in #rrggbb form.
+func (c RGB) String() string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// namedColors are the color names understood in ColorValues, with their values as
+// tk (and X11) define them. Names are matched regardless of case and spaces.
+var namedColors = map[string]RGB{
+	"amber":      {0xff, 0xbf, 0x00},
+	"black":      {0x00, 0x00, 0x00},
+	"blue":       {0x00, 0x00, 0xff},
+	"brown":      {0xa5, 0x2a, 0x2a},
+	"chartreuse": {0x7f, 0xff, 0x00},
+	"cyan":       {0x00, 0xff, 0xff},
+	"darkgreen":  {0x00, 0x64, 0x00},
+	"gold":       {0xff, 0xd7, 0x00},
+	"gray":       {0xbe, 0xbe, 0xbe},
+	"green":      {0x00, 0xff, 0x00},
+	"grey":       {0xbe, 0xbe, 0xbe},
+	"indigo":     {0x4b, 0x00, 0x82},
+	"lightblue":  {0xad, 0xd8, 0xe6},
+	"lime":       {0x00, 0xff, 0x00},
+	"magenta":    {0xff, 0x00, 0xff},
+	"navy":       {0x00, 0x00, 0x80},
+	"orange":     {0xff, 0xa5, 0x00},
+	"pink":       {0xff, 0xc0, 0xcb},
+	"purple":     {0xa0, 0x20, 0xf0},
+	"red":        {0xff, 0x00, 0x00},
+	"turquoise":  {0x40, 0xe0, 0xd0},
+	"violet":     {0xee, 0x82, 0xee},
+	"white":      {0xff, 0xff, 0xff},
+	"yellow":     {0xff, 0xff, 0x00},
+}
+
+// letterColors are the colors assumed for lights when ColorValues doesn't say,
+// going by the letter in Colors.
+var letterColors = map[byte]string{
+	'A': "amber",
+	'B': "blue",
+	'C': "cyan",
+	'G': "green",
+	'M': "magenta",
+	'O': "orange",
+	'P': "purple",
+	'R': "red",
+	'W': "white",
+	'Y': "yellow",
+}
+
+// ParseColor interprets a color given as a name or as #rrggbb (or #rgb).
+func ParseColor(value string) (RGB, error) {
+	if strings.HasPrefix(value, "#") {
+		hex := value[1:]
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		if len(hex) == 6 {
+			if v, err := strconv.ParseUint(hex, 16, 32); err == nil {
+				return RGB{uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+			}
+		}
+		return RGB{}, fmt.Errorf("color \"%s\" is not in #rrggbb form", value)
+	}
+	if c, ok := namedColors[strings.ToLower(strings.ReplaceAll(value, " ", ""))]; ok {
+		return c, nil
+	}
+	return RGB{}, fmt.Errorf("unknown color name \"%s\"", value)
+}
+
+// ColorName returns the name of the color of light number i: its ColorValues entry
+// as given there, or the name assumed from its letter in Colors, or "" if neither
+// says.
+func ColorName(config *ConfigData, i int) string {
+	if i < 0 || i >= len(config.Colors) {
+		return ""
+	}
+	letter := config.Colors[i]
+	if value, ok := config.ColorValues[string(letter)]; ok {
+		return value
+	}
+	return letterColors[strings.ToUpper(string(letter))[0]]
+}
+
+// LightColor returns the color of light number i, from ColorValues if it has a usable
+// entry for that light's letter in Colors, or otherwise from the letter itself.
+// Lights we can't make anything of are gray.
+func LightColor(config *ConfigData, i int) RGB {
+	if i < 0 || i >= len(config.Colors) {
+		return namedColors["gray"]
+	}
+	letter := config.Colors[i]
+	if value, ok := config.ColorValues[string(letter)]; ok {
+		if c, err := ParseColor(value); err == nil {
+			return c
+		}
+	}
+	if name, ok := letterColors[strings.ToUpper(string(letter))[0]]; ok {
+		return namedColors[name]
+	}
+	return namedColors["gray"]
+}
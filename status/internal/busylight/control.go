@@ -0,0 +1,311 @@
+package busylight
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Override is a status manually requested by the user which takes
+// precedence over whatever the daemon would otherwise display (or, for
+// a flag, is displayed on top of it), until it expires.
+type Override struct {
+	// The name of the status (from StatusLights) to display.
+	Status string
+
+	// When the override expires. If zero, it remains in effect until
+	// explicitly cancelled.
+	Until time.Time
+}
+
+// IsActive reports whether the override is in effect at the given time.
+func (o Override) IsActive(now time.Time) bool {
+	return o.Status != "" && (o.Until.IsZero() || now.Before(o.Until))
+}
+
+// DaemonStatus is the daemon's report of its own state, as returned
+// from the control socket.
+type DaemonStatus struct {
+	// The daemon's process ID.
+	PID int
+
+	// Is the daemon awake (as opposed to sleeping via -zzz)?
+	Active bool
+
+	// The name of the status the daemon most recently displayed,
+	// which layer it came from, and why.
+	Status string
+	Layer  string
+	Reason string
+
+	// The name of the rule which changed the status displayed, if any.
+	Rule string `json:",omitempty"`
+
+	// Meeting state as signalled to the daemon.
+	InMeeting bool
+	Muted     bool
+
+	// Is the calendar showing us as busy now?
+	CalendarBusy bool
+
+	// The manual override in effect, if any.
+	Override *Override `json:",omitempty"`
+
+	// The manually-set flag displayed on top of the status, if any.
+	Flag *Override `json:",omitempty"`
+
+	// The activity the user is doing now, if any.
+	Activity string `json:",omitempty"`
+
+	// What the lights are showing for Status.
+	Lights LightPattern
+
+	// When the daemon next expects to change the lights on its own.
+	NextTransition time.Time
+}
+
+// Display describes the device's lights and the statuses it can show, as returned
+// from the control socket so that clients can draw the lights on screen.
+type Display struct {
+	// The color of each light, starting with light #0, as letters (see Colors
+	// in ConfigData) and as the actual colors to draw them (see ColorValues).
+	Colors      string
+	ColorValues map[string]string `json:",omitempty"`
+
+	// The statuses the user may choose from (see StatusNames).
+	Statuses []string
+}
+
+// Explanation describes how the daemon arrived at the status it displays,
+// as returned from the control socket.
+type Explanation struct {
+	// Every layer offering a candidate status, highest priority first.
+	Layers []LayerReport
+
+	// The status chosen from the layers, and the layer(s) which offered it,
+	// before any rules are applied.
+	Resolved      string
+	ResolvedLayer string
+
+	// The rules checked, in order, up to and including the one which applied (if any).
+	Rules []RuleReport
+
+	// The name of the rule which applied, if any.
+	Rule string `json:",omitempty"`
+
+	// The status finally displayed, and why.
+	Status string
+	Reason string
+}
+
+// LayerReport describes the candidate status offered by one layer.
+type LayerReport struct {
+	Name     string
+	Priority int
+	Overlay  bool
+	Status   string
+	Reason   string
+	Expires  time.Time
+}
+
+// RuleReport describes whether a rule applied and why.
+type RuleReport struct {
+	Name    string
+	Matched bool
+	Details []string // how each condition fared
+}
+
+// StatusEvent announces a change in the status the daemon displays. It is
+// the JSON payload the daemon posts to each configured webhook.
+type StatusEvent struct {
+	// Who the status belongs to (see ConfigData.UserName).
+	User string
+
+	// The name of the status now displayed, why, and which layer(s) it came from.
+	Status string
+	Reason string
+	Layer  string
+
+	// The name of the rule which chose the status, if any.
+	Rule string `json:",omitempty"`
+
+	// The status displayed before this change.
+	Previous string
+
+	// When the daemon next expects to change the lights on its own, if known.
+	NextTransition *time.Time `json:",omitempty"`
+
+	// When the change happened.
+	Time time.Time
+}
+
+// MeetingState reports whether the user is in a meeting, as announced by the
+// daemon's "meeting" event.
+type MeetingState struct {
+	InMeeting bool
+	Muted     bool
+}
+
+// CalendarState reports what the daemon knows of the user's calendars, as
+// announced by its "calendar" event.
+type CalendarState struct {
+	// When the daemon last polled the calendars.
+	LastPoll time.Time
+
+	// Is the calendar showing us as busy now, and on which calendars?
+	Busy          bool
+	BusyCalendars []string `json:",omitempty"`
+
+	// The busy periods found on each calendar which haven't ended yet, in order
+	// of their start times.
+	Periods []CalendarPeriod `json:",omitempty"`
+}
+
+// CalendarPeriod is a span of time during which one of the calendars shows the user as busy.
+type CalendarPeriod struct {
+	Calendar   string
+	Start, End time.Time
+}
+
+// DeviceState reports whether the daemon can reach the light device, as announced
+// by its "device" event.
+type DeviceState struct {
+	// The device most recently opened.
+	Device string `json:",omitempty"`
+
+	// Did the daemon's most recent attempt to use the device work? If not, why not?
+	Connected bool
+	Error     string `json:",omitempty"`
+}
+
+// DaemonEvent is a change announced by the daemon on its /events stream.
+// The kind of event determines what the Data holds.
+type DaemonEvent struct {
+	Event string
+	Data  json.RawMessage
+}
+
+// ControlSocketPath returns the pathname of the Unix-domain socket on which
+// the daemon accepts control requests. If not explicitly configured, it
+// lives alongside the PID file.
+func ControlSocketPath(config *ConfigData) string {
+	if config.ControlSocket != "" {
+		return config.ControlSocket
+	}
+	return filepath.Join(filepath.Dir(config.PidFile), "busylightd.sock")
+}
+
+// controlClient returns an HTTP client which talks to the daemon via its control socket.
+// A zero timeout lets requests run for as long as they need to.
+func controlClient(socket string, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+// DaemonRequest sends a request to the running daemon via its control socket.
+// If request is non-nil, it is sent as the JSON body of the request.
+// If result is non-nil, the daemon's JSON response is decoded into it.
+func DaemonRequest(config *ConfigData, method, path string, request, result interface{}) error {
+	var body io.Reader
+
+	socket := ControlSocketPath(config)
+	client := controlClient(socket, 10*time.Second)
+
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://busylightd"+path, body)
+	if err != nil {
+		return err
+	}
+	if request != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errorOfKind(ErrNoDaemon, "unable to contact daemon at %s: %v", socket, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("daemon refused request: %s", strings.TrimSpace(string(message)))
+	}
+
+	if result != nil {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return errorOfKind(ErrBadResponse, "invalid response from daemon: %v", err)
+		}
+	}
+	return nil
+}
+
+// WatchDaemon listens to the daemon's /events stream via its control socket, calling
+// handle for each event as it arrives, starting with the latest event of each kind.
+// It returns when the daemon closes the stream, or with the error from handle
+// if that fails.
+func WatchDaemon(config *ConfigData, handle func(DaemonEvent) error) error {
+	socket := ControlSocketPath(config)
+	resp, err := controlClient(socket, 0).Get("http://busylightd/events")
+	if err != nil {
+		return errorOfKind(ErrNoDaemon, "unable to contact daemon at %s: %v", socket, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("daemon refused request: %s", strings.TrimSpace(string(message)))
+	}
+
+	// Each event is a block of "field: value" lines ended by a blank line. Lines
+	// starting with a colon are comments (which the daemon sends to keep idle
+	// connections alive).
+	var event DaemonEvent
+	var data []string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch {
+		case line == "":
+			if event.Event != "" && len(data) > 0 {
+				event.Data = json.RawMessage(strings.Join(data, "\n"))
+				if err := handle(event); err != nil {
+					return err
+				}
+			}
+			event, data = DaemonEvent{}, nil
+		case field == "event":
+			event.Event = value
+		case field == "data":
+			data = append(data, value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errorOfKind(ErrNoDaemon, "lost contact with daemon: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package busylight
+
+import (
+	"fmt"
+	"time"
+)
+
+// FirmwareLights is the number of lights the device's firmware drives (not all of
+// which need be fitted).
+const FirmwareLights = 7
+
+// LightOff is a place in a flasher or strober sequence where no light is lit.
+const LightOff = 255
+
+// maxSequence is the longest flasher or strober sequence the device accepts. It
+// ignores any lights beyond that.
+const maxSequence = 64
+
+// Emulator imitates the device's firmware (arduino/busylight/busylight.ino) so that
+// we can see what a command would make the lights do without sending it to the device.
+// It follows the firmware's command state machine and its flasher and strober timers,
+// quirks and all, for commands received over USB.
+type Emulator struct {
+	// Whether each light is lit now.
+	Lights []bool
+
+	// How much (emulated) time has passed since the emulator started.
+	Now time.Duration
+
+	colors  string // letters which may be used to name the lights (see ConfigData.Colors)
+	state   emulatorState
+	buffer  []byte // light numbers collected for the command in progress
+	skip    int    // bytes left to ignore for an "=" command
+	flasher blinker
+	strober blinker
+}
+
+// emulatorState is where the firmware's command state machine is.
+type emulatorState int
+
+const (
+	idleState     emulatorState = iota // waiting for a command
+	flashState                         // collecting the lights for F
+	strobeState                        // collecting the lights for *
+	lightSetState                      // waiting for the light for S
+	setState                           // skipping over the settings for =
+	endState                           // a command has ended; waiting for ^D
+	errorState                         // a command was invalid; waiting for ^D
+)
+
+// blinker imitates the firmware's LightBlinker, which flashes through a sequence of lights.
+type blinker struct {
+	on, off time.Duration // how long each light is on, and how long they're all off between them (if at all)
+	running bool
+	lit     bool          // is the light at index lit?
+	index   int           // where we are in the sequence
+	seq     []byte        // light numbers (or LightOff)
+	due     time.Duration // when the timer next goes off
+}
+
+// NewEmulator returns an emulated device which has just been switched on, with all lights off.
+// The colors are the letters which may be used in commands to name the lights, as
+// the firmware's THIS_DEVICE_COLOR_MAP (which should match ConfigData.Colors).
+func NewEmulator(colors string) *Emulator {
+	return &Emulator{
+		Lights:  make([]bool, FirmwareLights),
+		colors:  colors,
+		flasher: blinker{on: FlashInterval},
+		strober: blinker{on: StrobeOnTime, off: StrobeOffTime},
+	}
+}
+
+// Send feeds a command to the emulated device. It returns an error if the device would
+// reject any of it (in which case the device lights light #0 to signal the error) or
+// ignore any of it; in either case, the rest of the command is still acted upon as the
+// device would.
+//
+// Note that after each command, the firmware ignores everything it receives until
+// a ^D (\x04), so a string of several commands without ^D between them only has
+// the effect of the first.
+func (e *Emulator) Send(command string) error {
+	var problem error
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch e.state {
+		case endState, errorState:
+			if c == '\x04' {
+				e.state, e.buffer = idleState, nil
+			} else if problem == nil {
+				problem = fmt.Errorf("the device ignores \"%s\", since it waits for ^D after each command", command[i:])
+			}
+
+		case idleState:
+			switch c {
+			case '*':
+				e.state = strobeState
+			case 'F', 'f':
+				e.state = flashState
+			case 'S', 's':
+				e.state = lightSetState
+			case 'X', 'x':
+				e.flasher.stop()
+				e.strober.stop()
+				e.allOff()
+				e.state = endState
+			case '?', 'Q', 'q':
+				e.state = endState
+			case '=':
+				e.state, e.skip = setState, 4
+			default:
+				e.error(&problem, command, i)
+			}
+
+		case flashState, strobeState:
+			b := &e.flasher
+			if e.state == strobeState {
+				b = &e.strober
+			}
+			if c == '\x1b' || c == '$' {
+				b.stop()
+				b.seq = e.buffer
+				b.start(e)
+				e.state, e.buffer = endState, nil
+			} else if code, ok := e.lightCode(c); !ok {
+				e.error(&problem, command, i)
+			} else if len(e.buffer) < maxSequence {
+				e.buffer = append(e.buffer, code)
+			}
+
+		case lightSetState:
+			e.allOff()
+			if code, ok := e.lightCode(c); !ok {
+				e.error(&problem, command, i)
+			} else {
+				e.setLight(code, true)
+				e.state = endState
+			}
+
+		case setState:
+			// We don't emulate the device's address and speed settings.
+			if e.skip--; e.skip == 0 {
+				e.state = endState
+			}
+		}
+	}
+	return problem
+}
+
+// error puts the emulated device into its error state, as it does when it can't
+// understand command[i].
+func (e *Emulator) error(problem *error, command string, i int) {
+	e.setLight(0, true)
+	e.state = errorState
+	if *problem == nil {
+		*problem = fmt.Errorf("the device rejects \"%s\" at \"%s\"", command, command[i:])
+	}
+}
+
+// lightCode works out which light a character in a command names, as the firmware does.
+func (e *Emulator) lightCode(c byte) (byte, bool) {
+	if c == '_' {
+		return LightOff, true
+	}
+	for i := 0; i < len(e.colors); i++ {
+		if e.colors[i] == c {
+			return byte(i), true
+		}
+	}
+	if c >= '0' && c <= '9' {
+		if int(c-'0') >= FirmwareLights {
+			return LightOff, true
+		}
+		return c - '0', true
+	}
+	return 0, false
+}
+
+func (e *Emulator) setLight(code byte, on bool) {
+	if int(code) < len(e.Lights) {
+		e.Lights[code] = on
+	}
+}
+
+func (e *Emulator) allOff() {
+	for i := range e.Lights {
+		e.Lights[i] = false
+	}
+}
+
+// Advance lets the given amount of time pass, with the flasher and strober doing
+// whatever they would in that time.
+func (e *Emulator) Advance(d time.Duration) {
+	until := e.Now + d
+	for {
+		next, ok := e.NextChange()
+		if !ok || e.Now+next > until {
+			break
+		}
+		e.Now += next
+		// The firmware updates the flasher first, so it goes first if both are due.
+		if e.flasher.running && e.flasher.due == e.Now {
+			e.flasher.step(e)
+		} else {
+			e.strober.step(e)
+		}
+	}
+	e.Now = until
+}
+
+// NextChange reports how long it will be until the flasher or strober next does something,
+// or false if neither is running.
+func (e *Emulator) NextChange() (time.Duration, bool) {
+	switch {
+	case e.flasher.running && (!e.strober.running || e.flasher.due <= e.strober.due):
+		return e.flasher.due - e.Now, true
+	case e.strober.running:
+		return e.strober.due - e.Now, true
+	}
+	return 0, false
+}
+
+// Cycle reports how long it takes for the flasher and strober to come back around to
+// where they started, after which the lights repeat what they did, or zero if neither
+// is running.
+func (e *Emulator) Cycle() time.Duration {
+	var cycle time.Duration
+	for _, b := range []*blinker{&e.flasher, &e.strober} {
+		if !b.running {
+			continue
+		}
+		period := time.Duration(len(b.seq)) * (b.on + b.off)
+		if len(b.seq) == 1 && b.off == 0 {
+			period = 2 * b.on
+		}
+		if cycle == 0 {
+			cycle = period
+		} else {
+			cycle = lcm(cycle, period)
+		}
+	}
+	return cycle
+}
+
+func lcm(a, b time.Duration) time.Duration {
+	x, y := a, b
+	for y != 0 {
+		x, y = y, x%y
+	}
+	return a / x * b
+}
+
+func (b *blinker) start(e *Emulator) {
+	if len(b.seq) == 0 {
+		b.stop()
+		return
+	}
+	b.running, b.index, b.lit = true, 0, true
+	e.setLight(b.seq[0], true)
+	b.due = e.Now + b.on
+}
+
+// stop stops the blinker where it is, leaving any light it had lit still lit.
+func (b *blinker) stop() {
+	b.running = false
+	b.seq = nil
+}
+
+// step does what the firmware's LightBlinker::advance does when its timer goes off.
+func (b *blinker) step(e *Emulator) {
+	switch {
+	case len(b.seq) < 2:
+		// A single light just goes on and off.
+		b.lit = !b.lit
+		e.setLight(b.seq[0], b.lit)
+		if b.lit || b.off == 0 {
+			b.due += b.on
+		} else {
+			b.due += b.off
+		}
+
+	case b.off == 0:
+		// Move straight on to the next light.
+		e.setLight(b.seq[b.index], false)
+		b.index = (b.index + 1) % len(b.seq)
+		e.setLight(b.seq[b.index], true)
+		b.due += b.on
+
+	case b.lit:
+		e.setLight(b.seq[b.index], false)
+		b.lit = false
+		b.due += b.off
+
+	default:
+		b.index = (b.index + 1) % len(b.seq)
+		e.setLight(b.seq[b.index], true)
+		b.lit = true
+		b.due += b.on
+	}
+}
@@ -0,0 +1,196 @@
+package busylight
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The color map the firmware is shipped with (THIS_DEVICE_COLOR_MAP in busylight.ino).
+const firmwareColors = "BRrYG"
+
+// sendAll sends commands to a new emulator, failing the test if the device wouldn't take them.
+func sendAll(t *testing.T, commands ...string) *Emulator {
+	t.Helper()
+	e := NewEmulator(firmwareColors)
+	for _, command := range commands {
+		if err := e.Send(command); err != nil {
+			t.Fatalf("%q: %v", command, err)
+		}
+	}
+	return e
+}
+
+func TestEmulatorCommands(t *testing.T) {
+	for _, test := range []struct {
+		command string
+		want    string
+		problem string
+	}{
+		{"S3", "---X---", ""},
+		{"S3\x04S4", "----X--", ""},
+		{"S3\x04X", "-------", ""},
+		{"F12$", "-X-----", ""},
+		{"*5\x1b", "-----X-", ""},
+		// Letters name lights as in THIS_DEVICE_COLOR_MAP (which is case-sensitive),
+		// and digits name them whether or not they have a letter.
+		{"SB", "X------", ""},
+		{"SR", "-X-----", ""},
+		{"Sr", "--X----", ""},
+		{"SG", "----X--", ""},
+		{"S6", "------X", ""},
+		// "_" and digits beyond the lights the firmware drives name no light at all.
+		{"S_", "-------", ""},
+		{"S9", "-------", ""},
+		{"F_1$", "-------", ""},
+		// S turns the others off first, even those the flasher has lit.
+		{"F12$\x04S3", "---X---", ""},
+		// After each command, everything up to the next ^D is ignored.
+		{"S3S4", "---X---", "ignores \"S4\""},
+		{"F1$S4\x04S5", "-----X-", "ignores \"S4"},
+		// Anything the device doesn't understand lights light 0 and the rest of the
+		// command is ignored.
+		{"Z", "X------", "rejects \"Z\" at \"Z\""},
+		{"ZS3", "X------", "rejects \"ZS3\" at \"ZS3\""},
+		{"S3\x04SZ", "X------", "rejects"},
+		{"F1Z2$", "X------", "rejects \"F1Z2$\" at \"Z2$\""},
+		{"Sg", "X------", "rejects"},
+		// A ^D where a command should be is a mistake too.
+		{"\x04S3", "X------", "rejects"},
+		// The error light stays on until the next S or X.
+		{"Z\x04S3", "---X---", "rejects"},
+		{"Z\x04X", "-------", "rejects"},
+		// Queries and settings change nothing.
+		{"S3\x04?\x04Q\x04=1234\x04", "---X---", ""},
+	} {
+		e := NewEmulator(firmwareColors)
+		err := e.Send(test.command)
+		if got := litString(e.Lights); got != test.want {
+			t.Errorf("%q: lights %s, want %s", test.command, got, test.want)
+		}
+		switch {
+		case test.problem == "" && err != nil:
+			t.Errorf("%q: %v", test.command, err)
+		case test.problem != "" && (err == nil || !strings.Contains(err.Error(), test.problem)):
+			t.Errorf("%q: error %v, want one about %q", test.command, err, test.problem)
+		}
+	}
+}
+
+// lightsOver advances the emulator through each of the given times in turn, returning
+// what the lights show at each.
+func lightsOver(e *Emulator, times ...time.Duration) []string {
+	var shown []string
+	for _, at := range times {
+		e.Advance(at - e.Now)
+		shown = append(shown, litString(e.Lights))
+	}
+	return shown
+}
+
+func TestEmulatorTiming(t *testing.T) {
+	ms := time.Millisecond
+	for _, test := range []struct {
+		command string
+		times   []time.Duration
+		want    string
+	}{
+		// A single light flashes on and off every 200ms.
+		{"F1$", []time.Duration{0, 199 * ms, 200 * ms, 399 * ms, 400 * ms}, "-X----- -X----- ------- ------- -X-----"},
+		// Several go round in turn, each for 200ms.
+		{"F123$", []time.Duration{0, 200 * ms, 400 * ms, 600 * ms}, "-X----- --X---- ---X--- -X-----"},
+		// The strober flashes each light for 50ms, then waits 2s.
+		{"*1$", []time.Duration{0, 49 * ms, 50 * ms, 2049 * ms, 2050 * ms, 2100 * ms}, "-X----- -X----- ------- ------- -X----- -------"},
+		{"*12$", []time.Duration{0, 50 * ms, 2050 * ms, 2100 * ms, 4100 * ms}, "-X----- ------- --X---- ------- -X-----"},
+		// The flasher and strober run on top of the steady light, and of each other.
+		{"S6\x04F12$\x04*0$", []time.Duration{0, 50 * ms, 200 * ms}, "XX----X -X----X --X---X"},
+		// The flasher turns off the lights it leaves, even the steady one.
+		{"S2\x04F12$", []time.Duration{0, 200 * ms, 400 * ms}, "-XX---- --X---- -X-----"},
+		// S leaves the flasher running, and starting another flasher replaces it (leaving
+		// the old one's light lit).
+		{"F12$\x04S5", []time.Duration{0, 200 * ms}, "-----X- --X--X-"},
+		{"F12$\x04F34$", []time.Duration{0, 200 * ms}, "-X-X--- -X--X--"},
+		// X stops everything.
+		{"F12$\x04*3$\x04X", []time.Duration{0, time.Second, 3 * time.Second}, "------- ------- -------"},
+	} {
+		e := sendAll(t, test.command)
+		if got := strings.Join(lightsOver(e, test.times...), " "); got != test.want {
+			t.Errorf("%q: got %s, want %s", test.command, got, test.want)
+		}
+	}
+}
+
+func TestEmulatorLongSequence(t *testing.T) {
+	e := sendAll(t, "F"+strings.Repeat("0", maxSequence)+"1$")
+	for i := 0; i < maxSequence+1; i++ {
+		e.Advance(FlashInterval)
+		if e.Lights[1] {
+			t.Fatalf("light 1, beyond the longest sequence, lit after %v", e.Now)
+		}
+	}
+}
+
+func TestEmulatorNextChange(t *testing.T) {
+	e := sendAll(t, "S3")
+	if next, ok := e.NextChange(); ok {
+		t.Errorf("change due in %v with nothing running", next)
+	}
+	e = sendAll(t, "F12$\x04*0$")
+	e.Advance(150 * time.Millisecond)
+	if next, ok := e.NextChange(); !ok || next != 50*time.Millisecond {
+		t.Errorf("next change in %v (%v), want 50ms", next, ok)
+	}
+	e.Advance(2 * time.Second)
+	if next, ok := e.NextChange(); !ok || next != 50*time.Millisecond {
+		t.Errorf("next change in %v (%v), want 50ms for the strober", next, ok)
+	}
+}
+
+func TestEmulatorCycle(t *testing.T) {
+	ms := time.Millisecond
+	for _, test := range []struct {
+		command string
+		want    time.Duration
+	}{
+		{"S3", 0},
+		{"F1$", 400 * ms},
+		{"F12$", 400 * ms},
+		{"F123$", 600 * ms},
+		{"*0$", 2050 * ms},
+		{"*01$", 4100 * ms},
+		{"F123$\x04*0$", 24600 * ms},
+		{"F12$\x04*01$", 16400 * ms},
+	} {
+		e := sendAll(t, test.command)
+		cycle := e.Cycle()
+		if cycle != test.want {
+			t.Errorf("%q: cycle %v, want %v", test.command, cycle, test.want)
+		}
+		if cycle == 0 {
+			continue
+		}
+		// After the first time around, the lights do the same each time.
+		var first, second []string
+		for at := cycle; at < 2*cycle; at += 10 * ms {
+			first = append(first, lightsOver(e, at)...)
+		}
+		for at := 2 * cycle; at < 3*cycle; at += 10 * ms {
+			second = append(second, lightsOver(e, at)...)
+		}
+		if strings.Join(first, " ") != strings.Join(second, " ") {
+			t.Errorf("%q: lights don't repeat every %v", test.command, cycle)
+		}
+	}
+
+	for _, test := range []struct{ a, b, want time.Duration }{
+		{4, 6, 12},
+		{6, 4, 12},
+		{5, 5, 5},
+		{7, 1, 7},
+		{400 * ms, 2050 * ms, 16400 * ms},
+	} {
+		if got := lcm(test.a, test.b); got != test.want {
+			t.Errorf("lcm(%v, %v) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
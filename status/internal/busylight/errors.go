@@ -0,0 +1,28 @@
+package busylight
+
+import (
+	"errors"
+	"fmt"
+)
+
+// These are the kinds of trouble a client may want to tell apart. Errors returned
+// from this package which are of one of these kinds match it with errors.Is.
+var (
+	ErrNoDaemon    = errors.New("daemon not running")
+	ErrNoDevice    = errors.New("light device not found")
+	ErrBadResponse = errors.New("bad response")
+)
+
+// kindError is an error of one of the kinds above, which reads as its own message.
+type kindError struct {
+	kind    error
+	message string
+}
+
+func (e *kindError) Error() string        { return e.message }
+func (e *kindError) Is(target error) bool { return target == e.kind }
+
+// errorOfKind formats an error message (as fmt.Errorf does) for an error of the given kind.
+func errorOfKind(kind error, format string, a ...interface{}) error {
+	return &kindError{kind: kind, message: fmt.Sprintf(format, a...)}
+}
@@ -1,3 +1,3 @@
 module busylight
 
-go 1.16
+go 1.21
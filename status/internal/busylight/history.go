@@ -0,0 +1,110 @@
+package busylight
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// HistoryEntry records a change in what the daemon was showing. Each entry
+// remains in effect until the time of the next one.
+type HistoryEntry struct {
+	// When the change happened.
+	Time time.Time
+
+	// The status shown, the layer which offered it, and why.
+	Status string
+	Layer  string `json:",omitempty"`
+	Reason string `json:",omitempty"`
+
+	// The rule which chose the status, if any.
+	Rule string `json:",omitempty"`
+
+	// The activity going on, if any, and the titles of the calendars showing
+	// the user as busy.
+	Activity  string   `json:",omitempty"`
+	Calendars []string `json:",omitempty"`
+}
+
+// SameAs reports whether two entries record the same state of affairs (apart from when).
+func (e HistoryEntry) SameAs(other HistoryEntry) bool {
+	if e.Status != other.Status || e.Layer != other.Layer || e.Reason != other.Reason ||
+		e.Rule != other.Rule || e.Activity != other.Activity || len(e.Calendars) != len(other.Calendars) {
+		return false
+	}
+	for i := range e.Calendars {
+		if e.Calendars[i] != other.Calendars[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// HistoryPath returns the pathname of the file where the daemon records its
+// status history. If not explicitly configured, it lives alongside the PID file.
+func HistoryPath(config *ConfigData) string {
+	if config.HistoryFile != "" {
+		return config.HistoryFile
+	}
+	return filepath.Join(filepath.Dir(config.PidFile), "history.jsonl")
+}
+
+// AppendHistory adds an entry to the end of the history file, one JSON object per line.
+func AppendHistory(path string, entry HistoryEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("Unable to encode history entry: %v", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to open history file: %v", err)
+	}
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("Unable to write history file: %v", err)
+	}
+	return f.Close()
+}
+
+// ReadHistory returns the entries from the history file which were in effect at any
+// time from `from` up to (but not including) `to`. This includes the last entry before
+// `from`, since that's what was being shown at the start of the range. A zero `from`
+// or `to` leaves that end of the range open. Lines which can't be understood (such as
+// one left half-written by a crash) are skipped, with a warning to the logger.
+func ReadHistory(path string, from, to time.Time, logger *slog.Logger) ([]HistoryEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open history file: %v", err)
+	}
+	defer f.Close()
+
+	var entries []HistoryEntry
+	var before *HistoryEntry // the latest entry before `from`
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var e HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			logger.Warn("Skipping unreadable history entry", "file", path, "line", line, "err", err)
+			continue
+		}
+		switch {
+		case !to.IsZero() && !e.Time.Before(to):
+			// too late
+		case !from.IsZero() && !e.Time.After(from):
+			before = &e
+		default:
+			entries = append(entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to read history file: %v", err)
+	}
+	if before != nil {
+		entries = append([]HistoryEntry{*before}, entries...)
+	}
+	return entries, nil
+}
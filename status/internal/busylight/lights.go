@@ -0,0 +1,213 @@
+package busylight
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// These are the timings the device's firmware uses to animate the lights.
+const (
+	FlashInterval  = 200 * time.Millisecond  // each step of the flasher (a single light is on, then off, for this long)
+	StrobeOnTime   = 50 * time.Millisecond   // how long each light in the strober sequence flashes
+	StrobeOffTime  = 2000 * time.Millisecond // how long the strober waits between flashes
+	strobeInterval = StrobeOnTime + StrobeOffTime
+)
+
+// LightPattern describes what the device displays as a result of one or more
+// commands sent to it. The device has a steady light and a flasher (each of which
+// may be on without the other), plus an independent strober which runs on top of them.
+type LightPattern struct {
+	// The LED lit steadily, or 0 if none. This is the LED name as sent in the
+	// command (usually a digit).
+	Steady byte
+
+	// The flasher sequence, or empty if not flashing.
+	Flash []byte
+
+	// The strober sequence, or empty if not strobing.
+	Strobe []byte
+}
+
+// Apply updates the pattern to reflect the effect of sending the given raw command
+// string to the device. The commands understood are those described in the
+// busylight(1) manual page: X, S, F, and *, each ended by a ^D. As on the device,
+// only X clears everything: S leaves the flasher running and F leaves the steady
+// light lit. Also as on the device, anything after a command up to the next ^D is
+// ignored.
+func (p *LightPattern) Apply(command string) error {
+	for i := 0; i < len(command); i++ {
+		switch command[i] {
+		case '\x04':
+			continue
+
+		case 'X', 'x':
+			*p = LightPattern{}
+
+		case 'S', 's':
+			if i+1 >= len(command) {
+				return fmt.Errorf("command \"%s\": S without a light number", command)
+			}
+			i++
+			p.Steady = command[i]
+
+		case 'F', 'f', '*':
+			end := strings.IndexAny(command[i+1:], "$\x1b")
+			if end < 0 {
+				return fmt.Errorf("command \"%s\": unterminated %c sequence", command, command[i])
+			}
+			var sequence []byte
+			if end > 0 {
+				sequence = []byte(command[i+1 : i+1+end])
+			}
+			if command[i] == '*' {
+				p.Strobe = sequence
+			} else {
+				p.Flash = sequence
+			}
+			i += end + 1
+
+		default:
+			return fmt.Errorf("command \"%s\": can't interpret '%c'", command, command[i])
+		}
+
+		end := strings.IndexByte(command[i+1:], '\x04')
+		if end < 0 {
+			return nil
+		}
+		i += end + 1
+	}
+	return nil
+}
+
+// LitAt reports which of the device's lights are lit at a given time after it started
+// showing the pattern, by playing the pattern's command on an Emulator of the device.
+// The colors are the letters which may name the lights (see NewEmulator).
+func (p LightPattern) LitAt(colors string, elapsed time.Duration, lights int) []bool {
+	device := NewEmulator(colors)
+	device.Send(p.Command())
+	// Once the flasher and strober have been all the way around, the lights repeat
+	// what they did (the first time around may differ, if the flasher turns off a light
+	// left on by S), so there's no need to go on any longer than that.
+	if cycle := device.Cycle(); cycle > 0 && elapsed >= cycle {
+		elapsed = cycle + elapsed%cycle
+	}
+	device.Advance(elapsed)
+
+	lit := make([]bool, lights)
+	copy(lit, device.Lights)
+	return lit
+}
+
+// lightPatternJSON is how a LightPattern is represented in JSON, with each
+// part as a string of LED names rather than a number or an array of them.
+type lightPatternJSON struct {
+	Steady string `json:",omitempty"`
+	Flash  string `json:",omitempty"`
+	Strobe string `json:",omitempty"`
+}
+
+// MarshalJSON represents the pattern as a JSON object such as {"Steady":"3","Strobe":"4"}.
+func (p LightPattern) MarshalJSON() ([]byte, error) {
+	var j lightPatternJSON
+	if p.Steady != 0 {
+		j.Steady = string(p.Steady)
+	}
+	j.Flash, j.Strobe = string(p.Flash), string(p.Strobe)
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON reads a pattern written by MarshalJSON.
+func (p *LightPattern) UnmarshalJSON(data []byte) error {
+	var j lightPatternJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if len(j.Steady) > 1 {
+		return fmt.Errorf("steady light \"%s\" is more than one LED", j.Steady)
+	}
+	*p = LightPattern{}
+	if j.Steady != "" {
+		p.Steady = j.Steady[0]
+	}
+	if j.Flash != "" {
+		p.Flash = []byte(j.Flash)
+	}
+	if j.Strobe != "" {
+		p.Strobe = []byte(j.Strobe)
+	}
+	return nil
+}
+
+// Command returns a command string which will make the device display this pattern,
+// regardless of what it was displaying before. Since S, F, and * each leave the
+// others alone, it starts with X to clear everything, and since the device ignores
+// everything after a command until it gets a ^D, the commands are separated by ^D.
+func (p LightPattern) Command() string {
+	commands := []string{"X"}
+	if p.Steady != 0 {
+		commands = append(commands, "S"+string(p.Steady))
+	}
+	if len(p.Flash) > 0 {
+		commands = append(commands, "F"+string(p.Flash)+"$")
+	}
+	if len(p.Strobe) > 0 {
+		commands = append(commands, "*"+string(p.Strobe)+"$")
+	}
+	return strings.Join(commands, "\x04")
+}
+
+// StatusPattern returns what the device displays for the named status (which may
+// be several statuses joined with "+"), starting from all lights off.
+func StatusPattern(config *ConfigData, name string) (LightPattern, error) {
+	var pattern LightPattern
+
+	command, err := StatusCommand(config, name)
+	if err != nil {
+		return pattern, err
+	}
+	if err = pattern.Apply(command); err != nil {
+		return pattern, fmt.Errorf("status \"%s\": %v", name, err)
+	}
+	return pattern, nil
+}
+
+// ComposeStatus combines multiple named statuses into a single command string which
+// displays all of them at once. Each status's pattern is taken in order, so where two
+// statuses both set the main display (the steady light and flasher), or both set the
+// strober, the later one wins. For example, composing "busy" (S3) with "lowpri" (*4$)
+// yields "X^DS3^D*4$" (where ^D is \x04).
+func ComposeStatus(config *ConfigData, names []string) (string, error) {
+	var pattern LightPattern
+
+	for _, name := range names {
+		command, err := StatusCommand(config, name)
+		if err != nil {
+			return "", err
+		}
+		var p LightPattern
+		if err = p.Apply(command); err != nil {
+			return "", fmt.Errorf("unable to combine status \"%s\": %v", name, err)
+		}
+		if p.Steady != 0 || len(p.Flash) > 0 {
+			pattern.Steady, pattern.Flash = p.Steady, p.Flash
+		}
+		if len(p.Strobe) > 0 {
+			pattern.Strobe = p.Strobe
+		}
+	}
+	return pattern.Command(), nil
+}
+
+// ShowStatus makes the device display exactly the named status (which may be several
+// names joined with "+"), and nothing else. Unlike LightSignal, which sends the
+// status's command as-is, this also clears anything left over from previous commands
+// which the status doesn't mention, such as a strober left running.
+func ShowStatus(config *ConfigData, devState *DevState, name string, delay time.Duration) error {
+	command, err := ComposeStatus(config, strings.Split(name, "+"))
+	if err != nil {
+		return err
+	}
+	return RawLightSignal(config, devState, command, delay)
+}
@@ -0,0 +1,137 @@
+package busylight
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// litString shows which lights are lit, such as "-X--".
+func litString(lit []bool) string {
+	s := make([]byte, len(lit))
+	for i, on := range lit {
+		s[i] = '-'
+		if on {
+			s[i] = 'X'
+		}
+	}
+	return string(s)
+}
+
+func TestLitAt(t *testing.T) {
+	const colors = "GYRBW"
+	for _, test := range []struct {
+		pattern LightPattern
+		elapsed time.Duration
+		want    string
+	}{
+		{LightPattern{}, 0, "-------"},
+		{LightPattern{Steady: '3'}, time.Hour, "---X---"},
+		// Letters name lights as they do on the device.
+		{LightPattern{Steady: 'R'}, 0, "--X----"},
+		{LightPattern{Strobe: []byte("G")}, 10 * time.Millisecond, "X------"},
+		// So do digits, but not those beyond the lights the firmware drives.
+		{LightPattern{Steady: '8'}, 0, "-------"},
+		// A single light flashes on and off.
+		{LightPattern{Flash: []byte("1")}, 100 * time.Millisecond, "-X-----"},
+		{LightPattern{Flash: []byte("1")}, 300 * time.Millisecond, "-------"},
+		// Several go round in turn.
+		{LightPattern{Flash: []byte("12")}, 300 * time.Millisecond, "--X----"},
+		{LightPattern{Flash: []byte("12")}, 400 * time.Millisecond, "-X-----"},
+		// The strober is only lit briefly, on top of everything else.
+		{LightPattern{Steady: '4', Strobe: []byte("05")}, 0, "X---X--"},
+		{LightPattern{Steady: '4', Strobe: []byte("05")}, time.Second, "----X--"},
+		{LightPattern{Steady: '4', Strobe: []byte("05")}, strobeInterval, "----XX-"},
+		// Long after starting, the lights are where the device would have them.
+		{LightPattern{Flash: []byte("12"), Strobe: []byte("05")}, 100*strobeInterval + 10*time.Millisecond, "X-X----"},
+		// The flasher turns off a steady light it goes through, and it stays off.
+		{LightPattern{Steady: '2', Flash: []byte("12")}, 100 * time.Millisecond, "-XX----"},
+		{LightPattern{Steady: '2', Flash: []byte("12")}, time.Hour + 100*time.Millisecond, "-X-----"},
+	} {
+		if got := litString(test.pattern.LitAt(colors, test.elapsed, FirmwareLights)); got != test.want {
+			t.Errorf("%s after %v: got %s, want %s", test.pattern.Command(), test.elapsed, got, test.want)
+		}
+	}
+
+	if got := litString(LightPattern{Steady: 'W'}.LitAt(colors, 0, 3)); got != "---" {
+		t.Errorf("got %s with only 3 lights", got)
+	}
+}
+
+func TestApply(t *testing.T) {
+	for _, test := range []struct {
+		start   LightPattern
+		command string
+		want    string // the pattern's Command, or the start of the error
+	}{
+		{LightPattern{}, "S3", "X\x04S3"},
+		{LightPattern{}, "s3", "X\x04S3"},
+		{LightPattern{}, "F12$", "X\x04F12$"},
+		{LightPattern{}, "f12\x1b", "X\x04F12$"},
+		{LightPattern{}, "*4$", "X\x04*4$"},
+		// S leaves the flasher running, and F leaves the steady light.
+		{LightPattern{Flash: []byte("12")}, "S3", "X\x04S3\x04F12$"},
+		{LightPattern{Steady: '3'}, "F12$", "X\x04S3\x04F12$"},
+		// Only X clears everything.
+		{LightPattern{Steady: '3', Flash: []byte("12"), Strobe: []byte("4")}, "X", "X"},
+		{LightPattern{Steady: '3', Flash: []byte("12"), Strobe: []byte("4")}, "x\x04S5", "X\x04S5"},
+		// An empty sequence stops the flasher or strober.
+		{LightPattern{Steady: '3', Strobe: []byte("4")}, "*$", "X\x04S3"},
+		// Everything after a command up to the next ^D is ignored...
+		{LightPattern{}, "S3S4", "X\x04S3"},
+		{LightPattern{}, "S3 and the rest\x04*4$", "X\x04S3\x04*4$"},
+		{LightPattern{}, "F1$S2\x04", "X\x04F1$"},
+		{LightPattern{}, "S3\x04", "X\x04S3"},
+		// Mistakes are reported.
+		{LightPattern{}, "S", "command \"S\": S without a light number"},
+		{LightPattern{}, "F12", "command \"F12\": unterminated F sequence"},
+		{LightPattern{}, "S3\x04*4", "command \"S3\x04*4\": unterminated * sequence"},
+		{LightPattern{}, "Z", "command \"Z\": can't interpret 'Z'"},
+	} {
+		p := test.start
+		var got string
+		if err := p.Apply(test.command); err != nil {
+			got = err.Error()
+		} else {
+			got = p.Command()
+		}
+		if got != test.want {
+			t.Errorf("%q applied to %q: got %q, want %q", test.command, test.start.Command(), got, test.want)
+		}
+	}
+}
+
+func TestComposeStatus(t *testing.T) {
+	config := &ConfigData{StatusLights: map[string]string{
+		"lowpri":  "*4$",
+		"urgent":  "*1$",
+		"meeting": "S2\x04F56$",
+		"blink":   "F3$",
+		"broken":  "F3",
+	}}
+	for _, test := range []struct {
+		names string
+		want  string
+	}{
+		{"busy", "X\x04S3"},
+		{"busy+lowpri", "X\x04S3\x04*4$"},
+		// A later status wins the steady and flasher lights...
+		{"busy+free", "X\x04S4"},
+		{"meeting+busy", "X\x04S3"},
+		{"busy+blink", "X\x04F3$"},
+		// ...and the strober, but a status without one leaves it alone.
+		{"lowpri+urgent", "X\x04*1$"},
+		{"busy+lowpri+free", "X\x04S4\x04*4$"},
+		{"off+lowpri", "X\x04*4$"},
+		{"nonesuch+busy", "undefined color code \"nonesuch\""},
+		{"busy+broken", "unable to combine status \"broken\": command \"F3\": unterminated F sequence"},
+	} {
+		got, err := ComposeStatus(config, strings.Split(test.names, "+"))
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.names, got, test.want)
+		}
+	}
+}
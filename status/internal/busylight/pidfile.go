@@ -0,0 +1,135 @@
+package busylight
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// DaemonName is the name of the daemon program, which is how we recognize its processes.
+const DaemonName = "busylightd"
+
+// LockPidFile claims the PID file for this process, so that only one daemon runs at a
+// time. The file stays locked (via flock) for as long as the returned file is open, so
+// the lock is released automatically however the process ends, and a PID file left
+// behind by a daemon which crashed doesn't get in the way.
+//
+// If the file named a different process, that PID is returned as well (unless that
+// process is still a running daemon, which is an error).
+func LockPidFile(path string) (*os.File, int, error) {
+	var f *os.File
+	for {
+		var err error
+		if f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644); err != nil {
+			return nil, 0, fmt.Errorf("Unable to open PID file: %v", err)
+		}
+		if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			pid, _ := readPid(f)
+			f.Close()
+			if err == syscall.EWOULDBLOCK {
+				return nil, 0, fmt.Errorf("%s is already running (PID %d)", DaemonName, pid)
+			}
+			return nil, 0, fmt.Errorf("Unable to lock PID file: %v", err)
+		}
+
+		// If the daemon which held the lock before us removed the file as it exited,
+		// we've locked a file nobody else can see, so try again.
+		held, err1 := f.Stat()
+		named, err2 := os.Stat(path)
+		if err1 == nil && err2 == nil && os.SameFile(held, named) {
+			break
+		}
+		f.Close()
+	}
+
+	// Older versions of the daemon didn't lock the file, so make sure the PID in it
+	// isn't one of those still running.
+	stale, _ := readPid(f)
+	if stale == os.Getpid() {
+		stale = 0
+	} else if IsDaemonProcess(stale) {
+		f.Close()
+		return nil, 0, fmt.Errorf("%s is already running (PID %d)", DaemonName, stale)
+	}
+
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("Unable to write PID file: %v", err)
+	}
+	if _, err := f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0); err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("Unable to write PID file: %v", err)
+	}
+	return f, stale, nil
+}
+
+// DaemonPID returns the PID of the running daemon according to its PID file, or 0 if
+// the daemon isn't running. A PID is only returned if the daemon holds the lock on the
+// file, or (for older versions of the daemon, which didn't lock it) if that process
+// really is the daemon. This never contacts the daemon itself, so it won't start one
+// which is waiting to be activated by its socket.
+func DaemonPID(config *ConfigData) int {
+	f, err := os.Open(config.PidFile)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	pid, err := readPid(f)
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		return pid
+	}
+	if !IsDaemonProcess(pid) {
+		return 0
+	}
+	return pid
+}
+
+// IsDaemonProcess reports whether the process with the given PID is a running daemon.
+// If we can't tell what program the process is running, we assume it isn't ours.
+func IsDaemonProcess(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return false
+	}
+	name, err := processName(pid)
+	return err == nil && name == DaemonName
+}
+
+// processName returns the name of the program a process is running.
+func processName(pid int) (string, error) {
+	if _, err := os.Stat("/proc/self"); err == nil {
+		comm, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "comm"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(comm)), nil
+	}
+
+	// No /proc filesystem (e.g., on macOS), so ask ps instead.
+	output, err := exec.Command("ps", "-o", "comm=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(strings.TrimSpace(string(output))), nil
+}
+
+// readPid reads the PID recorded in a PID file.
+func readPid(f *os.File) (int, error) {
+	data, err := io.ReadAll(io.NewSectionReader(f, 0, 64))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(bytes.TrimSpace(data)))
+}